@@ -0,0 +1,146 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/neovim/go-client/msgpack"
+)
+
+// RawArgs is the MessagePack encoded arguments array of an incoming call or
+// notification.
+type RawArgs struct {
+	data       []byte
+	extensions msgpack.ExtensionMap
+}
+
+// compile time check whether the RawArgs implements msgpack.Marshaler interface.
+var _ msgpack.Marshaler = RawArgs{}
+
+// Bytes returns the MessagePack encoding of the arguments array.
+func (a RawArgs) Bytes() []byte {
+	return a.data
+}
+
+// Decode decodes the arguments array to v. Use a struct with the
+// msgpack:",array" tag on the first field to decode the arguments by
+// position.
+func (a RawArgs) Decode(v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(a.data))
+	dec.SetExtensions(a.extensions)
+	return dec.Decode(v)
+}
+
+// Values returns the decoded arguments.
+func (a RawArgs) Values() ([]any, error) {
+	var values []any
+	err := a.Decode(&values)
+	return values, err
+}
+
+// MarshalMsgPack implements msgpack.Marshaler. The arguments are encoded as
+// an array.
+func (a RawArgs) MarshalMsgPack(enc *msgpack.Encoder) error {
+	return enc.PackRaw(a.data)
+}
+
+// WithFallbackHandler configures Endpoint to call fn for requests and
+// notifications with no registered handler. The return values of fn are sent
+// to the peer as the reply to a request. Notifications are processed in the
+// default lane.
+//
+// Without a fallback handler, requests for unknown methods are replied with an
+// error and notifications for unknown methods are logged and dropped.
+func WithFallbackHandler(fn func(method string, args RawArgs) (any, error)) Option {
+	return Option{func(e *Endpoint) {
+		if fn == nil {
+			e.fallback = nil
+			return
+		}
+		e.fallback = e.newRawHandler(func(_ context.Context, method string, _ bool, args RawArgs) (any, error) {
+			return fn(method, args)
+		})
+	}}
+}
+
+// newRawHandler returns a handler that calls fn with the raw arguments of the
+// call or notification.
+func (e *Endpoint) newRawHandler(fn func(ctx context.Context, method string, notification bool, args RawArgs) (any, error)) *handler {
+	return &handler{
+		decode: func(method string, notification bool, dec *msgpack.Decoder) (func(context.Context) (any, error), any, error) {
+			args := RawArgs{data: []byte{emptyArray}, extensions: e.extensions}
+			if dec != nil {
+				var buf bytes.Buffer
+				if err := copyValue(dec, msgpack.NewEncoder(&buf)); err != nil {
+					return nil, nil, err
+				}
+				args.data = buf.Bytes()
+			}
+			return func(ctx context.Context) (any, error) {
+				return fn(ctx, method, notification, args)
+			}, args, nil
+		},
+	}
+}
+
+// copyValue copies the next value in the stream from dec to enc.
+func copyValue(dec *msgpack.Decoder, enc *msgpack.Encoder) error {
+	if err := dec.Unpack(); err != nil {
+		return err
+	}
+	return copyUnpackedValue(dec, enc)
+}
+
+// copyUnpackedValue copies the value starting at the current token of dec to
+// enc.
+func copyUnpackedValue(dec *msgpack.Decoder, enc *msgpack.Encoder) error {
+	for n := 1; ; {
+		var err error
+		switch dec.Type() {
+		case msgpack.Nil:
+			err = enc.PackNil()
+		case msgpack.Bool:
+			err = enc.PackBool(dec.Bool())
+		case msgpack.Int:
+			err = enc.PackInt(dec.Int())
+		case msgpack.Uint:
+			err = enc.PackUint(dec.Uint())
+		case msgpack.Float:
+			err = enc.PackFloat(dec.Float())
+		case msgpack.String:
+			err = enc.PackStringBytes(dec.BytesNoCopy())
+		case msgpack.Binary:
+			err = enc.PackBinary(dec.BytesNoCopy())
+		case msgpack.Extension:
+			err = enc.PackExtension(dec.Extension(), dec.BytesNoCopy())
+		case msgpack.ArrayLen:
+			err = enc.PackArrayLen(int64(dec.Len()))
+			n += dec.Len()
+		case msgpack.MapLen:
+			err = enc.PackMapLen(int64(dec.Len()))
+			n += 2 * dec.Len()
+		default:
+			err = fmt.Errorf("msgpack/rpc: unexpected type %s", dec.Type())
+		}
+		if err != nil {
+			return err
+		}
+
+		if n--; n == 0 {
+			return nil
+		}
+		if err := dec.Unpack(); err != nil {
+			return err
+		}
+	}
+}
+
+// Unregister removes the handler for the specified method name. Requests and
+// notifications for the method received after Unregister returns are handled
+// as unknown methods.
+func (e *Endpoint) Unregister(method string) {
+	e.handlersMu.Lock()
+	delete(e.handlers, method)
+	e.handlersMu.Unlock()
+}
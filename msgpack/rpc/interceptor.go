@@ -0,0 +1,89 @@
+package rpc
+
+import (
+	"context"
+	"reflect"
+)
+
+// CallInfo describes a call or notification passed to an interceptor.
+type CallInfo struct {
+	// Reply is the pointer to the result of an outgoing call. Reply is nil for
+	// notifications and incoming calls.
+	Reply any
+
+	// Method is the method name.
+	Method string
+
+	// Args is the arguments of the call. Client interceptors can change Args
+	// before calling the invoker. For incoming calls, Args is the decoded
+	// arguments sent by the peer and changes to Args are not seen by the
+	// handler. For handlers registered with Handle, Args is the decoded Args
+	// value.
+	Args []any
+
+	// Notification is true when the message is a notification.
+	Notification bool
+
+	// call, in and numOut are used to call the handler registered with
+	// Register for incoming calls.
+	call   func([]reflect.Value) []reflect.Value
+	in     []reflect.Value
+	numOut int
+
+	// invoke calls a handler registered with Handle.
+	invoke func(context.Context) (any, error)
+}
+
+// Invoker sends an outgoing call or notification to the peer. For calls,
+// Invoker waits for the response and stores the result in info.Reply.
+type Invoker func(ctx context.Context, info *CallInfo) error
+
+// ClientInterceptor intercepts outgoing calls and notifications. The
+// interceptor must call invoker to send the message to the peer.
+//
+// Calls made with the Go method are intercepted in a new goroutine.
+type ClientInterceptor func(ctx context.Context, info *CallInfo, invoker Invoker) error
+
+// Handler calls the handler registered for an incoming call or notification.
+type Handler func(ctx context.Context, info *CallInfo) (any, error)
+
+// ServerInterceptor intercepts incoming calls and notifications. The
+// interceptor must call handler to run the registered handler. The returned
+// value and error are sent to the peer as the reply to a call.
+type ServerInterceptor func(ctx context.Context, info *CallInfo, handler Handler) (any, error)
+
+// WithClientInterceptor adds interceptors for outgoing calls and
+// notifications. The first interceptor is the outermost.
+func WithClientInterceptor(interceptors ...ClientInterceptor) Option {
+	return Option{func(e *Endpoint) {
+		e.clientInterceptors = append(e.clientInterceptors, interceptors...)
+	}}
+}
+
+// WithServerInterceptor adds interceptors for incoming calls and
+// notifications. The first interceptor is the outermost.
+func WithServerInterceptor(interceptors ...ServerInterceptor) Option {
+	return Option{func(e *Endpoint) {
+		e.serverInterceptors = append(e.serverInterceptors, interceptors...)
+	}}
+}
+
+func chainClientInterceptors(interceptors []ClientInterceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, info *CallInfo) error {
+			return interceptor(ctx, info, next)
+		}
+	}
+	return invoker
+}
+
+func chainServerInterceptors(interceptors []ServerInterceptor, handler Handler) Handler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, info *CallInfo) (any, error) {
+			return interceptor(ctx, info, next)
+		}
+	}
+	return handler
+}
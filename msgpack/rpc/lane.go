@@ -0,0 +1,65 @@
+package rpc
+
+import "fmt"
+
+// LaneFunc returns the key of the lane for a notification with the given
+// method and arguments. Notifications in the same lane are processed in order
+// by a single goroutine. Notifications in different lanes are processed
+// concurrently. The empty key selects the default lane, which is shared by
+// all handlers registered with Register.
+type LaneFunc func(method string, args []any) string
+
+// MethodLane is a LaneFunc that processes notifications for each method in a
+// separate lane.
+func MethodLane(method string, args []any) string {
+	return method
+}
+
+// FirstArgLane is a LaneFunc that processes notifications for each method and
+// first argument in a separate lane. Use FirstArgLane to process
+// notifications for different objects, such as Nvim buffers, concurrently.
+func FirstArgLane(method string, args []any) string {
+	if len(args) == 0 {
+		return method
+	}
+	return fmt.Sprintf("%s\x00%v", method, args[0])
+}
+
+// RegisterWithLane registers handler fn for the specified method name like
+// Register. Notifications for the method are processed in the lane returned
+// by lane instead of the default lane. Requests are not affected by lane.
+func (e *Endpoint) RegisterWithLane(method string, lane LaneFunc, fn any, args ...any) error {
+	h, err := newHandler(fn, args...)
+	if err != nil {
+		return err
+	}
+	h.lane = lane
+
+	e.handlersMu.Lock()
+	e.handlers[method] = h
+	e.handlersMu.Unlock()
+	return nil
+}
+
+// lane is a queue of notifications processed in order by a goroutine.
+type lane struct {
+	notifications []*notification
+}
+
+// runLane runs the notifications in lane l until the queue is empty.
+func (e *Endpoint) runLane(key string, l *lane) {
+	for {
+		e.notificationsMu.Lock()
+		if len(l.notifications) == 0 {
+			delete(e.lanes, key)
+			e.notificationsMu.Unlock()
+			return
+		}
+		n := l.notifications[0]
+		removeNotification(&l.notifications, 0)
+		e.notificationsSpaceCond.Broadcast()
+		e.notificationsMu.Unlock()
+
+		e.runNotification(n)
+	}
+}
@@ -0,0 +1,325 @@
+package rpc
+
+import (
+	"bufio"
+	"expvar"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/neovim/go-client/msgpack"
+)
+
+// LatencyBounds are the upper bounds of the buckets in a LatencyHistogram.
+// The last bucket of a histogram counts the latencies greater than the last
+// bound. LatencyBounds must not be modified.
+var LatencyBounds = []time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// LatencyHistogram is a distribution of call latencies.
+type LatencyHistogram struct {
+	// Counts is the number of calls in each bucket. Counts[i] is the number
+	// of calls with latency less than or equal to LatencyBounds[i] and
+	// greater than the previous bound. Counts[len(LatencyBounds)] is the
+	// number of calls with latency greater than the last bound.
+	Counts []uint64
+
+	// Sum is the total latency of the calls.
+	Sum time.Duration
+
+	// Max is the maximum latency of the calls.
+	Max time.Duration
+}
+
+func (h *LatencyHistogram) observe(d time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make([]uint64, len(LatencyBounds)+1)
+	}
+	i := 0
+	for i < len(LatencyBounds) && d > LatencyBounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Sum += d
+	if d > h.Max {
+		h.Max = d
+	}
+}
+
+// Count returns the number of calls in the histogram.
+func (h *LatencyHistogram) Count() uint64 {
+	var n uint64
+	for _, c := range h.Counts {
+		n += c
+	}
+	return n
+}
+
+// Mean returns the mean latency or zero if the histogram is empty.
+func (h *LatencyHistogram) Mean() time.Duration {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(n)
+}
+
+// Quantile returns an upper bound of the q-quantile latency for 0 <= q <= 1.
+// Quantile returns Max when the quantile falls in the last bucket.
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(n) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var c uint64
+	for i, count := range h.Counts {
+		c += count
+		if c >= rank && i < len(LatencyBounds) {
+			if LatencyBounds[i] > h.Max {
+				return h.Max
+			}
+			return LatencyBounds[i]
+		}
+	}
+	return h.Max
+}
+
+// MethodStats are the metrics for a method.
+type MethodStats struct {
+	// Latency is the distribution of the call latencies. The latency of an
+	// outgoing call is the time from sending the request to receiving the
+	// reply. The latency of an incoming call is the time to run the handler
+	// and send the reply. The latency of a notification is the time to send
+	// or handle the notification.
+	Latency LatencyHistogram
+
+	// Calls is the number of completed calls and notifications.
+	Calls uint64
+
+	// Errors is the number of calls that returned an error.
+	Errors uint64
+
+	// BytesSent is the number of bytes sent for the method including the
+	// replies to incoming calls.
+	BytesSent uint64
+
+	// BytesReceived is the number of bytes received for the method including
+	// the replies to outgoing calls.
+	BytesReceived uint64
+
+	// InFlight is the number of calls that are not completed.
+	InFlight int64
+}
+
+// OtherMethods is the method name under which CallStats reports the calls of
+// the methods that are not tracked individually. An Endpoint tracks at most
+// 256 methods for each direction.
+const OtherMethods = "(other)"
+
+// maxMethodStats is the number of methods tracked for each direction.
+const maxMethodStats = 256
+
+// WithCallStats enables the per-method metrics reported by CallStats. The
+// metrics are disabled by default.
+func WithCallStats() Option {
+	return Option{func(e *Endpoint) {
+		e.metrics.enabled = true
+	}}
+}
+
+// CallStats is a snapshot of the per-method metrics of an Endpoint.
+type CallStats struct {
+	// Outgoing are the metrics of the calls and notifications sent to the
+	// peer by method.
+	Outgoing map[string]MethodStats
+
+	// Incoming are the metrics of the calls and notifications received from
+	// the peer by method.
+	Incoming map[string]MethodStats
+}
+
+// CallStats returns a snapshot of the per-method metrics of the endpoint. The
+// snapshot is empty unless the endpoint was created with WithCallStats.
+func (e *Endpoint) CallStats() CallStats {
+	return e.metrics.snapshot()
+}
+
+// Expvar returns an expvar.Var that reports the CallStats of the endpoint.
+func (e *Endpoint) Expvar() expvar.Var {
+	return expvar.Func(func() any {
+		return e.CallStats()
+	})
+}
+
+// PublishExpvar publishes the CallStats of the endpoint as the expvar
+// variable name. PublishExpvar panics if name is already registered.
+func (e *Endpoint) PublishExpvar(name string) {
+	expvar.Publish(name, e.Expvar())
+}
+
+// direction of a call for metrics.
+type callDirection int
+
+// list of callDirection.
+const (
+	outgoingCall callDirection = iota
+	incomingCall
+)
+
+type metrics struct {
+	// enabled is set by WithCallStats and not changed afterwards.
+	enabled bool
+
+	methods [2]map[string]*MethodStats
+	mu      sync.Mutex
+}
+
+// stats returns the stats of method. The calls of new methods are counted
+// under OtherMethods once maxMethodStats methods are tracked, so that a peer
+// cannot grow the map without bound. The caller must hold mu.
+func (m *metrics) stats(dir callDirection, method string) *MethodStats {
+	s := m.methods[dir][method]
+	if s == nil {
+		if m.methods[dir] == nil {
+			m.methods[dir] = make(map[string]*MethodStats)
+		}
+		if len(m.methods[dir]) >= maxMethodStats {
+			method = OtherMethods
+			if s = m.methods[dir][method]; s != nil {
+				return s
+			}
+		}
+		s = &MethodStats{}
+		m.methods[dir][method] = s
+	}
+	return s
+}
+
+// begin counts a call as in flight and returns the start time of the call.
+// begin returns the zero time when the metrics are disabled.
+func (m *metrics) begin(dir callDirection, method string) time.Time {
+	if !m.enabled {
+		return time.Time{}
+	}
+	m.mu.Lock()
+	m.stats(dir, method).InFlight++
+	m.mu.Unlock()
+	return time.Now()
+}
+
+// end completes a call started with begin.
+func (m *metrics) end(dir callDirection, method string, start time.Time, err error) {
+	if !m.enabled {
+		return
+	}
+	d := time.Since(start)
+	m.mu.Lock()
+	s := m.stats(dir, method)
+	s.InFlight--
+	s.Calls++
+	if err != nil {
+		s.Errors++
+	}
+	s.Latency.observe(d)
+	m.mu.Unlock()
+}
+
+// transfer adds sent and received bytes to the stats of method.
+func (m *metrics) transfer(dir callDirection, method string, sent, received int64) {
+	if !m.enabled {
+		return
+	}
+	m.mu.Lock()
+	s := m.stats(dir, method)
+	s.BytesSent += uint64(sent)
+	s.BytesReceived += uint64(received)
+	m.mu.Unlock()
+}
+
+func (m *metrics) snapshot() CallStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copyStats := func(methods map[string]*MethodStats) map[string]MethodStats {
+		c := make(map[string]MethodStats, len(methods))
+		for method, s := range methods {
+			cs := *s
+			cs.Latency.Counts = append([]uint64(nil), s.Latency.Counts...)
+			c[method] = cs
+		}
+		return c
+	}
+	return CallStats{
+		Outgoing: copyStats(m.methods[outgoingCall]),
+		Incoming: copyStats(m.methods[incomingCall]),
+	}
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write implements io.Writer.
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// WriteString implements io.StringWriter.
+func (cw *countingWriter) WriteString(s string) (int, error) {
+	n, err := io.WriteString(cw.w, s)
+	cw.n += int64(n)
+	return n, err
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read implements io.Reader.
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// readOffset returns the number of bytes consumed by the decoder. It must be
+// called from the Serve goroutine.
+func (e *Endpoint) readOffset() int64 {
+	return e.cr.n - int64(e.br.Buffered())
+}
+
+// newReader returns the buffered reader used by the decoder. The decoder uses
+// a *bufio.Reader of msgpack.DecoderBufferSize bytes as is, so the number of
+// bytes consumed by the decoder is the number of bytes read from r minus the
+// bytes buffered in the reader.
+func (e *Endpoint) newReader(r io.Reader) *bufio.Reader {
+	e.cr = &countingReader{r: r}
+	e.br = bufio.NewReaderSize(e.cr, msgpack.DecoderBufferSize)
+	return e.br
+}
@@ -0,0 +1,40 @@
+package rpc
+
+import "net"
+
+// NewPipe returns two Endpoints connected by an in-memory transport. The
+// Serve loops of both endpoints are running. The options are applied to both
+// endpoints. Closing either endpoint closes the other. Without the WithLogf
+// option, the endpoints log with log.Printf.
+//
+// NewPipe is useful for testing handlers without a process or network
+// connection:
+//
+//	client, server, err := rpc.NewPipe()
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer client.Close()
+//	server.Register("add", func(a, b int) (int, error) { return a + b, nil })
+//	var sum int
+//	err = client.Call("add", &sum, 1, 2)
+func NewPipe(options ...Option) (a, b *Endpoint, err error) {
+	aConn, bConn := net.Pipe()
+
+	a, err = NewEndpoint(aConn, aConn, aConn, options...)
+	if err != nil {
+		aConn.Close()
+		bConn.Close()
+		return nil, nil, err
+	}
+	b, err = NewEndpoint(bConn, bConn, bConn, options...)
+	if err != nil {
+		aConn.Close()
+		bConn.Close()
+		return nil, nil, err
+	}
+
+	go a.Serve()
+	go b.Serve()
+	return a, b, nil
+}
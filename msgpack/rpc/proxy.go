@@ -0,0 +1,463 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/neovim/go-client/msgpack"
+)
+
+var (
+	// ErrMethodNotAllowed is returned to proxy clients for calls to methods
+	// rejected by the allowlist or denylist of the proxy.
+	ErrMethodNotAllowed = errors.New("msgpack/rpc: method not allowed")
+
+	// ErrRateLimited is returned to proxy clients for calls that exceed the
+	// rate limit of the client.
+	ErrRateLimited = errors.New("msgpack/rpc: rate limit exceeded")
+)
+
+// ProxyOption specifies an option for a Proxy.
+type ProxyOption struct {
+	f func(*Proxy)
+}
+
+// ProxyAllow restricts the methods that clients can call to methods matching
+// one of the patterns. The patterns use the syntax of path.Match, for example
+// "nvim_buf_*". All methods are allowed by default.
+func ProxyAllow(patterns ...string) ProxyOption {
+	return ProxyOption{func(p *Proxy) {
+		p.allow = append(p.allow, patterns...)
+	}}
+}
+
+// ProxyDeny forbids clients to call methods matching one of the patterns.
+// The patterns use the syntax of path.Match. The denylist is applied after
+// the allowlist.
+//
+// The deprecated method names that Nvim still accepts, such as vim_command
+// and buffer_set_lines, are also matched by their nvim_ names.
+//
+// A denylist is not a sandbox. Many methods run arbitrary commands, for
+// example nvim_call_function with "execute", nvim_eval, nvim_input and
+// nvim_feedkeys, and a denylist cannot cover methods added to Nvim in the
+// future. Use ProxyAllow to restrict untrusted clients.
+func ProxyDeny(patterns ...string) ProxyOption {
+	return ProxyOption{func(p *Proxy) {
+		p.deny = append(p.deny, patterns...)
+	}}
+}
+
+// ProxyRateLimit limits each client to rate requests and notifications per
+// second with bursts of up to burst messages. Requests over the limit are
+// replied with ErrRateLimited and notifications over the limit are dropped.
+// Clients are not rate limited by default.
+func ProxyRateLimit(rate float64, burst int) ProxyOption {
+	return ProxyOption{func(p *Proxy) {
+		p.rate = rate
+		p.burst = burst
+	}}
+}
+
+// ProxyClientOptions specifies the options for the Endpoints created for
+// client connections.
+func ProxyClientOptions(options ...Option) ProxyOption {
+	return ProxyOption{func(p *Proxy) {
+		p.clientOptions = append(p.clientOptions, options...)
+	}}
+}
+
+// ProxyLogf specifies function for logging output. The log.Printf function
+// is used by default.
+func ProxyLogf(logf func(string, ...any)) ProxyOption {
+	return ProxyOption{func(p *Proxy) {
+		p.logf = logf
+	}}
+}
+
+// Proxy forwards requests and notifications from many client connections to
+// one upstream Endpoint. Each client is served by its own Endpoint; requests
+// are sent upstream with ids assigned by the upstream Endpoint and the
+// replies are routed back to the client with the client's request id.
+//
+// Requests for methods rejected by the allowlist or denylist are replied
+// with ErrMethodNotAllowed without contacting the upstream peer. The calls in
+// a nvim_call_atomic request, including nested nvim_call_atomic calls, are
+// checked individually.
+//
+// Requests and notifications from the upstream peer are not forwarded. Use
+// Broadcast to send notifications to all clients, for example from a
+// fallback handler of the upstream Endpoint:
+//
+//	var p *rpc.Proxy
+//	upstream, err := rpc.NewEndpoint(r, w, c, rpc.WithFallbackHandler(func(method string, args rpc.RawArgs) (any, error) {
+//		return nil, p.Broadcast(method, args)
+//	}))
+//	...
+//	p = rpc.NewProxy(upstream, rpc.ProxyAllow("nvim_buf_get_*", "nvim_get_current_buf"))
+type Proxy struct {
+	upstream      *Endpoint
+	allow         []string
+	deny          []string
+	rate          float64
+	burst         int
+	clientOptions []Option
+	logf          func(string, ...any)
+
+	mu        sync.Mutex
+	closed    bool
+	clients   map[*Endpoint]struct{}
+	listeners map[net.Listener]struct{}
+}
+
+// NewProxy returns a proxy that forwards client requests and notifications to
+// upstream.
+func NewProxy(upstream *Endpoint, options ...ProxyOption) *Proxy {
+	p := &Proxy{
+		upstream:  upstream,
+		logf:      log.Printf,
+		clients:   make(map[*Endpoint]struct{}),
+		listeners: make(map[net.Listener]struct{}),
+	}
+	for _, option := range options {
+		option.f(p)
+	}
+	return p
+}
+
+// Serve accepts client connections on ln and serves each connection in a new
+// goroutine. Serve returns when ln.Accept fails or the proxy is closed. Serve
+// closes ln.
+func (p *Proxy) Serve(ln net.Listener) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		ln.Close()
+		return ErrClosed
+	}
+	p.listeners[ln] = struct{}{}
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.listeners, ln)
+		p.mu.Unlock()
+		ln.Close()
+	}()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+			if closed {
+				return ErrClosed
+			}
+			return err
+		}
+		go func() {
+			if err := p.ServeConn(c); err != nil {
+				p.logf("msgpack/rpc: proxy client %v: %v", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn serves a client connection. ServeConn blocks until the client
+// disconnects or the proxy is closed.
+func (p *Proxy) ServeConn(conn io.ReadWriteCloser) error {
+	var limiter *rateLimiter
+	if p.rate > 0 {
+		limiter = newRateLimiter(p.rate, p.burst)
+	}
+
+	options := append([]Option{WithLogf(p.logf)}, p.clientOptions...)
+	options = append(options, Option{func(e *Endpoint) {
+		e.fallback = e.newRawHandler(func(ctx context.Context, method string, notification bool, args RawArgs) (any, error) {
+			return p.forward(ctx, limiter, method, notification, args)
+		})
+	}})
+	ep, err := NewEndpoint(conn, conn, conn, options...)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		ep.Close()
+		return ErrClosed
+	}
+	p.clients[ep] = struct{}{}
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.clients, ep)
+		p.mu.Unlock()
+	}()
+
+	return ep.Serve()
+}
+
+// forward forwards a request or notification from a client upstream.
+func (p *Proxy) forward(ctx context.Context, limiter *rateLimiter, method string, notification bool, args RawArgs) (any, error) {
+	if limiter != nil && !limiter.allow(time.Now()) {
+		if notification {
+			p.logf("msgpack/rpc: proxy dropped notification %s: %v", method, ErrRateLimited)
+		}
+		return nil, ErrRateLimited
+	}
+	if err := p.checkMethod(method, args); err != nil {
+		if notification {
+			p.logf("msgpack/rpc: proxy dropped notification %s: %v", method, err)
+		}
+		return nil, err
+	}
+
+	values, err := args.rawValues()
+	if err != nil {
+		return nil, err
+	}
+
+	if notification {
+		return nil, p.upstream.Notify(method, values...)
+	}
+	// Decode to a pointer so that a nil result is decoded without calling
+	// rawValue.UnmarshalMsgPack.
+	var result *rawValue
+	if err := p.upstream.CallContext(ctx, method, &result, values...); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// checkMethod returns an error if clients are not allowed to call method.
+func (p *Proxy) checkMethod(method string, args RawArgs) error {
+	if !p.allowed(method) {
+		return fmt.Errorf("%w: %s", ErrMethodNotAllowed, method)
+	}
+	if canonicalMethod(method) != "nvim_call_atomic" {
+		return nil
+	}
+
+	var calls struct {
+		Calls []struct {
+			Method string `msgpack:",array"`
+			Args   *rawValue
+		} `msgpack:",array"`
+	}
+	if err := args.Decode(&calls); err != nil {
+		// Reject the calls that cannot be checked.
+		return fmt.Errorf("%w: %s: %v", ErrMethodNotAllowed, method, err)
+	}
+	for _, call := range calls.Calls {
+		callArgs := RawArgs{data: []byte{nilValue}, extensions: args.extensions}
+		if call.Args != nil {
+			callArgs.data = *call.Args
+		}
+		if err := p.checkMethod(call.Method, callArgs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nilValue is the MessagePack encoding of nil.
+const nilValue = 0xc0
+
+func (p *Proxy) allowed(method string) bool {
+	canonical := canonicalMethod(method)
+	if len(p.allow) > 0 && !matchAny(p.allow, method) && !matchAny(p.allow, canonical) {
+		return false
+	}
+	return !matchAny(p.deny, method) && !matchAny(p.deny, canonical)
+}
+
+// deprecatedPrefixes maps the prefixes of the deprecated method names to the
+// prefixes of the nvim_ names.
+var deprecatedPrefixes = []struct{ prefix, nvimPrefix string }{
+	{"vim_", "nvim_"},
+	{"buffer_", "nvim_buf_"},
+	{"window_", "nvim_win_"},
+	{"tabpage_", "nvim_tabpage_"},
+	{"ui_", "nvim_ui_"},
+}
+
+// deprecatedAliases maps the deprecated method names whose nvim_ name is not
+// derived by replacing the prefix.
+var deprecatedAliases = map[string]string{
+	"vim_change_directory":   "nvim_set_current_dir",
+	"vim_get_buffers":        "nvim_list_bufs",
+	"vim_get_current_buffer": "nvim_get_current_buf",
+	"vim_get_current_window": "nvim_get_current_win",
+	"vim_get_tabpages":       "nvim_list_tabpages",
+	"vim_get_windows":        "nvim_list_wins",
+	"vim_name_to_color":      "nvim_get_color_by_name",
+	"vim_report_error":       "nvim_err_writeln",
+	"vim_set_current_buffer": "nvim_set_current_buf",
+	"vim_set_current_window": "nvim_set_current_win",
+	"tabpage_get_window":     "nvim_tabpage_get_win",
+	"tabpage_get_windows":    "nvim_tabpage_list_wins",
+	"window_get_buffer":      "nvim_win_get_buf",
+}
+
+// canonicalMethod returns the nvim_ name of a deprecated method name. Other
+// method names are returned unchanged.
+func canonicalMethod(method string) string {
+	if name, ok := deprecatedAliases[method]; ok {
+		return name
+	}
+	for _, p := range deprecatedPrefixes {
+		if strings.HasPrefix(method, p.prefix) {
+			return p.nvimPrefix + method[len(p.prefix):]
+		}
+	}
+	return method
+}
+
+func matchAny(patterns []string, method string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, method); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Broadcast sends a notification to all connected clients. A single RawArgs
+// argument is sent as the arguments array. Broadcast returns the first error
+// encountered.
+func (p *Proxy) Broadcast(method string, args ...any) error {
+	p.mu.Lock()
+	clients := make([]*Endpoint, 0, len(p.clients))
+	for ep := range p.clients {
+		clients = append(clients, ep)
+	}
+	p.mu.Unlock()
+
+	if len(args) == 1 {
+		if raw, ok := args[0].(RawArgs); ok {
+			values, err := raw.rawValues()
+			if err != nil {
+				return err
+			}
+			args = values
+		}
+	}
+
+	var err error
+	for _, ep := range clients {
+		if e := ep.Notify(method, args...); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Close closes the listeners passed to Serve and all client connections. The
+// upstream Endpoint is not closed.
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	listeners := p.listeners
+	clients := p.clients
+	p.listeners = make(map[net.Listener]struct{})
+	p.clients = make(map[*Endpoint]struct{})
+	p.mu.Unlock()
+
+	var err error
+	for ln := range listeners {
+		if e := ln.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for ep := range clients {
+		if e := ep.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// rawValue is a MessagePack encoded value.
+type rawValue []byte
+
+// MarshalMsgPack implements msgpack.Marshaler.
+func (v rawValue) MarshalMsgPack(enc *msgpack.Encoder) error {
+	if len(v) == 0 {
+		return enc.PackNil()
+	}
+	return enc.PackRaw(v)
+}
+
+// UnmarshalMsgPack implements msgpack.Unmarshaler.
+func (v *rawValue) UnmarshalMsgPack(dec *msgpack.Decoder) error {
+	var buf bytes.Buffer
+	if err := copyUnpackedValue(dec, msgpack.NewEncoder(&buf)); err != nil {
+		return err
+	}
+	*v = buf.Bytes()
+	return nil
+}
+
+// rawValues returns the elements of the arguments array as *rawValues. Nil
+// elements are returned as nil pointers.
+func (a RawArgs) rawValues() ([]any, error) {
+	var values []*rawValue
+	if err := a.Decode(&values); err != nil {
+		return nil, err
+	}
+	args := make([]any, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args, nil
+}
+
+// rateLimiter is a token bucket.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// allow reports whether a message can be sent at now and takes a token.
+func (l *rateLimiter) allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,114 @@
+package rpc
+
+import "sync/atomic"
+
+// OverflowPolicy specifies how an Endpoint handles an incoming notification
+// when the notification queue is full.
+type OverflowPolicy int
+
+// list of OverflowPolicy.
+const (
+	// OverflowDropOldest drops the oldest queued notification. It is the
+	// zero value of OverflowPolicy.
+	OverflowDropOldest OverflowPolicy = iota
+
+	// OverflowCoalesce drops the oldest queued notification for the same
+	// method. The oldest queued notification is dropped when there are no
+	// queued notifications for the method.
+	OverflowCoalesce
+
+	// OverflowBlock stops reading messages from the peer until there is
+	// space in the queue. Notification handlers that make calls to the peer
+	// can deadlock with this policy because replies are not read while the
+	// queue is full.
+	OverflowBlock
+)
+
+// String returns a string representation of the OverflowPolicy.
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDropOldest:
+		return "DropOldest"
+	case OverflowCoalesce:
+		return "Coalesce"
+	case OverflowBlock:
+		return "Block"
+	default:
+		return "unknown OverflowPolicy"
+	}
+}
+
+// WithMaxConcurrentRequests limits the number of request handlers that run
+// concurrently to n. When a request is received while n handlers are running,
+// the endpoint stops reading messages from the peer until a running handler
+// returns. Request handlers that make calls to the peer can deadlock when n
+// handlers are running because replies are not read. The number of handlers
+// is not limited when n <= 0, which is the default.
+func WithMaxConcurrentRequests(n int) Option {
+	return Option{func(e *Endpoint) {
+		if n <= 0 {
+			e.requestSem = nil
+			return
+		}
+		e.requestSem = make(chan struct{}, n)
+	}}
+}
+
+// WithNotificationQueue limits the number of queued notifications to size and
+// sets the policy for notifications received when the queue is full. The
+// limit applies to each lane separately. The
+// queue size is not limited when size <= 0, which is the default.
+func WithNotificationQueue(size int, policy OverflowPolicy) Option {
+	return Option{func(e *Endpoint) {
+		e.maxNotifications = size
+		e.overflowPolicy = policy
+	}}
+}
+
+// QueueStats represents the state of the request handlers and the
+// notification queue of an Endpoint.
+type QueueStats struct {
+	// ActiveRequests is the number of running request handlers.
+	ActiveRequests int
+
+	// WaitingRequests is the number of requests waiting for a running
+	// handler to return. It is at most 1 because the endpoint stops reading
+	// messages while a request waits. See WithMaxConcurrentRequests.
+	WaitingRequests int
+
+	// QueuedNotifications is the number of notifications waiting to be
+	// handled.
+	QueuedNotifications int
+
+	// Lanes is the number of lanes with running or queued notifications.
+	// See RegisterWithLane.
+	Lanes int
+
+	// DroppedNotifications is the number of notifications dropped by the
+	// OverflowDropOldest and OverflowCoalesce policies.
+	DroppedNotifications uint64
+
+	// CoalescedNotifications is the number of notifications replaced by a
+	// newer notification for the same method by the OverflowCoalesce policy.
+	CoalescedNotifications uint64
+}
+
+// QueueStats returns the current state of the request handlers and the
+// notification queue.
+func (e *Endpoint) QueueStats() QueueStats {
+	e.notificationsMu.Lock()
+	stats := QueueStats{
+		QueuedNotifications:    len(e.notifications),
+		Lanes:                  len(e.lanes),
+		DroppedNotifications:   e.droppedNotifications,
+		CoalescedNotifications: e.coalescedNotifications,
+	}
+	for _, l := range e.lanes {
+		stats.QueuedNotifications += len(l.notifications)
+	}
+	e.notificationsMu.Unlock()
+
+	stats.ActiveRequests = int(atomic.LoadInt64(&e.activeRequests))
+	stats.WaitingRequests = int(atomic.LoadInt64(&e.waitingRequests))
+	return stats
+}
@@ -0,0 +1,627 @@
+package rpc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/neovim/go-client/msgpack"
+)
+
+// Direction represents the direction of a recorded message.
+type Direction int
+
+// list of Direction.
+const (
+	// Inbound is a message received from the peer.
+	Inbound Direction = iota
+
+	// Outbound is a message sent to the peer.
+	Outbound
+)
+
+// String returns a string representation of the Direction.
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "Inbound"
+	case Outbound:
+		return "Outbound"
+	default:
+		return "unknown Direction"
+	}
+}
+
+// MessageKind represents a MessagePack RPC message kind.
+type MessageKind int
+
+// list of MessageKind.
+const (
+	RequestMessage      = MessageKind(requestMessage)
+	ReplyMessage        = MessageKind(replyMessage)
+	NotificationMessage = MessageKind(notificationMessage)
+)
+
+// String returns a string representation of the MessageKind.
+func (k MessageKind) String() string {
+	switch k {
+	case RequestMessage:
+		return "Request"
+	case ReplyMessage:
+		return "Reply"
+	case NotificationMessage:
+		return "Notification"
+	default:
+		return "unknown MessageKind"
+	}
+}
+
+// Record represents a message sent or received by an Endpoint.
+type Record struct {
+	// Time is the time the message was read from or written to the
+	// transport.
+	Time time.Time
+
+	// Payload is the arguments of a request or notification, or the result
+	// of a reply.
+	Payload any
+
+	// Error is the error of a reply.
+	Error any
+
+	// Method is the method name of a request or notification.
+	Method string
+
+	// Raw is the MessagePack encoding of the message.
+	Raw []byte
+
+	// ID is the id of a request or reply.
+	ID uint64
+
+	Direction Direction
+	Kind      MessageKind
+}
+
+// String returns a string representation of the Record.
+func (r *Record) String() string {
+	switch r.Kind {
+	case RequestMessage:
+		return fmt.Sprintf("%s %s %d %s %v", r.Direction, r.Kind, r.ID, r.Method, r.Payload)
+	case ReplyMessage:
+		return fmt.Sprintf("%s %s %d %v %v", r.Direction, r.Kind, r.ID, r.Error, r.Payload)
+	default:
+		return fmt.Sprintf("%s %s %s %v", r.Direction, r.Kind, r.Method, r.Payload)
+	}
+}
+
+// newRecord returns the record for the MessagePack encoded message raw.
+func newRecord(d Direction, t time.Time, raw []byte, extensions msgpack.ExtensionMap) (*Record, error) {
+	dec := msgpack.NewDecoder(bytes.NewReader(raw))
+	dec.SetExtensions(extensions)
+	var message []any
+	if err := dec.Decode(&message); err != nil {
+		return nil, err
+	}
+
+	r := &Record{Time: t, Raw: raw, Direction: d}
+	if len(message) < 1 {
+		return nil, fmt.Errorf("msgpack/rpc: invalid message length %d", len(message))
+	}
+	kind, ok := toUint(message[0])
+	if !ok {
+		return nil, fmt.Errorf("msgpack/rpc: invalid message type %v", message[0])
+	}
+	r.Kind = MessageKind(kind)
+
+	switch r.Kind {
+	case RequestMessage:
+		if len(message) != 4 {
+			return nil, fmt.Errorf("msgpack/rpc: invalid request message length %d", len(message))
+		}
+		r.ID, _ = toUint(message[1])
+		r.Method, _ = message[2].(string)
+		r.Payload = message[3]
+	case ReplyMessage:
+		if len(message) != 4 {
+			return nil, fmt.Errorf("msgpack/rpc: invalid reply message length %d", len(message))
+		}
+		r.ID, _ = toUint(message[1])
+		r.Error = message[2]
+		r.Payload = message[3]
+	case NotificationMessage:
+		if len(message) != 3 {
+			return nil, fmt.Errorf("msgpack/rpc: invalid notification message length %d", len(message))
+		}
+		r.Method, _ = message[1].(string)
+		r.Payload = message[2]
+	default:
+		return nil, fmt.Errorf("msgpack/rpc: unknown message type %d", kind)
+	}
+	return r, nil
+}
+
+func toUint(v any) (uint64, bool) {
+	switch v := v.(type) {
+	case uint64:
+		return v, true
+	case int64:
+		return uint64(v), v >= 0
+	default:
+		return 0, false
+	}
+}
+
+// Recorder receives the messages sent and received by an Endpoint.
+//
+// Record is called from the goroutine reading or writing the transport.
+// Implementations must not call the Endpoint.
+type Recorder interface {
+	Record(r *Record)
+}
+
+// RecorderFunc is an adapter to use a function as a Recorder.
+type RecorderFunc func(r *Record)
+
+// Record implements Recorder.
+func (f RecorderFunc) Record(r *Record) {
+	f(r)
+}
+
+// WithRecorder configures Endpoint to send every message read from or
+// written to the transport to recorder.
+func WithRecorder(recorder Recorder) Option {
+	return Option{func(e *Endpoint) {
+		e.recorder = recorder
+	}}
+}
+
+// errInvalidMessage is the error of a messageSplitter for a stream that is
+// not a sequence of MessagePack arrays.
+var errInvalidMessage = errors.New("msgpack/rpc: invalid message")
+
+// messageSplitter splits a MessagePack stream into messages. The values of a
+// message are parsed as the bytes arrive, so each byte is parsed once.
+type messageSplitter struct {
+	buf []byte
+
+	// off is the length of the parsed part of the first message in buf.
+	// remaining is the number of values left to parse in each open array
+	// and map of the message, innermost last.
+	off       int
+	remaining []int
+
+	// err is set when the stream is invalid. The bytes written after an
+	// error are discarded.
+	err error
+}
+
+// Write appends p to the stream.
+func (s *messageSplitter) Write(p []byte) (int, error) {
+	if s.err == nil {
+		s.buf = append(s.buf, p...)
+	}
+	return len(p), nil
+}
+
+// next returns the next complete message in the stream or nil if there is
+// no complete message.
+func (s *messageSplitter) next() []byte {
+	for s.err == nil {
+		if s.off > 0 && len(s.remaining) == 0 {
+			raw := make([]byte, s.off)
+			copy(raw, s.buf)
+			s.buf = s.buf[s.off:]
+			if len(s.buf) == 0 {
+				s.buf = nil
+			}
+			s.off = 0
+			return raw
+		}
+
+		b := s.buf[s.off:]
+		if s.off == 0 && len(b) > 0 && !isArrayCode(b[0]) {
+			s.fail(fmt.Errorf("%w: type code %#x", errInvalidMessage, b[0]))
+			return nil
+		}
+		n, items, err := valueHeaderLen(b)
+		if err != nil {
+			s.fail(err)
+			return nil
+		}
+		if n == 0 || len(b) < n {
+			return nil
+		}
+		s.off += n
+		if len(s.remaining) > 0 {
+			s.remaining[len(s.remaining)-1]--
+		}
+		if items > 0 {
+			s.remaining = append(s.remaining, items)
+		}
+		for len(s.remaining) > 0 && s.remaining[len(s.remaining)-1] == 0 {
+			s.remaining = s.remaining[:len(s.remaining)-1]
+		}
+	}
+	return nil
+}
+
+// fail discards the stream after an error.
+func (s *messageSplitter) fail(err error) {
+	s.err = err
+	s.buf = nil
+	s.off = 0
+	s.remaining = nil
+}
+
+// isArrayCode reports whether c is the type code of a MessagePack array.
+func isArrayCode(c byte) bool {
+	return c&0xf0 == 0x90 || c == 0xdc || c == 0xdd
+}
+
+// valueHeaderLen returns the length of the MessagePack value at the start of
+// b, excluding the elements of an array or map, and the number of elements of
+// an array or map. The length is 0 if b is too short to contain the length.
+func valueHeaderLen(b []byte) (n, items int, err error) {
+	if len(b) == 0 {
+		return 0, 0, nil
+	}
+
+	// size returns the length of a header of h bytes with a big-endian
+	// size in the last k bytes.
+	size := func(h, k int) int {
+		if len(b) < h {
+			return -1
+		}
+		v := 0
+		for _, c := range b[h-k : h] {
+			v = v<<8 | int(c)
+		}
+		return v
+	}
+
+	c := b[0]
+	switch {
+	case c <= 0x7f || c >= 0xe0:
+		return 1, 0, nil
+	case c <= 0x8f:
+		return 1, 2 * int(c&0x0f), nil
+	case c <= 0x9f:
+		return 1, int(c & 0x0f), nil
+	case c <= 0xbf:
+		return 1 + int(c&0x1f), 0, nil
+	}
+
+	switch c {
+	case 0xc0, 0xc2, 0xc3:
+		return 1, 0, nil
+	case 0xcc, 0xd0:
+		return 2, 0, nil
+	case 0xcd, 0xd1:
+		return 3, 0, nil
+	case 0xca, 0xce, 0xd2:
+		return 5, 0, nil
+	case 0xcb, 0xcf, 0xd3:
+		return 9, 0, nil
+	case 0xd4:
+		return 3, 0, nil
+	case 0xd5:
+		return 4, 0, nil
+	case 0xd6:
+		return 6, 0, nil
+	case 0xd7:
+		return 10, 0, nil
+	case 0xd8:
+		return 18, 0, nil
+	case 0xc4, 0xd9:
+		if v := size(2, 1); v >= 0 {
+			return 2 + v, 0, nil
+		}
+	case 0xc5, 0xda:
+		if v := size(3, 2); v >= 0 {
+			return 3 + v, 0, nil
+		}
+	case 0xc6, 0xdb:
+		if v := size(5, 4); v >= 0 {
+			return 5 + v, 0, nil
+		}
+	case 0xc7:
+		if v := size(2, 1); v >= 0 {
+			return 3 + v, 0, nil
+		}
+	case 0xc8:
+		if v := size(3, 2); v >= 0 {
+			return 4 + v, 0, nil
+		}
+	case 0xc9:
+		if v := size(5, 4); v >= 0 {
+			return 6 + v, 0, nil
+		}
+	case 0xdc:
+		if v := size(3, 2); v >= 0 {
+			return 3, v, nil
+		}
+	case 0xdd:
+		if v := size(5, 4); v >= 0 {
+			return 5, v, nil
+		}
+	case 0xde:
+		if v := size(3, 2); v >= 0 {
+			return 3, 2 * v, nil
+		}
+	case 0xdf:
+		if v := size(5, 4); v >= 0 {
+			return 5, 2 * v, nil
+		}
+	default:
+		return 0, 0, fmt.Errorf("%w: type code %#x", errInvalidMessage, c)
+	}
+	return 0, 0, nil
+}
+
+// messageRecorder sends the messages in a MessagePack stream to the Endpoint
+// recorder.
+type messageRecorder struct {
+	e *Endpoint
+	messageSplitter
+	direction Direction
+}
+
+func (e *Endpoint) newMessageRecorder(d Direction) *messageRecorder {
+	return &messageRecorder{e: e, direction: d}
+}
+
+// Write implements io.Writer.
+func (m *messageRecorder) Write(p []byte) (int, error) {
+	if m.err != nil {
+		return len(p), nil
+	}
+	now := time.Now()
+	m.messageSplitter.Write(p)
+	for raw := m.next(); raw != nil; raw = m.next() {
+		r, err := newRecord(m.direction, now, raw, m.e.extensions)
+		if err != nil {
+			m.e.logf("msgpack/rpc: error recording %s message: %v", m.direction, err)
+			continue
+		}
+		m.e.recorder.Record(r)
+	}
+	if m.err != nil {
+		m.e.logf("msgpack/rpc: stopped recording %s messages: %v", m.direction, m.err)
+	}
+	return len(p), nil
+}
+
+// RecordWriter is a Recorder that writes records to an io.Writer in the
+// format read by ReadRecords.
+//
+// The format is a MessagePack stream of [direction, time, raw] arrays where
+// direction is the Direction, time is the number of nanoseconds since the
+// Unix epoch and raw is the message as MessagePack binary.
+type RecordWriter struct {
+	err error
+	enc *msgpack.Encoder
+	mu  sync.Mutex
+}
+
+// compile time check whether the RecordWriter implements Recorder interface.
+var _ Recorder = (*RecordWriter)(nil)
+
+// NewRecordWriter returns a new RecordWriter that writes to w.
+func NewRecordWriter(w io.Writer) *RecordWriter {
+	return &RecordWriter{enc: msgpack.NewEncoder(w)}
+}
+
+// Record implements Recorder.
+func (rw *RecordWriter) Record(r *Record) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.err != nil {
+		return
+	}
+	rw.err = rw.enc.Encode(&struct {
+		Direction Direction `msgpack:",array"`
+		Time      int64
+		Raw       []byte
+	}{
+		r.Direction,
+		r.Time.UnixNano(),
+		r.Raw,
+	})
+}
+
+// Err returns the first error encountered writing records.
+func (rw *RecordWriter) Err() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.err
+}
+
+// ReadRecords reads the records written by a RecordWriter from r. Extension
+// values in the message payloads are decoded using extensions.
+func ReadRecords(r io.Reader, extensions msgpack.ExtensionMap) ([]*Record, error) {
+	dec := msgpack.NewDecoder(r)
+	var records []*Record
+	for {
+		var rec struct {
+			Direction Direction `msgpack:",array"`
+			Time      int64
+			Raw       []byte
+		}
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+		record, err := newRecord(rec.Direction, time.Unix(0, rec.Time), rec.Raw, extensions)
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+// ErrReplayMismatch is the error returned from Replayer.Err when the
+// messages written by the Endpoint do not match the recording.
+var ErrReplayMismatch = errors.New("msgpack/rpc: replay mismatch")
+
+// Replayer is a transport that replays a recorded session to an Endpoint.
+// Replayer returns the inbound messages from Read in the recorded order. An
+// inbound message is returned after the Endpoint writes the outbound messages
+// recorded before it. The outbound messages written by the Endpoint are
+// compared to the recorded messages. Replies are compared with the recorded
+// reply with the same id, because concurrent handlers can reply in a
+// different order than recorded. Requests and notifications are compared in
+// the recorded order. Use Err to get the differences.
+//
+// Use the Replayer as the reader, writer and closer of an Endpoint:
+//
+//	rp := rpc.NewReplayer(records)
+//	e, err := rpc.NewEndpoint(rp, rp, rp)
+//
+// Read returns io.EOF when all records are replayed or the Replayer is
+// closed.
+type Replayer struct {
+	err        error
+	records    []*Record
+	pending    []byte
+	extensions msgpack.ExtensionMap
+	cond       *sync.Cond
+	out        messageSplitter
+
+	// pos is the index of the next record to replay.
+	pos int
+
+	// outPos is the index of the first outbound record that is not written
+	// by the Endpoint. written records the written outbound records.
+	outPos  int
+	written []bool
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// compile time check whether the Replayer implements io.ReadWriteCloser interface.
+var _ io.ReadWriteCloser = (*Replayer)(nil)
+
+// NewReplayer returns a new Replayer for records. Extension values in the
+// outbound messages are decoded using extensions for comparison with the
+// recording.
+func NewReplayer(records []*Record, extensions msgpack.ExtensionMap) *Replayer {
+	rp := &Replayer{records: records, extensions: extensions, written: make([]bool, len(records))}
+	rp.cond = sync.NewCond(&rp.mu)
+	rp.outPos = rp.nextOutbound(0)
+	return rp
+}
+
+// nextOutbound returns the index of the first outbound record at or after i
+// that is not written.
+func (rp *Replayer) nextOutbound(i int) int {
+	for i < len(rp.records) && (rp.records[i].Direction != Outbound || rp.written[i]) {
+		i++
+	}
+	return i
+}
+
+// match returns the index of the outbound record to compare with got, or -1
+// if there is none.
+func (rp *Replayer) match(got *Record) int {
+	for i := rp.outPos; i < len(rp.records); i++ {
+		want := rp.records[i]
+		if want.Direction != Outbound || rp.written[i] {
+			continue
+		}
+		if got.Kind != ReplyMessage || want.Kind == ReplyMessage && want.ID == got.ID {
+			return i
+		}
+	}
+	return -1
+}
+
+// Read implements io.Reader.
+func (rp *Replayer) Read(p []byte) (int, error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	for len(rp.pending) == 0 {
+		switch {
+		case rp.closed || rp.pos >= len(rp.records):
+			return 0, io.EOF
+		case rp.records[rp.pos].Direction == Inbound:
+			rp.pending = rp.records[rp.pos].Raw
+			rp.pos++
+		case rp.written[rp.pos]:
+			// The Endpoint wrote the outbound message.
+			rp.pos++
+		default:
+			rp.cond.Wait()
+		}
+	}
+
+	n := copy(p, rp.pending)
+	rp.pending = rp.pending[n:]
+	return n, nil
+}
+
+// Write implements io.Writer.
+func (rp *Replayer) Write(p []byte) (int, error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	if rp.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	rp.out.Write(p)
+	for raw := rp.out.next(); raw != nil; raw = rp.out.next() {
+		got, err := newRecord(Outbound, time.Now(), raw, rp.extensions)
+		if err != nil {
+			rp.setErr(err)
+			continue
+		}
+		i := rp.match(got)
+		if i < 0 {
+			rp.setErr(fmt.Errorf("%w: unexpected message %v", ErrReplayMismatch, got))
+			continue
+		}
+		want := rp.records[i]
+		if got.Kind != want.Kind || got.ID != want.ID || got.Method != want.Method ||
+			!reflect.DeepEqual(got.Error, want.Error) || !reflect.DeepEqual(got.Payload, want.Payload) {
+			rp.setErr(fmt.Errorf("%w: got message %v, want %v", ErrReplayMismatch, got, want))
+		}
+		rp.written[i] = true
+		rp.outPos = rp.nextOutbound(rp.outPos)
+	}
+	if rp.out.err != nil {
+		rp.setErr(rp.out.err)
+	}
+	rp.cond.Broadcast()
+	return len(p), nil
+}
+
+// Close implements io.Closer.
+func (rp *Replayer) Close() error {
+	rp.mu.Lock()
+	rp.closed = true
+	rp.cond.Broadcast()
+	rp.mu.Unlock()
+	return nil
+}
+
+func (rp *Replayer) setErr(err error) {
+	if rp.err == nil {
+		rp.err = err
+	}
+}
+
+// Err returns the first difference between the outbound messages written by
+// the Endpoint and the recording. Err returns nil if the messages match.
+func (rp *Replayer) Err() error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.err
+}
@@ -3,11 +3,16 @@ package rpc
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"reflect"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/neovim/go-client/msgpack"
 )
@@ -28,6 +33,7 @@ type state int
 // list of state.
 const (
 	stateInit state = iota
+	stateShutdown
 	stateClosed
 )
 
@@ -35,6 +41,9 @@ var (
 	// ErrClosed session closed error.
 	ErrClosed = errors.New("msgpack/rpc: session closed")
 
+	// ErrShutdown session shutting down error.
+	ErrShutdown = errors.New("msgpack/rpc: session shutting down")
+
 	// ErrInternal msgpack-rpc internal error.
 	ErrInternal = errors.New("msgpack/rpc: internal error")
 
@@ -58,6 +67,49 @@ func (e Error) Error() string {
 	return fmt.Sprintf("%v", e.Value)
 }
 
+// TypedError is an error returned from a handler that is sent to the peer as
+// a [type, message] array. Nvim uses this format for API errors.
+type TypedError struct {
+	Message string
+	Type    int
+}
+
+// compile time check whether the TypedError implements msgpack.Marshaler interface.
+var _ msgpack.Marshaler = (*TypedError)(nil)
+
+// Error implements the error interface.
+func (e *TypedError) Error() string {
+	return e.Message
+}
+
+// MarshalMsgPack implements msgpack.Marshaler.
+func (e *TypedError) MarshalMsgPack(enc *msgpack.Encoder) error {
+	if err := enc.PackArrayLen(2); err != nil {
+		return err
+	}
+	if err := enc.PackInt(int64(e.Type)); err != nil {
+		return err
+	}
+	return enc.PackString(e.Message)
+}
+
+// PanicError represents a panic recovered from a handler.
+type PanicError struct {
+	// Value is the value passed to panic.
+	Value any
+
+	// Method is the method name of the handler.
+	Method string
+
+	// Stack is the stack trace of the goroutine at the time of the panic.
+	Stack []byte
+}
+
+// Error implements the error interface.
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("msgpack/rpc: service method %s panic: %v", e.Method, e.Value)
+}
+
 // Call represents a MessagePack RPC call.
 type Call struct {
 	Args   any
@@ -65,10 +117,15 @@ type Call struct {
 	Err    error
 	Done   chan *Call
 	Method string
+	start  time.Time
+	id     uint64
 }
 
 func (c *Call) done(e *Endpoint, err error) {
 	c.Err = err
+	if !c.start.IsZero() {
+		e.metrics.end(outgoingCall, c.Method, c.start, err)
+	}
 	select {
 	case c.Done <- c:
 		// ok
@@ -80,30 +137,123 @@ func (c *Call) done(e *Endpoint, err error) {
 type handler struct {
 	fn   reflect.Value
 	args []reflect.Value
+
+	// lane returns the ordering lane for notifications. All notifications
+	// are processed in the default lane when lane is nil.
+	lane LaneFunc
+
+	// decode decodes the arguments of a handler registered with Handle and
+	// returns the function that calls the handler and the decoded arguments.
+	// dec is nil when the peer sent no arguments and notification is true
+	// for notifications. fn and args are not used when decode is set.
+	decode func(method string, notification bool, dec *msgpack.Decoder) (invoke func(context.Context) (any, error), args any, err error)
+
+	// ctx is true when the first parameter of fn is a context.Context.
+	ctx bool
+}
+
+// contextKey is a value for use with context.WithValue.
+type contextKey struct {
+	name string
+}
+
+var (
+	requestIDContextKey = &contextKey{"request-id"}
+	methodContextKey    = &contextKey{"method"}
+)
+
+// RequestIDFromContext returns the id of the request that the handler context
+// ctx was created for. The boolean result is false for notifications.
+func RequestIDFromContext(ctx context.Context) (uint64, bool) {
+	id, ok := ctx.Value(requestIDContextKey).(uint64)
+	return id, ok
+}
+
+// MethodFromContext returns the method name of the request or notification
+// that the handler context ctx was created for.
+func MethodFromContext(ctx context.Context) (string, bool) {
+	method, ok := ctx.Value(methodContextKey).(string)
+	return method, ok
 }
 
 type notification struct {
-	call   func([]reflect.Value) []reflect.Value
-	next   *notification
-	method string
-	args   []reflect.Value
+	ctx  context.Context
+	info *CallInfo
+	next *notification
+	lane string
 }
 
 // Endpoint represents a MessagePack RPC peer.
 type Endpoint struct {
+	// activeRequests and waitingRequests are accessed atomically. Keep
+	// them first in the struct for 64-bit alignment on 32-bit platforms.
+	activeRequests  int64
+	waitingRequests int64
+
 	err  error
 	logf func(fmt string, args ...any)
 
-	done   chan struct{}
-	closer io.Closer
-	bw     *bufio.Writer
-	enc    *msgpack.Encoder
-	dec    *msgpack.Decoder
+	// ctx is the parent of handler contexts. ctx is canceled when the
+	// endpoint is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	done       chan struct{}
+	closer     io.Closer
+	extensions msgpack.ExtensionMap
+	recorder   Recorder
+	bw         *bufio.Writer
+	enc        *msgpack.Encoder
+	dec        *msgpack.Decoder
+
+	// cw counts the bytes encoded by enc and is guarded by encMu. cr and br
+	// count the bytes decoded by dec and are used by the Serve goroutine.
+	cw *countingWriter
+	cr *countingReader
+	br *bufio.Reader
+
+	// coalescer writes the output from a writer goroutine when coalescing
+	// is enabled with WithCoalescedWrites.
+	coalescer       *coalescingWriter
+	coalesce        bool
+	maxWriteLatency time.Duration
+
+	// messageStart is the read offset of the message decoded by Serve.
+	messageStart int64
+
+	metrics metrics
+
+	// invoke sends outgoing messages through the client interceptors.
+	invoke             Invoker
+	clientInterceptors []ClientInterceptor
+
+	// handle runs incoming messages through the server interceptors.
+	handle             Handler
+	serverInterceptors []ServerInterceptor
 
 	handlers          map[string]*handler
+	fallback          *handler
 	pending           map[uint64]*Call
 	notificationsCond *sync.Cond
 
+	// notificationsSpaceCond is signaled when a notification is removed
+	// from the queue.
+	notificationsSpaceCond *sync.Cond
+	maxNotifications       int
+	overflowPolicy         OverflowPolicy
+	lanes                  map[string]*lane
+	droppedNotifications   uint64
+	coalescedNotifications uint64
+
+	// inflight counts running request handlers and queued notifications.
+	// Add is called with mu held and state == stateInit so that Add does not
+	// race with Wait in Shutdown.
+	inflight sync.WaitGroup
+
+	// requestSem limits the number of concurrent request handlers. The
+	// number of handlers is not limited when requestSem is nil.
+	requestSem chan struct{}
+
 	arg           reflect.Value
 	notifications []*notification
 	state         state
@@ -121,34 +271,55 @@ type Option struct{ f func(*Endpoint) }
 // WithExtensions configures Endpoint to define application-specific types.
 func WithExtensions(extensions msgpack.ExtensionMap) Option {
 	return Option{func(e *Endpoint) {
-		e.dec.SetExtensions(extensions)
+		e.extensions = extensions
 	}}
 }
 
-// WithLogf sets the log function to Endpoint.
+// WithLogf sets the log function to Endpoint. The log.Printf function is used
+// by default or when f is nil.
 func WithLogf(f func(fmt string, args ...any)) Option {
 	return Option{func(e *Endpoint) {
-		e.logf = f
+		if f != nil {
+			e.logf = f
+		}
 	}}
 }
 
 // NewEndpoint returns a new endpoint with the specified options.
 func NewEndpoint(r io.Reader, w io.Writer, c io.Closer, options ...Option) (*Endpoint, error) {
-	bw := bufio.NewWriter(w)
+	ctx, cancel := context.WithCancel(context.Background())
 	e := &Endpoint{
+		ctx:      ctx,
+		cancel:   cancel,
 		done:     make(chan struct{}),
 		handlers: make(map[string]*handler),
 		pending:  make(map[uint64]*Call),
 		closer:   c,
-		bw:       bw,
-		enc:      msgpack.NewEncoder(bw),
-		dec:      msgpack.NewDecoder(r),
+		logf:     log.Printf,
 	}
 	for _, option := range options {
 		option.f(e)
 	}
+	if e.recorder != nil {
+		r = io.TeeReader(r, e.newMessageRecorder(Inbound))
+		// Record outbound messages before writing them so that a reply is
+		// never recorded before the request.
+		w = io.MultiWriter(e.newMessageRecorder(Outbound), w)
+	}
+	if e.coalesce {
+		e.coalescer = newCoalescingWriter(w, e.maxWriteLatency, func(err error) {
+			e.close(fmt.Errorf("msgpack/rpc: error writing: %w", err))
+		})
+		w = e.coalescer
+	}
+	e.bw = bufio.NewWriter(w)
+	e.cw = &countingWriter{w: e.bw}
+	e.enc = msgpack.NewEncoder(e.cw)
+	e.dec = msgpack.NewDecoder(e.newReader(r))
+	e.dec.SetExtensions(e.extensions)
+	e.invoke = chainClientInterceptors(e.clientInterceptors, e.invokePeer)
+	e.handle = chainServerInterceptors(e.serverInterceptors, e.invokeHandler)
 	return e, nil
-
 }
 
 func (e *Endpoint) decodeUint(what string) (uint64, error) {
@@ -188,10 +359,12 @@ func (e *Endpoint) skip(n int) error {
 // there is an error.
 func (e *Endpoint) Serve() error {
 	e.notificationsCond = sync.NewCond(&e.notificationsMu)
+	e.notificationsSpaceCond = sync.NewCond(&e.notificationsMu)
 	defer e.enqueNotification(nil)
 	go e.runNotifications()
 
 	for {
+		e.messageStart = e.readOffset()
 		if err := e.dec.Unpack(); err != nil {
 			if err == io.EOF {
 				err = nil
@@ -227,17 +400,30 @@ func (e *Endpoint) Serve() error {
 
 func (e *Endpoint) close(err error) error {
 	e.mu.Lock()
-	defer e.mu.Unlock()
 	if e.state == stateClosed {
-		return e.err
+		err := e.err
+		e.mu.Unlock()
+		return err
 	}
 	e.state = stateClosed
 	e.err = err
+	e.cancel()
 	for _, call := range e.pending {
 		call.done(e, ErrClosed)
 	}
 	e.pending = nil
+	e.mu.Unlock()
+
+	if e.coalescer != nil {
+		// Write the queued notifications and replies before closing the
+		// connection. The flush runs without e.mu so that concurrent sends
+		// fail with ErrClosed instead of waiting for the flush.
+		e.coalescer.Close(closeFlushTimeout)
+	}
 	err = e.closer.Close()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	if e.err == nil {
 		e.err = err
 	}
@@ -249,84 +435,218 @@ func (e *Endpoint) Close() error {
 	return e.close(nil)
 }
 
-var errorType = reflect.ValueOf(new(error)).Elem().Type()
+// Shutdown gracefully shuts down the endpoint. Shutdown stops handling new
+// requests and notifications from the peer, waits for running request
+// handlers and queued notifications to complete, flushes the output and then
+// closes the endpoint. New requests from the peer are replied with
+// ErrShutdown. Calls to the peer made by the running handlers work until the
+// endpoint is closed.
+//
+// If ctx is done before the handlers complete, Shutdown closes the endpoint
+// and returns ctx.Err().
+func (e *Endpoint) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	if e.state == stateInit {
+		e.state = stateShutdown
+	}
+	e.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		e.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		e.close(nil)
+		return ctx.Err()
+	}
+
+	e.encMu.Lock()
+	err := e.bw.Flush()
+	e.encMu.Unlock()
+	if err == nil && e.coalescer != nil {
+		err = e.coalescer.Flush()
+	}
+
+	if cerr := e.close(nil); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// startHandler reports whether the endpoint accepts new requests and
+// notifications from the peer. If startHandler returns true, the caller must
+// call e.inflight.Done when the handler completes.
+func (e *Endpoint) startHandler() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.state != stateInit {
+		return false
+	}
+	e.inflight.Add(1)
+	return true
+}
+
+var (
+	errorType   = reflect.ValueOf(new(error)).Elem().Type()
+	contextType = reflect.ValueOf(new(context.Context)).Elem().Type()
+)
 
 // Register registers handler fn for the specified method name.
 //
 // When servicing a call, the arguments to fn are the values in args followed
 // by the values passed from the peer.
+//
+// If the first parameter of fn is a context.Context, then fn is called with a
+// context that is canceled when the endpoint is closed. Use the
+// RequestIDFromContext and MethodFromContext functions to get the request id
+// and method name from the context. The values in args follow the context.
 func (e *Endpoint) Register(method string, fn any, args ...any) error {
+	h, err := newHandler(fn, args...)
+	if err != nil {
+		return err
+	}
+
+	e.handlersMu.Lock()
+	e.handlers[method] = h
+	e.handlersMu.Unlock()
+	return nil
+}
+
+func newHandler(fn any, args ...any) (*handler, error) {
 	v := reflect.ValueOf(fn)
 	t := v.Type()
 	if t.Kind() != reflect.Func {
-		return ErrHandlerNotFunction
-	}
-	if t.NumIn() < len(args) {
-		return fmt.Errorf("msgpack/rpc: handler must have at least %d args", len(args))
+		return nil, ErrHandlerNotFunction
 	}
 
 	h := &handler{fn: v, args: make([]reflect.Value, len(args))}
 
+	off := 0
+	if t.NumIn() > 0 && t.In(0) == contextType {
+		h.ctx = true
+		off = 1
+	}
+
+	if t.NumIn() < off+len(args) {
+		return nil, fmt.Errorf("msgpack/rpc: handler must have at least %d args", off+len(args))
+	}
+
 	for i, arg := range args {
 		if arg == nil {
-			t := t.In(i)
+			t := t.In(off + i)
 			switch t.Kind() {
 			case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
 				h.args[i] = reflect.New(t).Elem()
 			default:
-				return fmt.Errorf("msgpack/rpc: handler arg %d must be interface, pointer, map or slice", i)
+				return nil, fmt.Errorf("msgpack/rpc: handler arg %d must be interface, pointer, map or slice", i)
 			}
 		} else {
 			h.args[i] = reflect.ValueOf(arg)
-			if t.In(i) != h.args[i].Type() {
-				return fmt.Errorf("msgpack/rpc: handler arg %d must be type %T", i, arg)
+			if t.In(off+i) != h.args[i].Type() {
+				return nil, fmt.Errorf("msgpack/rpc: handler arg %d must be type %T", i, arg)
 			}
 		}
 	}
 
 	if t.NumOut() > 2 || (t.NumOut() > 0 && t.Out(t.NumOut()-1) != errorType) {
-		return ErrInvalidHandlerReturn
+		return nil, ErrInvalidHandlerReturn
 	}
 
-	e.handlersMu.Lock()
-	e.handlers[method] = h
-	e.handlersMu.Unlock()
-	return nil
+	return h, nil
 }
 
 // Call invokes the target method and waits for a response.
 func (e *Endpoint) Call(method string, reply any, args ...any) error {
-	c := <-e.Go(method, make(chan *Call, 1), reply, args...).Done
+	return e.CallContext(context.Background(), method, reply, args...)
+}
+
+// CallContext invokes the target method and waits for a response or for ctx to
+// be done. If ctx is done before the response arrives, the pending call is
+// discarded and ctx.Err() is returned.
+func (e *Endpoint) CallContext(ctx context.Context, method string, reply any, args ...any) error {
+	if len(e.clientInterceptors) == 0 {
+		return e.callContext(ctx, method, reply, args...)
+	}
+	return e.invoke(ctx, &CallInfo{Method: method, Args: args, Reply: reply})
+}
+
+func (e *Endpoint) callContext(ctx context.Context, method string, reply any, args ...any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	call := e.newCall(method, make(chan *Call, 1), reply, args)
+	e.send(call)
+	select {
+	case c := <-call.Done:
+		return c.Err
+	case <-ctx.Done():
+	}
+
+	e.mu.Lock()
+	if c, pending := e.pending[call.id]; pending && c == call {
+		delete(e.pending, call.id)
+		e.mu.Unlock()
+		e.metrics.end(outgoingCall, call.Method, call.start, ctx.Err())
+		return ctx.Err()
+	}
+	e.mu.Unlock()
+
+	// The reply is being decoded to call.Reply. Wait for the decode to
+	// complete so that the caller does not race with the decoder.
+	c := <-call.Done
 	return c.Err
 }
 
 // Go append method call to queue and returns the new Call.
 func (e *Endpoint) Go(method string, done chan *Call, reply any, args ...any) *Call {
-	if args == nil {
-		args = []any{}
-	}
-
 	if done == nil {
 		done = make(chan *Call, 1)
 	} else if cap(done) == 0 {
 		panic("unbuffered done channel")
 	}
 
-	call := &Call{
+	call := e.newCall(method, done, reply, args)
+	if len(e.clientInterceptors) == 0 {
+		e.send(call)
+		return call
+	}
+
+	go func() {
+		info := &CallInfo{Method: method, Args: call.Args.([]any), Reply: reply}
+		call.done(e, e.invoke(context.Background(), info))
+	}()
+	return call
+}
+
+func (e *Endpoint) newCall(method string, done chan *Call, reply any, args []any) *Call {
+	if args == nil {
+		args = []any{}
+	}
+	return &Call{
 		Method: method,
 		Args:   args,
 		Reply:  reply,
 		Done:   done,
 	}
+}
 
+// send sends the call to the peer.
+func (e *Endpoint) send(call *Call) {
 	e.mu.Lock()
 	if e.state == stateClosed {
 		call.done(e, ErrClosed)
 		e.mu.Unlock()
-		return call
+		return
 	}
 	e.id = (e.id + 1) & 0x7fffffff
 	id := e.id
+	call.id = id
+	call.start = e.metrics.begin(outgoingCall, call.Method)
 	e.pending[id] = call
 	e.mu.Unlock()
 
@@ -338,16 +658,20 @@ func (e *Endpoint) Go(method string, done chan *Call, reply any, args ...any) *C
 	}{
 		requestMessage,
 		id,
-		method,
-		args,
+		call.Method,
+		call.Args.([]any),
 	}
 
 	e.encMu.Lock()
+	offset := e.cw.n
 	err := e.enc.Encode(message)
 	if e := e.bw.Flush(); err == nil {
 		err = e
 	}
+	sent := e.cw.n - offset
 	e.encMu.Unlock()
+	e.writeQueued()
+	e.metrics.transfer(outgoingCall, call.Method, sent, 0)
 
 	if err != nil {
 		e.mu.Lock()
@@ -358,12 +682,17 @@ func (e *Endpoint) Go(method string, done chan *Call, reply any, args ...any) *C
 		e.mu.Unlock()
 		e.close(fmt.Errorf("msgpack/rpc: error encoding %s: %w", call.Method, err))
 	}
-
-	return call
 }
 
 // Notify invokes the target method with non-blocking.
 func (e *Endpoint) Notify(method string, args ...any) error {
+	if len(e.clientInterceptors) == 0 {
+		return e.notify(method, args...)
+	}
+	return e.invoke(context.Background(), &CallInfo{Method: method, Args: args, Notification: true})
+}
+
+func (e *Endpoint) notify(method string, args ...any) error {
 	if args == nil {
 		args = []any{}
 	}
@@ -378,23 +707,88 @@ func (e *Endpoint) Notify(method string, args ...any) error {
 		args,
 	}
 
+	start := e.metrics.begin(outgoingCall, method)
 	e.encMu.Lock()
+	offset := e.cw.n
 	err := e.enc.Encode(message)
 	if e := e.bw.Flush(); err == nil {
 		err = e
 	}
+	sent := e.cw.n - offset
 	e.encMu.Unlock()
+	if e.coalescer != nil {
+		e.coalescer.signal()
+	}
+	e.metrics.transfer(outgoingCall, method, sent, 0)
+	e.metrics.end(outgoingCall, method, start, err)
 	if err != nil {
 		e.close(fmt.Errorf("msgpack/rpc: error encoding %s: %w", method, err))
 	}
 	return err
 }
 
-func (e *Endpoint) createCall(h *handler) (func([]reflect.Value) []reflect.Value, []reflect.Value, error) {
+// invokePeer is the Invoker at the end of the client interceptor chain.
+func (e *Endpoint) invokePeer(ctx context.Context, info *CallInfo) error {
+	if info.Notification {
+		return e.notify(info.Method, info.Args...)
+	}
+	return e.callContext(ctx, info.Method, info.Reply, info.Args...)
+}
+
+// safeHandle runs the server interceptors and handler for info. A panic in
+// the interceptors or handler is logged and returned as a *PanicError.
+func (e *Endpoint) safeHandle(ctx context.Context, info *CallInfo) (reply any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			perr := &PanicError{Value: r, Method: info.Method, Stack: debug.Stack()}
+			e.logf("%v\n%s", perr, perr.Stack)
+			reply, err = nil, perr
+		}
+	}()
+	return e.handle(ctx, info)
+}
+
+// invokeHandler is the Handler at the end of the server interceptor chain.
+func (e *Endpoint) invokeHandler(ctx context.Context, info *CallInfo) (any, error) {
+	if info.invoke != nil {
+		return info.invoke(ctx)
+	}
+	out := info.call(info.in)
+	var replyErr error
+	var replyVal any
+	switch info.numOut {
+	case 1:
+		replyErr, _ = out[0].Interface().(error)
+	case 2:
+		replyVal = out[0].Interface()
+		replyErr, _ = out[1].Interface().(error)
+	}
+	return replyVal, replyErr
+}
+
+// handlerContext returns the context passed to handler h and the server
+// interceptors for method. The id is ignored for notifications.
+func (e *Endpoint) handlerContext(h *handler, kind kind, id uint64, method string) context.Context {
+	if !h.ctx && len(e.serverInterceptors) == 0 {
+		return e.ctx
+	}
+	ctx := context.WithValue(e.ctx, methodContextKey, method)
+	if kind == requestMessage {
+		ctx = context.WithValue(ctx, requestIDContextKey, id)
+	}
+	return ctx
+}
+
+func (e *Endpoint) createCall(h *handler, ctx context.Context) (func([]reflect.Value) []reflect.Value, []reflect.Value, error) {
 	t := h.fn.Type()
 	args := make([]reflect.Value, t.NumIn())
+	off := 0
+	if h.ctx {
+		args[0] = reflect.ValueOf(ctx)
+		off = 1
+	}
 	for i := range h.args {
-		args[i] = h.args[i]
+		args[off+i] = h.args[i]
 	}
 	if err := e.dec.Unpack(); err != nil {
 		return nil, nil, err
@@ -411,7 +805,7 @@ func (e *Endpoint) createCall(h *handler) (func([]reflect.Value) []reflect.Value
 	srcIndex := 0
 	srcLen := e.dec.Len()
 
-	dstIndex := len(h.args)
+	dstIndex := off + len(h.args)
 	dstLen := t.NumIn()
 	if t.IsVariadic() {
 		dstLen--
@@ -471,10 +865,99 @@ func (e *Endpoint) createCall(h *handler) (func([]reflect.Value) []reflect.Value
 	return h.fn.CallSlice, args, nil
 }
 
-func (e *Endpoint) reply(id uint64, replyErr error, reply any) error {
+// decodeCallInfo decodes the arguments of an incoming call or notification to
+// handler h and returns the CallInfo. If the arguments cannot be converted to
+// the handler parameter types, decodeCallInfo returns a
+// *msgpack.DecodeConvertError.
+func (e *Endpoint) decodeCallInfo(h *handler, ctx context.Context, method string, notification bool) (*CallInfo, error) {
+	if h.decode != nil {
+		dec := e.dec
+		if b, err := e.br.Peek(1); err == nil && b[0] == emptyArray {
+			// Skip the empty array so that the handler is called with zero
+			// value Args instead of failing to decode the empty array to a
+			// struct without fields.
+			if err := e.dec.Unpack(); err != nil {
+				return nil, err
+			}
+			dec = nil
+		}
+		invoke, args, err := h.decode(method, notification, dec)
+		if err != nil {
+			return nil, err
+		}
+		info := &CallInfo{Method: method, Notification: notification, invoke: invoke}
+		if len(e.serverInterceptors) > 0 || h.lane != nil {
+			info.Args = []any{args}
+		}
+		return info, nil
+	}
+
+	call, args, err := e.createCall(h, ctx)
+	if _, ok := err.(*msgpack.DecodeConvertError); err != nil && !ok {
+		return nil, err
+	}
+	return e.newCallInfo(h, method, notification, call, args), err
+}
+
+// lookupHandler returns the handler for method or the fallback handler if
+// there is no handler registered for method.
+func (e *Endpoint) lookupHandler(method string) (*handler, bool) {
+	e.handlersMu.RLock()
+	h, ok := e.handlers[method]
+	e.handlersMu.RUnlock()
+	if !ok && e.fallback != nil {
+		return e.fallback, true
+	}
+	return h, ok
+}
+
+// emptyArray is the MessagePack encoding of an empty array.
+const emptyArray = 0x90
+
+// newCallInfo returns the CallInfo for an incoming call or notification to
+// handler h.
+func (e *Endpoint) newCallInfo(h *handler, method string, notification bool, call func([]reflect.Value) []reflect.Value, args []reflect.Value) *CallInfo {
+	info := &CallInfo{
+		Method:       method,
+		Notification: notification,
+		call:         call,
+		in:           args,
+		numOut:       h.fn.Type().NumOut(),
+	}
+	if len(e.serverInterceptors) > 0 || h.lane != nil {
+		off := len(h.args)
+		if h.ctx {
+			off++
+		}
+		info.Args = make([]any, len(args)-off)
+		for i, arg := range args[off:] {
+			info.Args[i] = arg.Interface()
+		}
+	}
+	return info
+}
+
+// reply sends the reply to request id and returns the number of bytes sent.
+func (e *Endpoint) reply(id uint64, replyErr error, reply any) (int64, error) {
 	e.encMu.Lock()
-	defer e.encMu.Unlock()
+	offset := e.cw.n
+	err := e.encodeReply(id, replyErr, reply)
+	sent := e.cw.n - offset
+	e.encMu.Unlock()
+	e.writeQueued()
+	return sent, err
+}
 
+// writeQueued writes the messages queued by WithCoalescedWrites without
+// waiting for the max latency.
+func (e *Endpoint) writeQueued() {
+	if e.coalescer != nil {
+		e.coalescer.writeNow()
+	}
+}
+
+// encodeReply encodes and flushes the reply. The caller must hold encMu.
+func (e *Endpoint) encodeReply(id uint64, replyErr error, reply any) error {
 	err := e.enc.PackArrayLen(4)
 	if err != nil {
 		return err
@@ -490,13 +973,18 @@ func (e *Endpoint) reply(id uint64, replyErr error, reply any) error {
 		return err
 	}
 
-	if replyErr == nil {
+	var (
+		rpcErr    Error
+		marshaler msgpack.Marshaler
+	)
+	switch {
+	case replyErr == nil:
 		err = e.enc.PackNil()
-	} else if ee, ok := replyErr.(Error); ok {
-		err = e.enc.Encode(ee.Value)
-	} else if ee, ok := replyErr.(msgpack.Marshaler); ok {
-		err = ee.MarshalMsgPack(e.enc)
-	} else {
+	case errors.As(replyErr, &rpcErr):
+		err = e.enc.Encode(rpcErr.Value)
+	case errors.As(replyErr, &marshaler):
+		err = marshaler.MarshalMsgPack(e.enc)
+	default:
 		err = e.enc.PackString(replyErr.Error())
 	}
 	if err != nil {
@@ -526,38 +1014,60 @@ func (e *Endpoint) handleRequest(messageLen int) error {
 		return err
 	}
 
-	e.handlersMu.RLock()
-	h, ok := e.handlers[method]
-	e.handlersMu.RUnlock()
+	h, ok := e.lookupHandler(method)
 
 	if !ok {
 		if err := e.skip(1); err != nil {
 			return err
 		}
 		e.logf("msgpack/rpc: request service method %s not found", method)
-		return e.reply(id, fmt.Errorf("unknown request method: %s", method), nil)
+		_, err := e.reply(id, fmt.Errorf("unknown request method: %s", method), nil)
+		return err
 	}
 
-	call, args, err := e.createCall(h)
+	ctx := e.handlerContext(h, requestMessage, id, method)
+	info, err := e.decodeCallInfo(h, ctx, method, false)
+	received := e.readOffset() - e.messageStart
 	if _, ok := err.(*msgpack.DecodeConvertError); ok {
 		e.logf("msgpack/rpc: %s: %v", method, err)
-		return e.reply(id, ErrInvalidArgument, nil)
+		return e.rejectRequest(method, id, received, ErrInvalidArgument)
 	} else if err != nil {
 		return err
 	}
 
+	if !e.startHandler() {
+		return e.rejectRequest(method, id, received, ErrShutdown)
+	}
+
+	if e.requestSem != nil {
+		// Stop reading from the peer until a running handler returns, so
+		// that waiting requests do not hold a goroutine each.
+		atomic.AddInt64(&e.waitingRequests, 1)
+		select {
+		case e.requestSem <- struct{}{}:
+			atomic.AddInt64(&e.waitingRequests, -1)
+		case <-e.ctx.Done():
+			atomic.AddInt64(&e.waitingRequests, -1)
+			e.inflight.Done()
+			return ErrClosed
+		}
+	}
+
 	go func() {
-		out := call(args)
-		var replyErr error
-		var replyVal any
-		switch h.fn.Type().NumOut() {
-		case 1:
-			replyErr, _ = out[0].Interface().(error)
-		case 2:
-			replyVal = out[0].Interface()
-			replyErr, _ = out[1].Interface().(error)
+		defer e.inflight.Done()
+
+		if e.requestSem != nil {
+			defer func() { <-e.requestSem }()
 		}
-		if err := e.reply(id, replyErr, replyVal); err != nil {
+		atomic.AddInt64(&e.activeRequests, 1)
+		defer atomic.AddInt64(&e.activeRequests, -1)
+
+		start := e.metrics.begin(incomingCall, method)
+		replyVal, replyErr := e.safeHandle(ctx, info)
+		sent, err := e.reply(id, replyErr, replyVal)
+		e.metrics.transfer(incomingCall, method, sent, received)
+		e.metrics.end(incomingCall, method, start, replyErr)
+		if err != nil {
 			e.close(err)
 		}
 	}()
@@ -565,6 +1075,15 @@ func (e *Endpoint) handleRequest(messageLen int) error {
 	return nil
 }
 
+// rejectRequest replies err to the request id without calling the handler.
+func (e *Endpoint) rejectRequest(method string, id uint64, received int64, err error) error {
+	start := e.metrics.begin(incomingCall, method)
+	sent, replyErr := e.reply(id, err, nil)
+	e.metrics.transfer(incomingCall, method, sent, received)
+	e.metrics.end(incomingCall, method, start, err)
+	return replyErr
+}
+
 func (e *Endpoint) handleReply(messageLen int) error {
 	if messageLen != 4 {
 		// messageType, id, error, reply
@@ -594,6 +1113,7 @@ func (e *Endpoint) handleReply(messageLen int) error {
 
 	if errorValue != nil {
 		err := e.skip(1)
+		e.metrics.transfer(outgoingCall, call.Method, 0, e.readOffset()-e.messageStart)
 		call.done(e, Error{errorValue})
 		return err
 	}
@@ -603,10 +1123,12 @@ func (e *Endpoint) handleReply(messageLen int) error {
 	} else {
 		err = e.dec.Decode(call.Reply)
 		if cvterr, ok := err.(*msgpack.DecodeConvertError); ok {
+			e.metrics.transfer(outgoingCall, call.Method, 0, e.readOffset()-e.messageStart)
 			call.done(e, cvterr)
 			return nil
 		}
 	}
+	e.metrics.transfer(outgoingCall, call.Method, 0, e.readOffset()-e.messageStart)
 
 	if err != nil {
 		call.done(e, ErrInternal)
@@ -628,59 +1150,136 @@ func (e *Endpoint) handleNotification(messageLen int) error {
 		return err
 	}
 
-	e.handlersMu.RLock()
-	h, ok := e.handlers[method]
-	e.handlersMu.RUnlock()
+	h, ok := e.lookupHandler(method)
 
 	if !ok {
 		e.logf("msgpack/rpc: notification service method %s not found", method)
 		return e.skip(1)
 	}
 
-	call, args, err := e.createCall(h)
+	ctx := e.handlerContext(h, notificationMessage, 0, method)
+	info, err := e.decodeCallInfo(h, ctx, method, true)
 	if err != nil {
 		return err
 	}
+	e.metrics.transfer(incomingCall, method, 0, e.readOffset()-e.messageStart)
+
+	if !e.startHandler() {
+		e.logf("msgpack/rpc: notification service method %s dropped on shutdown", method)
+		return nil
+	}
 
-	e.enqueNotification(&notification{call: call, args: args, method: method})
+	n := &notification{ctx: ctx, info: info}
+	if h.lane != nil {
+		n.lane = h.lane(method, n.info.Args)
+	}
+	e.enqueNotification(n)
 	return nil
 }
 
 func (e *Endpoint) enqueNotification(n *notification) {
 	e.notificationsMu.Lock()
-	e.notifications = append(e.notifications, n)
-	e.notificationsCond.Signal()
-	e.notificationsMu.Unlock()
+	defer e.notificationsMu.Unlock()
+
+	// Serve() enqueues nil on return. Queue the nil notification regardless
+	// of the queue size so that runNotifications always exits.
+	if n == nil || n.lane == "" {
+		e.pushNotification(&e.notifications, n)
+		e.notificationsCond.Signal()
+		return
+	}
+
+	l := e.lanes[n.lane]
+	if l == nil {
+		l = &lane{}
+		if e.lanes == nil {
+			e.lanes = make(map[string]*lane)
+		}
+		e.lanes[n.lane] = l
+		e.pushNotification(&l.notifications, n)
+		go e.runLane(n.lane, l)
+		return
+	}
+	e.pushNotification(&l.notifications, n)
+}
+
+// pushNotification appends n to the queue q and applies the overflow policy
+// when q is full. The caller must hold notificationsMu.
+func (e *Endpoint) pushNotification(q *[]*notification, n *notification) {
+	if n != nil && e.maxNotifications > 0 && len(*q) >= e.maxNotifications {
+		switch e.overflowPolicy {
+		case OverflowBlock:
+			for len(*q) >= e.maxNotifications {
+				e.notificationsSpaceCond.Wait()
+			}
+		case OverflowCoalesce:
+			if i := queuedNotificationIndex(*q, n.info.Method); i >= 0 {
+				removeNotification(q, i)
+				e.coalescedNotifications++
+				e.inflight.Done()
+				break
+			}
+			fallthrough
+		case OverflowDropOldest:
+			removeNotification(q, 0)
+			e.droppedNotifications++
+			e.inflight.Done()
+		}
+	}
+	*q = append(*q, n)
 }
 
-func (e *Endpoint) dequeueNotifications() []*notification {
+// queuedNotificationIndex returns the index of the oldest notification in q
+// for method or -1 if there is no notification in q for method.
+func queuedNotificationIndex(q []*notification, method string) int {
+	for i, n := range q {
+		if n != nil && n.info.Method == method {
+			return i
+		}
+	}
+	return -1
+}
+
+func removeNotification(q *[]*notification, i int) {
+	s := *q
+	copy(s[i:], s[i+1:])
+	s[len(s)-1] = nil
+	*q = s[:len(s)-1]
+}
+
+func (e *Endpoint) dequeueNotification() *notification {
 	e.notificationsMu.Lock()
-	for e.notifications == nil {
+	defer e.notificationsMu.Unlock()
+	for len(e.notifications) == 0 {
 		e.notificationsCond.Wait()
 	}
-	notifications := e.notifications
-	e.notifications = nil
-	e.notificationsMu.Unlock()
-	return notifications
+	n := e.notifications[0]
+	removeNotification(&e.notifications, 0)
+	e.notificationsSpaceCond.Broadcast()
+	return n
 }
 
 // runNotifications runs notifications in a single goroutine to ensure that the
 // notifications are processed in order by the application.
 func (e *Endpoint) runNotifications() {
 	for {
-		notifications := e.dequeueNotifications()
-		for _, n := range notifications {
-			if n == nil {
-				// Serve() enqueues nil on return
-				return
-			}
-			out := n.call(n.args)
-			if len(out) > 0 {
-				replyErr, _ := out[len(out)-1].Interface().(error)
-				if replyErr != nil {
-					e.logf("msgpack/rpc: service method %s returned %v", n.method, replyErr)
-				}
-			}
+		n := e.dequeueNotification()
+		if n == nil {
+			// Serve() enqueues nil on return
+			return
 		}
+		e.runNotification(n)
+	}
+}
+
+// runNotification calls the handler for notification n.
+func (e *Endpoint) runNotification(n *notification) {
+	defer e.inflight.Done()
+
+	start := e.metrics.begin(incomingCall, n.info.Method)
+	_, err := e.safeHandle(n.ctx, n.info)
+	e.metrics.end(incomingCall, n.info.Method, start, err)
+	if err != nil {
+		e.logf("msgpack/rpc: service method %s returned %v", n.info.Method, err)
 	}
 }
@@ -0,0 +1,156 @@
+package rpc
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// benchClientServer returns a client and server connected by OS pipes so that
+// each write to the peer is a system call.
+func benchClientServer(b *testing.B, opts ...Option) (client, server *Endpoint, cleanup func()) {
+	b.Helper()
+
+	serverR, clientW, err := os.Pipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	clientR, serverW, err := os.Pipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	server, err = NewEndpoint(serverR, serverW, closers{serverR, serverW}, opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	client, err = NewEndpoint(clientR, clientW, closers{clientR, clientW}, opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	go server.Serve()
+	go client.Serve()
+
+	cleanup = func() {
+		client.Close()
+		server.Close()
+	}
+	return client, server, cleanup
+}
+
+type closers []*os.File
+
+func (c closers) Close() error {
+	for _, f := range c {
+		f.Close()
+	}
+	return nil
+}
+
+var benchWriteOptions = []struct {
+	name string
+	opts []Option
+}{
+	{"Flush", nil},
+	{"Coalesced", []Option{WithCoalescedWrites(0)}},
+	{"Coalesced/100us", []Option{WithCoalescedWrites(100 * time.Microsecond)}},
+}
+
+func BenchmarkNotify(b *testing.B) {
+	for _, bb := range benchWriteOptions {
+		b.Run(bb.name, func(b *testing.B) {
+			client, server, cleanup := benchClientServer(b, bb.opts...)
+			defer cleanup()
+
+			done := make(chan struct{})
+			n := 0
+			if err := server.Register("hello", func(s string) {
+				n++
+				if n == b.N {
+					close(done)
+				}
+			}); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := client.Notify("hello", "world"); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			<-done
+		})
+	}
+}
+
+func BenchmarkCall(b *testing.B) {
+	for _, bb := range benchWriteOptions {
+		b.Run(bb.name, func(b *testing.B) {
+			client, server, cleanup := benchClientServer(b, bb.opts...)
+			defer cleanup()
+
+			if err := server.Register("add", func(a, b int) (int, error) { return a + b, nil }); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				var sum int
+				for pb.Next() {
+					if err := client.Call("add", &sum, 1, 2); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkHandler(b *testing.B) {
+	type addArgs struct {
+		A int `msgpack:",array"`
+		B int
+	}
+
+	benchs := map[string]func(e *Endpoint){
+		"Register": func(e *Endpoint) {
+			if err := e.Register("add", func(a, b int) (int, error) { return a + b, nil }); err != nil {
+				b.Fatal(err)
+			}
+		},
+		"Handle": func(e *Endpoint) {
+			Handle(e, "add", func(ctx context.Context, args addArgs) (int, error) { return args.A + args.B, nil })
+		},
+	}
+
+	for name, register := range benchs {
+		register := register
+		b.Run(name, func(b *testing.B) {
+			client, server, cleanup := benchClientServer(b)
+			defer cleanup()
+			register(server)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := Request[int](context.Background(), client, "add", 1, 2); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
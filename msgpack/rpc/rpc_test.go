@@ -1,13 +1,22 @@
 package rpc
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
+	"os"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/neovim/go-client/msgpack"
 )
 
 func testClientServer(tb testing.TB, opts ...Option) (client, server *Endpoint, cleanup func()) {
@@ -268,3 +277,1838 @@ func TestBadFunction(t *testing.T) {
 		t.Fatal("expected error, got nil")
 	}
 }
+
+func TestCallContext(t *testing.T) {
+	t.Parallel()
+
+	client, server, cleanup := testClientServer(t)
+	defer cleanup()
+
+	release := make(chan struct{})
+	if err := server.Register("block", func() (string, error) {
+		<-release
+		return "done", nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer close(release)
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if err := client.CallContext(ctx, "block", nil); !errors.Is(err, context.Canceled) {
+			t.Fatalf("got error %v, want %v", err, context.Canceled)
+		}
+	})
+
+	t.Run("DeadlineExceeded", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		var result string
+		if err := client.CallContext(ctx, "block", &result); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+		}
+
+		client.mu.Lock()
+		n := len(client.pending)
+		client.mu.Unlock()
+		if n != 0 {
+			t.Fatalf("got %d pending calls, want 0", n)
+		}
+	})
+
+	t.Run("Reply", func(t *testing.T) {
+		if err := server.Register("echo", func(s string) (string, error) {
+			return s, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		var result string
+		if err := client.CallContext(context.Background(), "echo", &result, "hello"); err != nil {
+			t.Fatal(err)
+		}
+		if result != "hello" {
+			t.Fatalf("got %q, want %q", result, "hello")
+		}
+	})
+}
+
+func TestHandlerContext(t *testing.T) {
+	t.Parallel()
+
+	client, server, cleanup := testClientServer(t)
+
+	type result struct {
+		ID     uint64
+		HasID  bool
+		Method string
+	}
+	if err := server.Register("info", func(ctx context.Context, s string) (*result, error) {
+		if s != "hello" {
+			return nil, fmt.Errorf("got %q, want %q", s, "hello")
+		}
+		id, ok := RequestIDFromContext(ctx)
+		method, _ := MethodFromContext(ctx)
+		return &result{ID: id, HasID: ok, Method: method}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	notifCh := make(chan *result, 1)
+	if err := server.Register("notif", func(ctx context.Context) {
+		_, ok := RequestIDFromContext(ctx)
+		method, _ := MethodFromContext(ctx)
+		notifCh <- &result{HasID: ok, Method: method}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	canceled := make(chan error, 1)
+	if err := server.Register("wait", func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		canceled <- ctx.Err()
+		return ctx.Err()
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got result
+	if err := client.Call("info", &got, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if !got.HasID || got.ID == 0 || got.Method != "info" {
+		t.Fatalf("got %+v, want request id and method info", got)
+	}
+
+	if err := client.Notify("notif"); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-notifCh; n.HasID || n.Method != "notif" {
+		t.Fatalf("got %+v, want no request id and method notif", n)
+	}
+
+	client.Go("wait", nil, nil)
+	<-started
+	cleanup()
+
+	select {
+	case err := <-canceled:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got error %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for handler context to be canceled")
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu   sync.Mutex
+		logs []string
+	)
+	logf := func(format string, args ...any) {
+		mu.Lock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+		mu.Unlock()
+	}
+	clientInterceptor := func(name string) ClientInterceptor {
+		return func(ctx context.Context, info *CallInfo, invoker Invoker) error {
+			logf("%s> %s %v", name, info.Method, info.Args)
+			err := invoker(ctx, info)
+			logf("%s< %s %v", name, info.Method, err)
+			return err
+		}
+	}
+	serverInterceptor := func(name string) ServerInterceptor {
+		return func(ctx context.Context, info *CallInfo, handler Handler) (any, error) {
+			method, _ := MethodFromContext(ctx)
+			logf("%s> %s %s %v %t", name, info.Method, method, info.Args, info.Notification)
+			reply, err := handler(ctx, info)
+			logf("%s< %s %v %v", name, info.Method, reply, err)
+			return reply, err
+		}
+	}
+
+	client, server, cleanup := testClientServer(t,
+		WithClientInterceptor(clientInterceptor("c1"), clientInterceptor("c2")),
+		WithServerInterceptor(serverInterceptor("s1")),
+		WithServerInterceptor(serverInterceptor("s2")),
+	)
+	defer cleanup()
+
+	if err := server.Register("add", func(a, b int) (int, error) { return a + b, nil }); err != nil {
+		t.Fatal(err)
+	}
+	notifCh := make(chan struct{})
+	if err := server.Register("n", func(s string) { close(notifCh) }); err != nil {
+		t.Fatal(err)
+	}
+
+	// reset returns the client logs followed by the server logs. The client
+	// and server logs can interleave for notifications.
+	reset := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		var clientLogs, serverLogs []string
+		for _, l := range logs {
+			if strings.HasPrefix(l, "c") {
+				clientLogs = append(clientLogs, l)
+			} else {
+				serverLogs = append(serverLogs, l)
+			}
+		}
+		logs = nil
+		return append(clientLogs, serverLogs...)
+	}
+
+	var sum int
+	if err := client.Call("add", &sum, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if sum != 3 {
+		t.Fatalf("sum = %d, want %d", sum, 3)
+	}
+	want := []string{
+		"c1> add [1 2]",
+		"c2> add [1 2]",
+		"c2< add <nil>",
+		"c1< add <nil>",
+		"s1> add add [1 2] false",
+		"s2> add add [1 2] false",
+		"s2< add 3 <nil>",
+		"s1< add 3 <nil>",
+	}
+	if got := reset(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	call := <-client.Go("add", nil, &sum, 2, 3).Done
+	if call.Err != nil {
+		t.Fatal(call.Err)
+	}
+	if sum != 5 {
+		t.Fatalf("sum = %d, want %d", sum, 5)
+	}
+	reset()
+
+	if err := client.Notify("n", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	<-notifCh
+	// Wait for the server interceptors to return.
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n := len(logs)
+		mu.Unlock()
+		if n == 8 {
+			break
+		}
+	}
+	want = []string{
+		"c1> n [hello]",
+		"c2> n [hello]",
+		"c2< n <nil>",
+		"c1< n <nil>",
+		"s1> n n [hello] true",
+		"s2> n n [hello] true",
+		"s2< n <nil> <nil>",
+		"s1< n <nil> <nil>",
+	}
+	if got := reset(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestServerInterceptorReply(t *testing.T) {
+	t.Parallel()
+
+	denied := errors.New("denied")
+	client, server, cleanup := testClientServer(t,
+		WithServerInterceptor(func(ctx context.Context, info *CallInfo, handler Handler) (any, error) {
+			if info.Method == "secret" {
+				return nil, denied
+			}
+			return handler(ctx, info)
+		}),
+	)
+	defer cleanup()
+
+	called := false
+	if err := server.Register("secret", func() error {
+		called = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := client.Call("secret", nil)
+	var rpcErr Error
+	if !errors.As(err, &rpcErr) || rpcErr.Value != denied.Error() {
+		t.Fatalf("got error %v, want %v", err, denied)
+	}
+	if called {
+		t.Fatal("handler called")
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	t.Parallel()
+
+	client, server, cleanup := testClientServer(t)
+	defer cleanup()
+
+	if err := server.Register("panic", func() error {
+		panic("boom")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register("npanic", func() {
+		panic("boom")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	notifCh := make(chan string)
+	if err := server.Register("n", func(s string) { notifCh <- s }); err != nil {
+		t.Fatal(err)
+	}
+
+	err := client.Call("panic", nil)
+	var rpcErr Error
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("got error %v, want rpc.Error", err)
+	}
+	if s, _ := rpcErr.Value.(string); !strings.Contains(s, "panic: boom") {
+		t.Fatalf("got error value %v, want panic message", rpcErr.Value)
+	}
+
+	if err := client.Notify("npanic"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Notify("n", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-notifCh; got != "hello" {
+		t.Fatalf("got %q, want %q", got, "hello")
+	}
+}
+
+// TestHandlerPanicDefaultLogf does not run in parallel because it replaces the
+// output of the standard logger.
+func TestHandlerPanicDefaultLogf(t *testing.T) {
+	var logBuf syncBuffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	serverConn, clientConn := net.Pipe()
+	server, err := NewEndpoint(serverConn, serverConn, serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Serve()
+	client, err := NewEndpoint(clientConn, clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go client.Serve()
+
+	if err := server.Register("panic", func() error {
+		panic("boom")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Call("panic", nil)
+	var rpcErr Error
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("got error %v, want rpc.Error", err)
+	}
+
+	if s := logBuf.String(); !strings.Contains(s, "panic: boom") {
+		t.Fatalf("panic not logged with log.Printf, log is %q", s)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestErrorReply(t *testing.T) {
+	t.Parallel()
+
+	client, server, cleanup := testClientServer(t)
+	defer cleanup()
+
+	if err := server.Register("typed", func() error {
+		return fmt.Errorf("wrapped: %w", &TypedError{Type: 1, Message: "Invalid buffer id"})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register("value", func() error {
+		return fmt.Errorf("wrapped: %w", Error{Value: map[string]any{"code": 42}})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register("string", func() error {
+		return errors.New("failed")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	errorReplyTests := []struct {
+		method string
+		want   any
+	}{
+		{
+			method: "typed",
+			want:   []any{int64(1), "Invalid buffer id"},
+		},
+		{
+			method: "value",
+			want:   map[string]any{"code": int64(42)},
+		},
+		{
+			method: "string",
+			want:   "failed",
+		},
+	}
+	for _, tt := range errorReplyTests {
+		t.Run(tt.method, func(t *testing.T) {
+			err := client.Call(tt.method, nil)
+			var rpcErr Error
+			if !errors.As(err, &rpcErr) {
+				t.Fatalf("got error %v, want rpc.Error", err)
+			}
+			if !reflect.DeepEqual(rpcErr.Value, tt.want) {
+				t.Fatalf("got error value %#v, want %#v", rpcErr.Value, tt.want)
+			}
+		})
+	}
+}
+
+// waitFor polls cond until it returns true or the test times out.
+func waitFor(tb testing.TB, cond func() bool) {
+	tb.Helper()
+
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	tb.Fatal("timeout waiting for condition")
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	t.Parallel()
+
+	client, server, cleanup := testClientServer(t, WithMaxConcurrentRequests(2))
+	defer cleanup()
+
+	release := make(chan struct{})
+	if err := server.Register("block", func() error {
+		<-release
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server stops reading after the third request instead of starting a
+	// goroutine for each waiting request, so sending the fourth request
+	// blocks.
+	const n = 4
+	done := make(chan *Call, n)
+	for i := 0; i < n; i++ {
+		go client.Go("block", done, nil)
+	}
+
+	waitFor(t, func() bool {
+		stats := server.QueueStats()
+		return stats.ActiveRequests == 2 && stats.WaitingRequests == 1
+	})
+
+	close(release)
+	for i := 0; i < n; i++ {
+		if c := <-done; c.Err != nil {
+			t.Fatal(c.Err)
+		}
+	}
+	waitFor(t, func() bool {
+		return server.QueueStats().ActiveRequests == 0
+	})
+}
+
+func TestNotificationQueue(t *testing.T) {
+	t.Parallel()
+
+	notificationQueueTests := []struct {
+		policy        OverflowPolicy
+		notifications []string
+		want          []string
+		wantStats     QueueStats
+	}{
+		{
+			policy:        OverflowBlock,
+			notifications: []string{"a:1", "a:2", "b:1", "a:3"},
+			want:          []string{"first", "a:1", "a:2", "b:1", "a:3"},
+		},
+		{
+			policy:        OverflowDropOldest,
+			notifications: []string{"a:1", "a:2", "b:1", "a:3"},
+			want:          []string{"first", "b:1", "a:3"},
+			wantStats:     QueueStats{DroppedNotifications: 2},
+		},
+		{
+			policy:        OverflowCoalesce,
+			notifications: []string{"a:1", "b:1", "a:2", "c:1"},
+			want:          []string{"first", "a:2", "c:1"},
+			wantStats:     QueueStats{DroppedNotifications: 1, CoalescedNotifications: 1},
+		},
+	}
+	for _, tt := range notificationQueueTests {
+		tt := tt
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			t.Parallel()
+
+			client, server, cleanup := testClientServer(t, WithNotificationQueue(2, tt.policy))
+			defer cleanup()
+
+			var (
+				mu  sync.Mutex
+				got []string
+			)
+			started := make(chan struct{})
+			release := make(chan struct{})
+			handler := func(method string) func(string) {
+				return func(s string) {
+					if s == "first" {
+						close(started)
+						<-release
+					}
+					mu.Lock()
+					got = append(got, s)
+					mu.Unlock()
+				}
+			}
+			for _, method := range []string{"a", "b", "c"} {
+				if err := server.Register(method, handler(method)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := server.Register("sync", func() error { return nil }); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := client.Notify("a", "first"); err != nil {
+				t.Fatal(err)
+			}
+			<-started
+
+			notifyErr := make(chan error, 1)
+			go func() {
+				for _, n := range tt.notifications {
+					if err := client.Notify(n[:1], n); err != nil {
+						notifyErr <- err
+						return
+					}
+				}
+				notifyErr <- nil
+			}()
+
+			if tt.policy == OverflowBlock {
+				// The server stops reading messages until the queue has space.
+				waitFor(t, func() bool {
+					return server.QueueStats().QueuedNotifications == 2
+				})
+			} else {
+				if err := <-notifyErr; err != nil {
+					t.Fatal(err)
+				}
+				// The server handles messages in order. Wait for the
+				// notifications to be queued.
+				if err := client.Call("sync", nil); err != nil {
+					t.Fatal(err)
+				}
+				if stats := server.QueueStats(); stats.QueuedNotifications != 2 {
+					t.Fatalf("got %d queued notifications, want 2", stats.QueuedNotifications)
+				}
+			}
+			close(release)
+
+			waitFor(t, func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return len(got) == len(tt.want)
+			})
+			if tt.policy == OverflowBlock {
+				if err := <-notifyErr; err != nil {
+					t.Fatal(err)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			if stats := server.QueueStats(); !reflect.DeepEqual(stats, tt.wantStats) {
+				t.Fatalf("got stats %+v, want %+v", stats, tt.wantStats)
+			}
+		})
+	}
+}
+
+func TestNotificationLanes(t *testing.T) {
+	t.Parallel()
+
+	client, server, cleanup := testClientServer(t)
+	defer cleanup()
+
+	release := make(chan struct{})
+	gotCh := make(chan string, 10)
+	if err := server.RegisterWithLane("ev", FirstArgLane, func(buf int, s string) {
+		if s == "block" {
+			<-release
+		}
+		gotCh <- fmt.Sprintf("%d:%s", buf, s)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register("n", func(s string) {
+		gotCh <- s
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	notify := func(method string, args ...any) {
+		t.Helper()
+		if err := client.Notify(method, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	notify("ev", 1, "block")
+	notify("ev", 1, "a")
+	notify("ev", 2, "b")
+	notify("n", "c")
+	notify("ev", 2, "d")
+
+	// Lane 1 is blocked. Lane 2 and the default lane are not.
+	var got []string
+	for i := 0; i < 3; i++ {
+		got = append(got, <-gotCh)
+	}
+	sort.Strings(got)
+	if want := []string{"2:b", "2:d", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	waitFor(t, func() bool {
+		stats := server.QueueStats()
+		return stats.Lanes == 1 && stats.QueuedNotifications == 1
+	})
+
+	close(release)
+	got = []string{<-gotCh, <-gotCh}
+	if want := []string{"1:block", "1:a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	waitFor(t, func() bool {
+		return server.QueueStats().Lanes == 0
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	t.Parallel()
+
+	client, server, cleanup := testClientServer(t)
+	defer cleanup()
+
+	if err := client.Register("ping", func() (string, error) { return "pong", nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	if err := server.Register("save", func() (string, error) {
+		close(started)
+		<-release
+		// Calls to the peer work while shutting down.
+		var s string
+		err := server.Call("ping", &s)
+		return s, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	notified := make(chan struct{})
+	if err := server.Register("n", func() {
+		<-release
+		close(notified)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register("other", func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	var result string
+	call := client.Go("save", nil, &result)
+	<-started
+
+	// Queue a notification. The server handles messages in order.
+	if err := client.Notify("n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("other", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- server.Shutdown(context.Background())
+	}()
+
+	// New requests are rejected.
+	waitFor(t, func() bool {
+		err := client.Call("other", nil)
+		var rpcErr Error
+		return errors.As(err, &rpcErr) && rpcErr.Value == ErrShutdown.Error()
+	})
+
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned %v before the handler completed", err)
+	default:
+	}
+
+	close(release)
+	if c := <-call.Done; c.Err != nil {
+		t.Fatal(c.Err)
+	}
+	if result != "pong" {
+		t.Fatalf("got %q, want %q", result, "pong")
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("other", nil); err == nil {
+		t.Fatal("expected error after shutdown")
+	}
+
+	select {
+	case <-notified:
+	default:
+		t.Fatal("queued notification not handled before Shutdown returned")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	t.Parallel()
+
+	client, server, cleanup := testClientServer(t)
+	defer cleanup()
+
+	started := make(chan struct{})
+	if err := server.Register("block", func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	call := client.Go("block", nil, nil)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if c := <-call.Done; c.Err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	t.Parallel()
+
+	serverConn, clientConn := net.Pipe()
+	server, err := NewEndpoint(serverConn, serverConn, serverConn, WithLogf(t.Logf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register("add", func(a, b int) (int, error) { return a + b, nil }); err != nil {
+		t.Fatal(err)
+	}
+	notified := make(chan string, 1)
+	if err := server.Register("hello", func(s string) { notified <- s }); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Close()
+
+	var buf bytes.Buffer
+	rw := NewRecordWriter(&buf)
+	client, err := NewEndpoint(clientConn, clientConn, clientConn, WithLogf(t.Logf), WithRecorder(rw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Serve()
+
+	session := func(t *testing.T, e *Endpoint) {
+		t.Helper()
+
+		var sum int
+		if err := e.Call("add", &sum, 1, 2); err != nil {
+			t.Fatal(err)
+		}
+		if sum != 3 {
+			t.Fatalf("add(1, 2) = %d, want 3", sum)
+		}
+		if err := e.Notify("hello", "world"); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Call("add", &sum, 3, 4); err != nil {
+			t.Fatal(err)
+		}
+		if sum != 7 {
+			t.Fatalf("add(3, 4) = %d, want 7", sum)
+		}
+	}
+
+	session(t, client)
+	if got := <-notified; got != "world" {
+		t.Fatalf("hello(%q), want %q", got, "world")
+	}
+	client.Close()
+	if err := rw.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := ReadRecords(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type summary struct {
+		Direction Direction
+		Kind      MessageKind
+		ID        uint64
+		Method    string
+	}
+	var got []summary
+	for _, r := range records {
+		got = append(got, summary{r.Direction, r.Kind, r.ID, r.Method})
+	}
+	want := []summary{
+		{Outbound, RequestMessage, 1, "add"},
+		{Inbound, ReplyMessage, 1, ""},
+		{Outbound, NotificationMessage, 0, "hello"},
+		{Outbound, RequestMessage, 2, "add"},
+		{Inbound, ReplyMessage, 2, ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("records = %v, want %v", got, want)
+	}
+
+	t.Run("Replay", func(t *testing.T) {
+		rp := NewReplayer(records, nil)
+		e, err := NewEndpoint(rp, rp, rp, WithLogf(t.Logf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		go e.Serve()
+		defer e.Close()
+
+		session(t, e)
+		if err := rp.Err(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		rp := NewReplayer(records, nil)
+		e, err := NewEndpoint(rp, rp, rp, WithLogf(t.Logf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		go e.Serve()
+		defer e.Close()
+
+		var sum int
+		if err := e.Call("add", &sum, 1, 3); err != nil {
+			t.Fatal(err)
+		}
+		if err := rp.Err(); !errors.Is(err, ErrReplayMismatch) {
+			t.Fatalf("Err() = %v, want %v", err, ErrReplayMismatch)
+		}
+	})
+}
+
+// encodeMessage returns the MessagePack encoding of the message v.
+func encodeMessage(tb testing.TB, v ...any) []byte {
+	tb.Helper()
+
+	var buf bytes.Buffer
+	if err := msgpack.NewEncoder(&buf).Encode(v); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReplayReplyOrder(t *testing.T) {
+	t.Parallel()
+
+	var records []*Record
+	for _, m := range []struct {
+		d   Direction
+		raw []byte
+	}{
+		{Inbound, encodeMessage(t, 0, 1, "a", []any{})},
+		{Inbound, encodeMessage(t, 0, 2, "b", []any{})},
+		{Outbound, encodeMessage(t, 1, 2, nil, "b")},
+		{Outbound, encodeMessage(t, 1, 1, nil, "a")},
+	} {
+		r, err := newRecord(m.d, time.Now(), m.raw, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+
+	rp := NewReplayer(records, nil)
+	e, err := NewEndpoint(rp, rp, rp, WithLogf(t.Logf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	// The reply to b is recorded first but written last.
+	release := make(chan struct{})
+	if err := e.Register("a", func() (string, error) { return "a", nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Register("b", func() (string, error) {
+		<-release
+		return "b", nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- e.Serve() }()
+
+	waitFor(t, func() bool {
+		rp.mu.Lock()
+		defer rp.mu.Unlock()
+		return rp.written[3]
+	})
+	close(release)
+
+	select {
+	case <-serveErr:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the replay to end")
+	}
+	if err := rp.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMessageSplitter(t *testing.T) {
+	t.Parallel()
+
+	messages := [][]byte{
+		encodeMessage(t, 2, "event", []any{
+			map[string]any{
+				"bin":    []byte{1, 2, 3},
+				"neg":    int64(-1000),
+				"float":  1.5,
+				"str":    strings.Repeat("x", 300),
+				"nil":    nil,
+				"bool":   true,
+				"uint":   uint64(1 << 40),
+				"nested": []any{[]any{}, map[string]any{}},
+			},
+		}),
+		encodeMessage(t, 0, 1, "big", []any{strings.Repeat("y", 100000)}),
+		encodeMessage(t, 1, 1, nil, nil),
+	}
+	stream := bytes.Join(messages, nil)
+
+	// The messages are split when the stream is written one byte at a time.
+	var s messageSplitter
+	var got [][]byte
+	for i := range stream {
+		s.Write(stream[i : i+1])
+		for raw := s.next(); raw != nil; raw = s.next() {
+			got = append(got, raw)
+		}
+	}
+	if !reflect.DeepEqual(got, messages) {
+		t.Fatalf("got %d messages, want %d", len(got), len(messages))
+	}
+	if s.err != nil || len(s.buf) != 0 {
+		t.Fatalf("err = %v, %d bytes buffered, want nil, 0 bytes", s.err, len(s.buf))
+	}
+
+	// An invalid stream is discarded.
+	for _, invalid := range [][]byte{{0x01}, {0x91, 0xc1}} {
+		var s messageSplitter
+		s.Write(invalid)
+		s.Write(messages[0])
+		if raw := s.next(); raw != nil {
+			t.Errorf("next() after %x = %x, want nil", invalid, raw)
+		}
+		if !errors.Is(s.err, errInvalidMessage) || s.buf != nil {
+			t.Errorf("err = %v, buf = %x after %x, want %v, nil", s.err, s.buf, invalid, errInvalidMessage)
+		}
+	}
+}
+
+func TestCallStats(t *testing.T) {
+	t.Parallel()
+
+	client, server, cleanup := testClientServer(t, WithCallStats())
+	defer cleanup()
+
+	if err := server.Register("add", func(a, b int) (int, error) { return a + b, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register("fail", func() error { return errors.New("fail") }); err != nil {
+		t.Fatal(err)
+	}
+	notified := make(chan struct{}, 1)
+	if err := server.Register("hello", func(s string) { notified <- struct{}{} }); err != nil {
+		t.Fatal(err)
+	}
+
+	var sum int
+	for i := 0; i < 3; i++ {
+		if err := client.Call("add", &sum, i, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Call("fail", nil); err == nil {
+		t.Fatal("fail returned nil error")
+	}
+	if err := client.Notify("hello", "world"); err != nil {
+		t.Fatal(err)
+	}
+	<-notified
+
+	type counts struct {
+		Calls, Errors uint64
+		InFlight      int64
+	}
+	want := map[string]counts{
+		"add":   {Calls: 3},
+		"fail":  {Calls: 1, Errors: 1},
+		"hello": {Calls: 1},
+	}
+
+	clientStats := client.CallStats()
+	var serverStats CallStats
+	waitFor(t, func() bool {
+		// The server counts a call after sending the reply.
+		serverStats = server.CallStats()
+		return serverStats.Incoming["hello"].Calls == 1 && serverStats.Incoming["fail"].Calls == 1
+	})
+
+	for method, w := range want {
+		out := clientStats.Outgoing[method]
+		in := serverStats.Incoming[method]
+		if got := (counts{out.Calls, out.Errors, out.InFlight}); got != w {
+			t.Errorf("client %s stats = %+v, want %+v", method, got, w)
+		}
+		if got := (counts{in.Calls, in.Errors, in.InFlight}); got != w {
+			t.Errorf("server %s stats = %+v, want %+v", method, got, w)
+		}
+		if out.Latency.Count() != w.Calls || in.Latency.Count() != w.Calls {
+			t.Errorf("%s latency count = %d, %d, want %d", method, out.Latency.Count(), in.Latency.Count(), w.Calls)
+		}
+		if out.BytesSent == 0 || out.BytesSent != in.BytesReceived {
+			t.Errorf("%s client sent %d bytes, server received %d bytes", method, out.BytesSent, in.BytesReceived)
+		}
+		if out.BytesReceived != in.BytesSent {
+			t.Errorf("%s client received %d bytes, server sent %d bytes", method, out.BytesReceived, in.BytesSent)
+		}
+	}
+	if len(clientStats.Incoming) != 0 || len(serverStats.Outgoing) != 0 {
+		t.Errorf("unexpected stats: client incoming %v, server outgoing %v", clientStats.Incoming, serverStats.Outgoing)
+	}
+
+	if s := client.Expvar().String(); !strings.Contains(s, `"add":`) {
+		t.Errorf("Expvar() = %s, want add stats", s)
+	}
+}
+
+func TestCallStatsDisabled(t *testing.T) {
+	t.Parallel()
+
+	client, server, cleanup := testClientServer(t)
+	defer cleanup()
+
+	if err := server.Register("add", func(a, b int) (int, error) { return a + b, nil }); err != nil {
+		t.Fatal(err)
+	}
+	var sum int
+	if err := client.Call("add", &sum, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	for name, stats := range map[string]CallStats{"client": client.CallStats(), "server": server.CallStats()} {
+		if len(stats.Outgoing) != 0 || len(stats.Incoming) != 0 {
+			t.Errorf("%s stats = %+v, want empty", name, stats)
+		}
+	}
+}
+
+func TestCallStatsMaxMethods(t *testing.T) {
+	t.Parallel()
+
+	client, server, cleanup := testClientServer(t, WithCallStats(), WithFallbackHandler(func(string, RawArgs) (any, error) {
+		return nil, nil
+	}))
+	defer cleanup()
+
+	const n = maxMethodStats + 10
+	for i := 0; i < n; i++ {
+		if err := client.Call(fmt.Sprintf("method%d", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stats CallStats
+	waitFor(t, func() bool {
+		// The server counts a call after sending the reply.
+		stats = server.CallStats()
+		var calls uint64
+		for _, s := range stats.Incoming {
+			calls += s.Calls
+		}
+		return calls == n
+	})
+	if got, want := len(stats.Incoming), maxMethodStats+1; got != want {
+		t.Errorf("server tracks %d methods, want %d", got, want)
+	}
+	if got, want := stats.Incoming[OtherMethods].Calls, uint64(n-maxMethodStats); got != want {
+		t.Errorf("server counted %d calls under %s, want %d", got, OtherMethods, want)
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	t.Parallel()
+
+	var h LatencyHistogram
+	if got := h.Quantile(0.5); got != 0 {
+		t.Fatalf("empty Quantile(0.5) = %v, want 0", got)
+	}
+	for _, d := range []time.Duration{50 * time.Microsecond, 200 * time.Microsecond, 300 * time.Microsecond, 20 * time.Second} {
+		h.observe(d)
+	}
+
+	tests := []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0, 100 * time.Microsecond},
+		{0.5, 250 * time.Microsecond},
+		{0.75, 500 * time.Microsecond},
+		{1, 20 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := h.Quantile(tt.q); got != tt.want {
+			t.Errorf("Quantile(%v) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+	if got, want := h.Mean(), (20*time.Second+550*time.Microsecond)/4; got != want {
+		t.Errorf("Mean() = %v, want %v", got, want)
+	}
+	if h.Max != 20*time.Second {
+		t.Errorf("Max = %v, want %v", h.Max, 20*time.Second)
+	}
+}
+
+type writeCounter struct {
+	buf    bytes.Buffer
+	writes int
+	mu     sync.Mutex
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes++
+	return w.buf.Write(p)
+}
+
+func TestCoalescedWrites(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Coalesce", func(t *testing.T) {
+		t.Parallel()
+
+		var w writeCounter
+		r, pw := io.Pipe()
+		defer pw.Close()
+		e, err := NewEndpoint(r, &w, r, WithLogf(t.Logf), WithCoalescedWrites(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		const n = 100
+		for i := 0; i < n; i++ {
+			if err := e.Notify("hello", i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := e.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if w.writes != 1 {
+			t.Errorf("writes = %d, want 1", w.writes)
+		}
+		var s messageSplitter
+		s.Write(w.buf.Bytes())
+		count := 0
+		for raw := s.next(); raw != nil; raw = s.next() {
+			rec, err := newRecord(Outbound, time.Now(), raw, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []any{int64(count)}; rec.Method != "hello" || !reflect.DeepEqual(rec.Payload, want) {
+				t.Fatalf("message %d = %v, want hello %v", count, rec, want)
+			}
+			count++
+		}
+		if count != n {
+			t.Fatalf("got %d messages, want %d", count, n)
+		}
+	})
+
+	t.Run("Session", func(t *testing.T) {
+		t.Parallel()
+
+		client, server, cleanup := testClientServer(t, WithCoalescedWrites(time.Millisecond))
+		defer cleanup()
+
+		if err := server.Register("add", func(a, b int) (int, error) { return a + b, nil }); err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var sum int
+				if err := client.Call("add", &sum, i, i); err != nil {
+					t.Error(err)
+					return
+				}
+				if sum != 2*i {
+					t.Errorf("add(%d, %d) = %d, want %d", i, i, sum, 2*i)
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+
+	t.Run("Call", func(t *testing.T) {
+		t.Parallel()
+
+		// Requests and replies do not wait for the max latency.
+		client, server, cleanup := testClientServer(t, WithCoalescedWrites(time.Hour))
+		defer cleanup()
+
+		if err := server.Register("add", func(a, b int) (int, error) { return a + b, nil }); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var sum int
+		if err := client.CallContext(ctx, "add", &sum, 1, 2); err != nil {
+			t.Fatal(err)
+		}
+		if sum != 3 {
+			t.Fatalf("add(1, 2) = %d, want 3", sum)
+		}
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		t.Parallel()
+
+		client, server, cleanup := testClientServer(t, WithCoalescedWrites(time.Hour))
+		defer cleanup()
+
+		notifCh := make(chan string, 1)
+		if err := server.Register("n", func(s string) { notifCh <- s }); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.Notify("n", "hello"); err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+
+		select {
+		case got := <-notifCh:
+			if got != "hello" {
+				t.Fatalf("got %q, want %q", got, "hello")
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("notification queued before Close was not received")
+		}
+	})
+
+	t.Run("Backpressure", func(t *testing.T) {
+		t.Parallel()
+
+		r, pw := io.Pipe()
+		defer pw.Close()
+		blocked := make(chan struct{})
+		w := writerFunc(func(p []byte) (int, error) {
+			<-blocked
+			return len(p), nil
+		})
+		e, err := NewEndpoint(r, w, r, WithLogf(t.Logf), WithCoalescedWrites(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer e.Close()
+
+		// The writer goroutine takes the first message and blocks in the
+		// write. Notify blocks once the queue is over the limit.
+		payload := strings.Repeat("x", 64*1024)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 2*maxQueuedBytes/len(payload); i++ {
+				if err := e.Notify("n", payload); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+
+		waitFor(t, func() bool {
+			e.coalescer.mu.Lock()
+			defer e.coalescer.mu.Unlock()
+			return e.coalescer.buf.Len() >= maxQueuedBytes
+		})
+		select {
+		case <-done:
+			t.Fatal("Notify did not block with a full queue")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		close(blocked)
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Notify blocked after the writer goroutine caught up")
+		}
+		if err := e.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// writerFunc is an io.Writer implemented by a function.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestHandle(t *testing.T) {
+	t.Parallel()
+
+	type addArgs struct {
+		A int `msgpack:",array"`
+		B int
+	}
+
+	var interceptedArgs []any
+	var mu sync.Mutex
+	client, server, cleanup := testClientServer(t, WithServerInterceptor(func(ctx context.Context, info *CallInfo, handler Handler) (any, error) {
+		mu.Lock()
+		interceptedArgs = info.Args
+		mu.Unlock()
+		return handler(ctx, info)
+	}))
+	defer cleanup()
+
+	Handle(server, "add", func(ctx context.Context, args addArgs) (int, error) {
+		if method, _ := MethodFromContext(ctx); method != "add" {
+			return 0, fmt.Errorf("method = %q, want %q", method, "add")
+		}
+		return args.A + args.B, nil
+	})
+	Handle(server, "fail", func(ctx context.Context, args struct{}) (any, error) {
+		return nil, errors.New("failed")
+	})
+	notified := make(chan string, 1)
+	Handle(server, "hello", func(ctx context.Context, args struct {
+		S string `msgpack:",array"`
+	}) (struct{}, error) {
+		notified <- args.S
+		return struct{}{}, nil
+	})
+
+	t.Run("Call", func(t *testing.T) {
+		sum, err := Request[int](context.Background(), client, "add", 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum != 3 {
+			t.Fatalf("add(1, 2) = %d, want 3", sum)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if want := []any{addArgs{1, 2}}; !reflect.DeepEqual(interceptedArgs, want) {
+			t.Fatalf("intercepted args = %v, want %v", interceptedArgs, want)
+		}
+	})
+
+	t.Run("MissingAndExtraArgs", func(t *testing.T) {
+		sum, err := Request[int](context.Background(), client, "add", 1)
+		if err != nil || sum != 1 {
+			t.Fatalf("add(1) = %d, %v, want 1, nil", sum, err)
+		}
+		sum, err = Request[int](context.Background(), client, "add", 1, 2, 3)
+		if err != nil || sum != 3 {
+			t.Fatalf("add(1, 2, 3) = %d, %v, want 3, nil", sum, err)
+		}
+	})
+
+	t.Run("InvalidArgument", func(t *testing.T) {
+		_, err := Request[int](context.Background(), client, "add", "x", 2)
+		if err == nil || err.Error() != ErrInvalidArgument.Error() {
+			t.Fatalf("add(\"x\", 2) returned error %v, want %v", err, ErrInvalidArgument)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		_, err := Request[any](context.Background(), client, "fail")
+		if err == nil || err.Error() != "failed" {
+			t.Fatalf("fail returned error %v, want failed", err)
+		}
+	})
+
+	t.Run("Notification", func(t *testing.T) {
+		if err := client.Notify("hello", "world"); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-notified; got != "world" {
+			t.Fatalf("hello(%q), want %q", got, "world")
+		}
+	})
+}
+
+func TestFallbackHandler(t *testing.T) {
+	t.Parallel()
+
+	type fallbackCall struct {
+		Method string
+		Args   []any
+	}
+	calls := make(chan fallbackCall, 10)
+	client, server, cleanup := testClientServer(t, WithFallbackHandler(func(method string, args RawArgs) (any, error) {
+		values, err := args.Values()
+		if err != nil {
+			return nil, err
+		}
+		calls <- fallbackCall{method, values}
+		if method == "fail" {
+			return nil, errors.New("failed")
+		}
+		return args, nil
+	}))
+	defer cleanup()
+
+	if err := server.Register("echo", func(s string) (string, error) { return "registered " + s, nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	var reply []any
+	if err := client.Call("dynamic", &reply, "a", int64(-1), uint64(1), 1.5, []byte{1}, map[string]any{"k": true}, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []any{"a", int64(-1), int64(1), 1.5, []byte{1}, map[string]any{"k": true}, nil}
+	if !reflect.DeepEqual(reply, want) {
+		t.Fatalf("dynamic reply = %#v, want %#v", reply, want)
+	}
+	if got := <-calls; got.Method != "dynamic" || !reflect.DeepEqual(got.Args, want) {
+		t.Fatalf("fallback call = %v, want dynamic %v", got, want)
+	}
+
+	if err := client.Call("fail", nil); err == nil || err.Error() != "failed" {
+		t.Fatalf("fail returned error %v, want failed", err)
+	}
+	<-calls
+
+	var s string
+	if err := client.Call("echo", &s, "x"); err != nil || s != "registered x" {
+		t.Fatalf("echo(x) = %q, %v, want %q", s, err, "registered x")
+	}
+
+	server.Unregister("echo")
+	if err := client.Call("echo", nil, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-calls; got.Method != "echo" || !reflect.DeepEqual(got.Args, []any{"x"}) {
+		t.Fatalf("fallback call = %v, want echo [x]", got)
+	}
+
+	if err := client.Notify("event"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-calls; got.Method != "event" || len(got.Args) != 0 {
+		t.Fatalf("fallback call = %v, want event []", got)
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	t.Parallel()
+
+	client, server, cleanup := testClientServer(t)
+	defer cleanup()
+
+	if err := server.Register("echo", func(s string) (string, error) { return s, nil }); err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	if err := client.Call("echo", &s, "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Unregister("echo")
+	err := client.Call("echo", &s, "x")
+	if err == nil || err.Error() != "unknown request method: echo" {
+		t.Fatalf("echo returned error %v, want unknown request method", err)
+	}
+}
+
+func TestNewPipe(t *testing.T) {
+	t.Parallel()
+
+	client, server, err := NewPipe(WithLogf(t.Logf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.Register("add", func(a, b int) (int, error) { return a + b, nil }); err != nil {
+		t.Fatal(err)
+	}
+	var sum int
+	if err := client.Call("add", &sum, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if sum != 3 {
+		t.Fatalf("add(1, 2) = %d, want 3", sum)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Closing the client closes the server.
+	waitFor(t, func() bool { return errors.Is(server.Call("add", &sum, 1, 2), ErrClosed) })
+}
+
+// TestNewPipeNoOptions does not run in parallel because it replaces the output
+// of the standard logger.
+func TestNewPipeNoOptions(t *testing.T) {
+	var logBuf syncBuffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	client, server, err := NewPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := server.Register("panic", func() error {
+		panic("boom")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var rpcErr Error
+	if err := client.Call("unknown", nil); !errors.As(err, &rpcErr) {
+		t.Fatalf("call of unknown method returned %v, want rpc.Error", err)
+	}
+	if err := client.Call("panic", nil); !errors.As(err, &rpcErr) {
+		t.Fatalf("call of panicking method returned %v, want rpc.Error", err)
+	}
+
+	s := logBuf.String()
+	for _, want := range []string{"method unknown not found", "panic: boom"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("log does not contain %q, log is %q", want, s)
+		}
+	}
+}
+
+// testProxyClient connects a client to p and returns the client Endpoint.
+func testProxyClient(tb testing.TB, p *Proxy) *Endpoint {
+	tb.Helper()
+
+	proxyConn, clientConn := net.Pipe()
+	go p.ServeConn(proxyConn)
+
+	client, err := NewEndpoint(clientConn, clientConn, clientConn, WithLogf(tb.Logf))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go client.Serve()
+	tb.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestProxy(t *testing.T) {
+	t.Parallel()
+
+	upstream, server, err := NewPipe(WithLogf(t.Logf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	var (
+		mu       sync.Mutex
+		commands []string
+		events   []string
+	)
+	release := make(chan struct{})
+	server.Register("echo", func(s string) (string, error) {
+		<-release
+		return s, nil
+	})
+	server.Register("fail", func() error {
+		return errors.New("failed")
+	})
+	server.Register("identity", func(v any) (any, error) {
+		return v, nil
+	})
+	for _, method := range []string{"nvim_command", "vim_command"} {
+		server.Register(method, func(cmd string) {
+			mu.Lock()
+			commands = append(commands, cmd)
+			mu.Unlock()
+		})
+	}
+	server.Register("nvim_call_atomic", func(calls []any) ([]any, error) {
+		return []any{[]any{}, nil}, nil
+	})
+	server.Register("event", func(name string) {
+		mu.Lock()
+		events = append(events, name)
+		mu.Unlock()
+	})
+
+	p := NewProxy(upstream, ProxyLogf(t.Logf), ProxyDeny("nvim_command"))
+	defer p.Close()
+
+	client1 := testProxyClient(t, p)
+	client2 := testProxyClient(t, p)
+
+	// Calls with the same request id from different clients are routed back
+	// to the calling client.
+	call1 := client1.Go("echo", nil, new(string), "one")
+	call2 := client2.Go("echo", nil, new(string), "two")
+	close(release)
+	for call, want := range map[*Call]string{call1: "one", call2: "two"} {
+		<-call.Done
+		if call.Err != nil {
+			t.Fatal(call.Err)
+		}
+		if got := *call.Reply.(*string); got != want {
+			t.Fatalf("echo returned %q, want %q", got, want)
+		}
+	}
+
+	err = client1.Call("fail", nil)
+	var rpcErr Error
+	if !errors.As(err, &rpcErr) || rpcErr.Value != "failed" {
+		t.Fatalf("fail returned %v, want the upstream error", err)
+	}
+
+	// Nil arguments and results are forwarded as nil.
+	var result any = "not nil"
+	if err := client1.Call("identity", &result, nil); err != nil {
+		t.Fatal(err)
+	}
+	if result != nil {
+		t.Fatalf("identity(nil) returned %v, want nil", result)
+	}
+
+	for _, tt := range []struct {
+		method string
+		args   []any
+	}{
+		{"nvim_command", []any{"qa!"}},
+		{"vim_command", []any{"qa!"}},
+		{"nvim_call_atomic", []any{[]any{[]any{"echo", []any{"x"}}, []any{"nvim_command", []any{"qa!"}}}}},
+		{"nvim_call_atomic", []any{[]any{[]any{"vim_command", []any{"qa!"}}}}},
+		{"nvim_call_atomic", []any{[]any{[]any{"nvim_call_atomic", []any{[]any{[]any{"nvim_command", []any{"qa!"}}}}}}}},
+		{"nvim_call_atomic", []any{[]any{[]any{"nvim_call_atomic", nil}}}},
+	} {
+		err := client1.Call(tt.method, nil, tt.args...)
+		if !errors.As(err, &rpcErr) || !strings.Contains(fmt.Sprint(rpcErr.Value), ErrMethodNotAllowed.Error()) {
+			t.Fatalf("%s returned %v, want %v", tt.method, err, ErrMethodNotAllowed)
+		}
+	}
+	if err := client1.Call("nvim_call_atomic", nil, []any{[]any{"echo", []any{"x"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client2.Notify("nvim_command", "qa!"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client2.Notify("event", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events) == 1
+	})
+	mu.Lock()
+	if len(commands) != 0 || events[0] != "hello" {
+		t.Fatalf("upstream received commands %q and events %q", commands, events)
+	}
+	mu.Unlock()
+
+	received := make(chan string, 2)
+	for _, client := range []*Endpoint{client1, client2} {
+		client.Register("redraw", func(s string) {
+			received <- s
+		})
+	}
+	if err := p.Broadcast("redraw", "flush"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if got := <-received; got != "flush" {
+			t.Fatalf("client received %q, want %q", got, "flush")
+		}
+	}
+}
+
+func TestProxyAllow(t *testing.T) {
+	t.Parallel()
+
+	upstream, server, err := NewPipe(WithLogf(t.Logf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	server.Register("nvim_buf_get_name", func(b int) (string, error) { return "name", nil })
+	server.Register("nvim_buf_delete", func(b int) error { return nil })
+	server.Register("nvim_get_mode", func() (string, error) { return "n", nil })
+	server.Register("buffer_get_name", func(b int) (string, error) { return "name", nil })
+	server.Register("buffer_del_line", func(b, line int) error { return nil })
+	server.Register("vim_get_current_buffer", func() (int, error) { return 1, nil })
+
+	p := NewProxy(upstream, ProxyLogf(t.Logf), ProxyAllow("nvim_buf_*", "nvim_get_current_buf"), ProxyDeny("nvim_buf_delete", "nvim_buf_del_*"))
+	defer p.Close()
+	client := testProxyClient(t, p)
+
+	tests := []struct {
+		method  string
+		args    []any
+		allowed bool
+	}{
+		{"nvim_buf_get_name", []any{1}, true},
+		{"nvim_buf_delete", []any{1}, false},
+		{"nvim_get_mode", nil, false},
+		{"buffer_get_name", []any{1}, true},
+		{"buffer_del_line", []any{1, 0}, false},
+		{"vim_get_current_buffer", nil, true},
+	}
+	for _, tt := range tests {
+		err := client.Call(tt.method, nil, tt.args...)
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("%s returned %v, want allowed %v", tt.method, err, tt.allowed)
+		}
+	}
+}
+
+func TestProxyRateLimit(t *testing.T) {
+	t.Parallel()
+
+	upstream, server, err := NewPipe(WithLogf(t.Logf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	server.Register("ping", func() error { return nil })
+
+	p := NewProxy(upstream, ProxyLogf(t.Logf), ProxyRateLimit(0.001, 2))
+	defer p.Close()
+	client1 := testProxyClient(t, p)
+	client2 := testProxyClient(t, p)
+
+	for i := 0; i < 2; i++ {
+		if err := client1.Call("ping", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = client1.Call("ping", nil)
+	var rpcErr Error
+	if !errors.As(err, &rpcErr) || rpcErr.Value != ErrRateLimited.Error() {
+		t.Fatalf("third ping returned %v, want %v", err, ErrRateLimited)
+	}
+
+	// Clients are rate limited independently.
+	if err := client2.Call("ping", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	l := newRateLimiter(10, 2)
+	now := time.Now()
+	for i, want := range []bool{true, true, false} {
+		if got := l.allow(now); got != want {
+			t.Fatalf("allow #%d = %v, want %v", i, got, want)
+		}
+	}
+	if !l.allow(now.Add(100 * time.Millisecond)) {
+		t.Fatal("token not refilled after 100ms")
+	}
+	if l.allow(now.Add(100 * time.Millisecond)) {
+		t.Fatal("allow after refilled token was taken = true")
+	}
+	now = now.Add(time.Hour)
+	for i, want := range []bool{true, true, false} {
+		if got := l.allow(now); got != want {
+			t.Fatalf("allow #%d after an hour = %v, want %v", i, got, want)
+		}
+	}
+}
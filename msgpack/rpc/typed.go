@@ -0,0 +1,66 @@
+package rpc
+
+import (
+	"context"
+
+	"github.com/neovim/go-client/msgpack"
+)
+
+// Handle registers the typed handler fn for the specified method name.
+//
+// The arguments sent by the peer are decoded into a value of type Args. Use a
+// struct with the msgpack:",array" tag on the first field to decode the
+// arguments by position:
+//
+//	type addArgs struct {
+//		A int `msgpack:",array"`
+//		B int
+//	}
+//
+//	rpc.Handle(e, "add", func(ctx context.Context, args addArgs) (int, error) {
+//		return args.A + args.B, nil
+//	})
+//
+// Missing arguments are set to the zero value and extra arguments are
+// ignored. When the peer sends no arguments, fn is called with the zero value
+// of Args, so struct{} can be used for methods without arguments. The result
+// is discarded for notifications.
+//
+// Handle checks the types of fn at compile time. The arguments are decoded
+// with the same decoder as for Register, so Handle is not faster than
+// Register.
+//
+// The context passed to fn is the same as the context passed to the handlers
+// registered with Register. The CallInfo passed to the server interceptors has
+// a single argument, the decoded Args value.
+func Handle[Args, Result any](e *Endpoint, method string, fn func(ctx context.Context, args Args) (Result, error)) {
+	h := &handler{
+		ctx: true,
+		decode: func(_ string, _ bool, dec *msgpack.Decoder) (func(context.Context) (any, error), any, error) {
+			var args Args
+			if dec != nil {
+				if err := dec.Decode(&args); err != nil {
+					return nil, nil, err
+				}
+			}
+			return func(ctx context.Context) (any, error) {
+				return fn(ctx, args)
+			}, args, nil
+		},
+	}
+
+	e.handlersMu.Lock()
+	e.handlers[method] = h
+	e.handlersMu.Unlock()
+}
+
+// Request invokes the target method, waits for a response or for ctx to be
+// done and returns the result decoded into a value of type Result.
+//
+// Request is the generic form of Endpoint.Call. It is not named Call because
+// this package already has a Call type.
+func Request[Result any](ctx context.Context, e *Endpoint, method string, args ...any) (Result, error) {
+	var result Result
+	err := e.CallContext(ctx, method, &result, args...)
+	return result, err
+}
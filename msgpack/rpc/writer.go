@@ -0,0 +1,304 @@
+package rpc
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// WithCoalescedWrites configures Endpoint to coalesce outgoing messages.
+// Requests and replies are written as soon as no other write is in progress.
+// Messages encoded while a write is in progress are sent to the peer in a
+// single write after it. Notifications are written from a writer goroutine
+// that waits at most maxLatency for more messages after the first queued
+// notification. When maxLatency is zero, the writer goroutine writes the
+// queued notifications as soon as it runs.
+//
+// Call, Go and the replies to incoming calls write the queued messages from
+// the calling goroutine when no other write is in progress. Notify returns
+// without waiting for the message to be written. When more than 1 MiB is
+// queued, sending a message blocks until the queued messages are written. A
+// write error closes the endpoint and is returned from the next call.
+//
+// Close writes the queued messages before closing the connection. Messages
+// that are not written within one second are discarded.
+func WithCoalescedWrites(maxLatency time.Duration) Option {
+	return Option{func(e *Endpoint) {
+		e.coalesce = true
+		e.maxWriteLatency = maxLatency
+	}}
+}
+
+// maxCoalescedBytes is the number of queued bytes that make the writer
+// goroutine write without waiting for the max latency.
+const maxCoalescedBytes = 64 * 1024
+
+// maxQueuedBytes is the number of queued bytes that block Write until the
+// writer goroutine takes the queued bytes.
+const maxQueuedBytes = 1024 * 1024
+
+// closeFlushTimeout is the time Endpoint.Close waits for the queued bytes to
+// be written.
+const closeFlushTimeout = time.Second
+
+// coalescingWriter queues the bytes written to it and writes them to w from a
+// writer goroutine or from the goroutine calling writeNow.
+type coalescingWriter struct {
+	w   io.Writer
+	err error
+
+	// buf is the queued bytes. spare is the buffer being written to w and
+	// swapped with buf.
+	buf   *bytes.Buffer
+	spare *bytes.Buffer
+
+	cond *sync.Cond
+	wake chan struct{}
+	quit chan struct{}
+
+	// onError is called from the writer goroutine on a write error.
+	onError func(err error)
+
+	maxLatency time.Duration
+
+	// first is the time the first queued byte in buf was written.
+	first time.Time
+
+	// queued and written are the total number of bytes queued and written
+	// to w.
+	queued  int64
+	written int64
+
+	mu     sync.Mutex
+	closed bool
+
+	// writing is true while a goroutine writes spare to w.
+	writing bool
+
+	// flush is true when the queued bytes are written without waiting for
+	// the max latency.
+	flush bool
+}
+
+func newCoalescingWriter(w io.Writer, maxLatency time.Duration, onError func(error)) *coalescingWriter {
+	cw := &coalescingWriter{
+		w:          w,
+		buf:        new(bytes.Buffer),
+		spare:      new(bytes.Buffer),
+		wake:       make(chan struct{}, 1),
+		quit:       make(chan struct{}),
+		onError:    onError,
+		maxLatency: maxLatency,
+	}
+	cw.cond = sync.NewCond(&cw.mu)
+	go cw.run()
+	return cw
+}
+
+// Write queues p to be written to w by writeNow or by the writer goroutine
+// after signal. Write blocks while maxQueuedBytes or more are queued.
+func (cw *coalescingWriter) Write(p []byte) (int, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	for cw.buf.Len() >= maxQueuedBytes && cw.err == nil && !cw.closed {
+		cw.signal()
+		cw.cond.Wait()
+	}
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	if cw.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if cw.buf.Len() == 0 {
+		cw.first = time.Now()
+	}
+	cw.buf.Write(p)
+	cw.queued += int64(len(p))
+	return len(p), nil
+}
+
+// signal wakes the writer goroutine to write the queued bytes within the max
+// latency.
+func (cw *coalescingWriter) signal() {
+	select {
+	case cw.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Flush waits until the bytes queued before the call are written to w.
+func (cw *coalescingWriter) Flush() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	target := cw.queued
+	for cw.written < target && cw.err == nil && !cw.closed {
+		cw.flush = true
+		cw.signal()
+		cw.cond.Wait()
+	}
+	if cw.err != nil {
+		return cw.err
+	}
+	if cw.written < target {
+		return io.ErrClosedPipe
+	}
+	return nil
+}
+
+// Close waits at most timeout for the queued bytes to be written to w and
+// stops the writer goroutine. Bytes that are not written within timeout are
+// discarded.
+func (cw *coalescingWriter) Close(timeout time.Duration) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.closed {
+		return
+	}
+
+	target := cw.queued
+	expired := false
+	t := time.AfterFunc(timeout, func() {
+		cw.mu.Lock()
+		expired = true
+		cw.cond.Broadcast()
+		cw.mu.Unlock()
+	})
+	for cw.written < target && cw.err == nil && !expired {
+		cw.flush = true
+		cw.signal()
+		cw.cond.Wait()
+	}
+	t.Stop()
+
+	cw.closed = true
+	close(cw.quit)
+	cw.cond.Broadcast()
+}
+
+// writeNow writes the queued bytes from the calling goroutine. When another
+// goroutine is writing, the queued bytes are written after that write
+// without waiting for the max latency.
+func (cw *coalescingWriter) writeNow() {
+	cw.write(true)
+}
+
+func (cw *coalescingWriter) run() {
+	var timer *time.Timer
+	for {
+		select {
+		case <-cw.wake:
+		case <-cw.quit:
+			return
+		}
+
+		if d := cw.wait(); d > 0 {
+			if timer == nil {
+				timer = time.NewTimer(d)
+			} else {
+				timer.Reset(d)
+			}
+		wait:
+			for {
+				select {
+				case <-timer.C:
+					break wait
+				case <-cw.wake:
+					if cw.full() {
+						if !timer.Stop() {
+							<-timer.C
+						}
+						break wait
+					}
+				case <-cw.quit:
+					timer.Stop()
+					return
+				}
+			}
+		}
+
+		if !cw.write(false) {
+			return
+		}
+	}
+}
+
+// write writes the queued bytes to w unless another goroutine is writing. If
+// urgent is true and another goroutine is writing, the queued bytes are
+// written after that write without waiting for the max latency. write
+// returns false after a write error.
+func (cw *coalescingWriter) write(urgent bool) bool {
+	cw.mu.Lock()
+	if cw.err != nil || cw.closed {
+		cw.mu.Unlock()
+		return cw.err == nil
+	}
+	if cw.writing {
+		if urgent {
+			cw.flush = true
+		}
+		cw.mu.Unlock()
+		return true
+	}
+
+	for {
+		cw.writing = true
+		cw.buf, cw.spare = cw.spare, cw.buf
+		cw.flush = false
+		cw.cond.Broadcast()
+		cw.mu.Unlock()
+
+		n := int64(cw.spare.Len())
+		var err error
+		if n > 0 {
+			_, err = cw.w.Write(cw.spare.Bytes())
+			cw.spare.Reset()
+		}
+
+		cw.mu.Lock()
+		cw.writing = false
+		cw.written += n
+		if err != nil && cw.err == nil {
+			cw.err = err
+		}
+		cw.cond.Broadcast()
+		if err != nil {
+			cw.mu.Unlock()
+			cw.onError(err)
+			return false
+		}
+		if cw.buf.Len() == 0 || cw.closed {
+			cw.mu.Unlock()
+			return true
+		}
+		if !cw.flush {
+			// Leave the queued notifications to the writer goroutine.
+			cw.mu.Unlock()
+			cw.signal()
+			return true
+		}
+		// Write the requests and replies queued during the write.
+	}
+}
+
+// wait returns the time to wait for more messages before writing the queued
+// messages.
+func (cw *coalescingWriter) wait() time.Duration {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.maxLatency <= 0 || cw.flush || cw.buf.Len() == 0 || cw.buf.Len() >= maxCoalescedBytes {
+		return 0
+	}
+	return time.Until(cw.first.Add(cw.maxLatency))
+}
+
+// full reports whether the writer goroutine should write without waiting for
+// more messages.
+func (cw *coalescingWriter) full() bool {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.flush || cw.buf.Len() >= maxCoalescedBytes
+}
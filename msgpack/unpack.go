@@ -70,6 +70,12 @@ type Decoder struct {
 
 const bufioReaderSize = 4096
 
+// DecoderBufferSize is the buffer size of the *bufio.Reader that a Decoder
+// reads from. NewDecoder uses a *bufio.Reader with a buffer of at least
+// DecoderBufferSize bytes as is, so the caller can use the reader to track
+// the bytes consumed by the decoder.
+const DecoderBufferSize = bufioReaderSize
+
 // NewDecoder allocates and initializes a new decoder.
 func NewDecoder(r io.Reader) *Decoder {
 	return &Decoder{
@@ -1,6 +1,7 @@
 package msgpack
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/hex"
 	"io"
@@ -650,3 +651,12 @@ func TestUnpackEOF(t *testing.T) {
 		})
 	}
 }
+
+func TestNewDecoderBufferedReader(t *testing.T) {
+	t.Parallel()
+
+	br := bufio.NewReaderSize(bytes.NewReader(nil), DecoderBufferSize)
+	if d := NewDecoder(br); d.r != br {
+		t.Fatal("NewDecoder did not use the *bufio.Reader of DecoderBufferSize bytes as is")
+	}
+}
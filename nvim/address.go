@@ -0,0 +1,233 @@
+package nvim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseAddress parses an Nvim server address in one of the forms
+//
+//	unix:/path/to/socket
+//	unix:///path/to/socket
+//	tcp://host:port
+//	tcp:host:port
+//	host:port
+//	[::1]:port
+//	/path/to/socket
+//	relative/path/to/socket
+//
+// and returns the network ("unix" or "tcp") and the address to dial. A bare
+// address is a TCP address when it has the form host:port with a numeric
+// port, and a socket path otherwise. Relative socket paths are made absolute
+// so that the address stays valid when the working directory changes.
+//
+//	:help --listen
+//	:help serverstart()
+func ParseAddress(address string) (network, addr string, err error) {
+	if address == "" {
+		return "", "", errors.New("nvim: empty address")
+	}
+
+	// The explicit prefixes are checked first: "unix:1234" has the form
+	// host:port.
+	switch {
+	case strings.HasPrefix(address, "unix:"):
+		path := strings.TrimPrefix(address, "unix:")
+		if strings.HasPrefix(path, "//") {
+			path = strings.TrimPrefix(path, "//")
+		}
+		if path == "" {
+			return "", "", fmt.Errorf("nvim: invalid address %q: missing socket path", address)
+		}
+		return socketAddress(path)
+	case strings.HasPrefix(address, "tcp:"):
+		hostport := strings.TrimPrefix(strings.TrimPrefix(address, "tcp:"), "//")
+		if !isHostPort(hostport) {
+			return "", "", fmt.Errorf("nvim: invalid address %q: want tcp://host:port", address)
+		}
+		return "tcp", hostport, nil
+	case isHostPort(address):
+		return "tcp", address, nil
+	case strings.HasPrefix(address, "["):
+		return "", "", fmt.Errorf("nvim: invalid address %q: want [host]:port", address)
+	default:
+		return socketAddress(address)
+	}
+}
+
+// isHostPort reports whether s has the form host:port with a numeric port.
+func isHostPort(s string) bool {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || strings.ContainsAny(host, `/\`) {
+		return false
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	return err == nil && (n > 0 || port == "0")
+}
+
+func socketAddress(path string) (network, addr string, err error) {
+	// Windows named pipes and abstract unix sockets are not files.
+	if strings.HasPrefix(path, `\\`) || strings.HasPrefix(path, "@") {
+		return "unix", path, nil
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", "", err
+	}
+	return "unix", path, nil
+}
+
+// DialFromEnv dials the Nvim instance given by the $NVIM environment
+// variable. Nvim sets $NVIM in the environment of jobs and :terminal
+// processes. The deprecated $NVIM_LISTEN_ADDRESS variable is used when $NVIM
+// is not set.
+//
+//	:help $NVIM
+func DialFromEnv(options ...DialOption) (*Nvim, error) {
+	address := os.Getenv("NVIM")
+	if address == "" {
+		address = os.Getenv("NVIM_LISTEN_ADDRESS")
+	}
+	if address == "" {
+		return nil, errors.New("nvim: $NVIM is not set")
+	}
+	return Dial(address, options...)
+}
+
+// ServerInfo describes a running Nvim server found by DiscoverServers.
+type ServerInfo struct {
+	// Address is the address of the server socket.
+	Address string
+
+	// PID is the process id of the server.
+	PID int
+
+	// Cwd is the current working directory of the server.
+	Cwd string
+}
+
+// discoverTimeout is the time limit for probing a server.
+const discoverTimeout = time.Second
+
+// DiscoverServers returns the Nvim servers listening on the default socket
+// locations under $XDG_RUNTIME_DIR and the temporary directory. Each socket
+// named nvim.* (or a socket in a directory named nvim*) is probed with
+// nvim_get_api_info; sockets left behind by exited servers are skipped. The
+// servers are sorted by address.
+//
+//	:help serverlist()
+//	:help stdpath()
+func DiscoverServers() ([]*ServerInfo, error) {
+	var roots []string
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		roots = append(roots, dir)
+	}
+	roots = append(roots, os.TempDir())
+
+	seen := make(map[string]bool)
+	var paths []string
+	for _, root := range roots {
+		found, err := findSockets(root)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, path := range found {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	sort.Strings(paths)
+
+	var servers []*ServerInfo
+	for _, path := range paths {
+		if info, err := probeServer(path); err == nil {
+			servers = append(servers, info)
+		}
+	}
+	return servers, nil
+}
+
+// findSockets returns the Nvim sockets in root. Nvim creates sockets named
+// nvim.<pid>.<n> in $XDG_RUNTIME_DIR or in a directory under
+// $TMPDIR/nvim.<user>, and older versions create sockets in a nvim<random>
+// directory under $TMPDIR.
+func findSockets(root string) ([]string, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "nvim") {
+			continue
+		}
+		path := filepath.Join(root, entry.Name())
+		switch {
+		case entry.Type()&fs.ModeSocket != 0:
+			paths = append(paths, path)
+		case entry.IsDir():
+			paths = append(paths, findNestedSockets(path, 2)...)
+		}
+	}
+	return paths, nil
+}
+
+// findNestedSockets returns the sockets in dir and its subdirectories up to
+// depth levels deep. Unreadable directories are skipped.
+func findNestedSockets(dir string, depth int) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		switch {
+		case entry.Type()&fs.ModeSocket != 0:
+			paths = append(paths, path)
+		case entry.IsDir() && depth > 1:
+			paths = append(paths, findNestedSockets(path, depth-1)...)
+		}
+	}
+	return paths
+}
+
+// probeServer connects to the socket at path and queries the server pid and
+// working directory.
+func probeServer(path string) (*ServerInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), discoverTimeout)
+	defer cancel()
+
+	v, err := Dial("unix:"+path, DialContext(ctx), DialLogf(func(string, ...any) {}))
+	if err != nil {
+		return nil, err
+	}
+	defer v.Close()
+	v = v.WithContext(ctx)
+
+	if _, err := v.APIInfo(); err != nil {
+		return nil, err
+	}
+
+	info := &ServerInfo{Address: path}
+	if err := v.Call("getpid", &info.PID); err != nil {
+		return nil, err
+	}
+	if err := v.Call("getcwd", &info.Cwd); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
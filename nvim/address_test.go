@@ -0,0 +1,184 @@
+package nvim
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/neovim/go-client/msgpack/rpc"
+)
+
+func TestParseAddress(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		address     string
+		wantNetwork string
+		wantAddr    string
+		wantErr     bool
+	}{
+		{address: "/tmp/nvim.sock", wantNetwork: "unix", wantAddr: "/tmp/nvim.sock"},
+		{address: "unix:/tmp/nvim.sock", wantNetwork: "unix", wantAddr: "/tmp/nvim.sock"},
+		{address: "unix:///tmp/nvim.sock", wantNetwork: "unix", wantAddr: "/tmp/nvim.sock"},
+		{address: "unix:1234", wantNetwork: "unix", wantAddr: filepath.Join(wd, "1234")},
+		{address: "nvim.sock", wantNetwork: "unix", wantAddr: filepath.Join(wd, "nvim.sock")},
+		{address: "run/nvim:1.sock", wantNetwork: "unix", wantAddr: filepath.Join(wd, "run/nvim:1.sock")},
+		{address: "127.0.0.1:6666", wantNetwork: "tcp", wantAddr: "127.0.0.1:6666"},
+		{address: "localhost:6666", wantNetwork: "tcp", wantAddr: "localhost:6666"},
+		{address: ":6666", wantNetwork: "tcp", wantAddr: ":6666"},
+		{address: "[::1]:6666", wantNetwork: "tcp", wantAddr: "[::1]:6666"},
+		{address: "tcp://[::1]:6666", wantNetwork: "tcp", wantAddr: "[::1]:6666"},
+		{address: "tcp://localhost:6666", wantNetwork: "tcp", wantAddr: "localhost:6666"},
+		{address: "tcp:localhost:6666", wantNetwork: "tcp", wantAddr: "localhost:6666"},
+		{address: "", wantErr: true},
+		{address: "unix:", wantErr: true},
+		{address: "tcp://localhost", wantErr: true},
+		{address: "tcp://localhost:nvim", wantErr: true},
+		{address: "tcp:6666", wantErr: true},
+		{address: "[::1]", wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.address, func(t *testing.T) {
+			t.Parallel()
+
+			network, addr, err := ParseAddress(tt.address)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseAddress(%q) = %q, %q, want error", tt.address, network, addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if network != tt.wantNetwork || addr != tt.wantAddr {
+				t.Fatalf("ParseAddress(%q) = %q, %q, want %q, %q", tt.address, network, addr, tt.wantNetwork, tt.wantAddr)
+			}
+		})
+	}
+}
+
+// listenFakeServer serves nvim_get_api_info, getpid() and getcwd() on a unix
+// socket at path.
+func listenFakeServer(tb testing.TB, path string, pid int, cwd string) {
+	tb.Helper()
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			ep, err := rpc.NewEndpoint(c, c, c, rpc.WithLogf(tb.Logf))
+			if err != nil {
+				c.Close()
+				return
+			}
+			ep.Register("nvim_get_api_info", func() ([]any, error) {
+				return []any{1, map[string]any{}}, nil
+			})
+			ep.Register("nvim_call_function", func(fname string, args []any) (any, error) {
+				switch fname {
+				case "getpid":
+					return pid, nil
+				case "getcwd":
+					return cwd, nil
+				}
+				return nil, rpc.Error{Value: "unknown function " + fname}
+			})
+			go ep.Serve()
+		}
+	}()
+}
+
+func TestDiscoverServers(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("not supported dial unix socket on windows GOOS")
+	}
+
+	runtimeDir := t.TempDir()
+	tmpDir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	t.Setenv("TMPDIR", tmpDir)
+
+	listenFakeServer(t, filepath.Join(runtimeDir, "nvim.100.0"), 100, "/src/a")
+	if err := os.MkdirAll(filepath.Join(tmpDir, "nvim.user", "abc123"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	listenFakeServer(t, filepath.Join(tmpDir, "nvim.user", "abc123", "nvim.200.0"), 200, "/src/b")
+
+	// A socket left behind by an exited server.
+	ln, err := net.Listen("unix", filepath.Join(runtimeDir, "nvim.300.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	// Files that are not sockets and sockets not named nvim are ignored.
+	if err := os.WriteFile(filepath.Join(runtimeDir, "nvim.400.0"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	listenFakeServer(t, filepath.Join(runtimeDir, "other.sock"), 500, "/src/c")
+
+	servers, err := DiscoverServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ServerInfo{
+		{Address: filepath.Join(runtimeDir, "nvim.100.0"), PID: 100, Cwd: "/src/a"},
+		{Address: filepath.Join(tmpDir, "nvim.user", "abc123", "nvim.200.0"), PID: 200, Cwd: "/src/b"},
+	}
+	if len(servers) != len(want) {
+		t.Fatalf("DiscoverServers() returned %d servers, want %d: %v", len(servers), len(want), servers)
+	}
+	for i, s := range servers {
+		if *s != want[i] {
+			t.Fatalf("server %d is %+v, want %+v", i, *s, want[i])
+		}
+	}
+}
+
+func TestDialFromEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("not supported dial unix socket on windows GOOS")
+	}
+
+	t.Setenv("NVIM", "")
+	t.Setenv("NVIM_LISTEN_ADDRESS", "")
+	if _, err := DialFromEnv(); err == nil {
+		t.Fatal("DialFromEnv() with $NVIM unset returned nil error")
+	}
+
+	path := filepath.Join(t.TempDir(), "nvim.sock")
+	listenFakeServer(t, path, 100, "/src")
+	t.Setenv("NVIM", "unix:"+path)
+
+	v, err := DialFromEnv(DialLogf(t.Logf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	var pid int
+	if err := v.Call("getpid", &pid); err != nil {
+		t.Fatal(err)
+	}
+	if pid != 100 {
+		t.Fatalf("getpid() = %d, want %d", pid, 100)
+	}
+}
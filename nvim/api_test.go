@@ -3731,6 +3731,10 @@ func testBatch(v *Nvim) func(*testing.T) {
 		if e, ok := err.(*BatchError); !ok || e.Index != errorIndex {
 			t.Fatalf("unxpected error %T %v", e, e)
 		}
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.Method != "nvim_get_var" {
+			t.Fatalf("unxpected error %T %v", err, err)
+		}
 		// Expect results proceeding error.
 		for i := 0; i < errorIndex; i++ {
 			if results[i] != i {
@@ -0,0 +1,362 @@
+package nvim
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BufferMirror is a local copy of the lines of a buffer. The mirror reads the
+// lines once and then applies the EventBufLines events of the buffer. The
+// parts of a multipart change are applied together when the last part is
+// received. When an event does not follow the changedtick of the mirror, the
+// mirror reads the lines again. The read methods of the mirror do not call
+// Nvim.
+//
+// It is safe to call BufferMirror methods concurrently.
+type BufferMirror struct {
+	w     *BufferWatch
+	ready chan struct{}
+
+	mu      sync.RWMutex
+	lines   []string
+	tick    int64
+	snap    *BufferSnapshot
+	synced  bool
+	resyncs int
+
+	// next holds the lines of a multipart change until the last part of
+	// the change is received.
+	next     []string
+	nextTick int64
+}
+
+// MirrorBuffer returns a mirror of buffer. Buffer 0 is the current buffer.
+// MirrorBuffer returns after the lines of the buffer are read. The mirror is
+// closed when ctx is done.
+//
+// MirrorBuffer watches the buffer with WatchBuffer. The mirror reattaches
+// when Nvim detaches the buffer and ends when reattaching fails.
+func (v *Nvim) MirrorBuffer(ctx context.Context, buffer Buffer) (*BufferMirror, error) {
+	m := &BufferMirror{ready: make(chan struct{})}
+
+	// Events are not applied until m.w is set.
+	m.mu.Lock()
+	w, err := v.WatchBuffer(ctx, buffer, &BufferWatchOptions{
+		SendBuffer: true,
+		Reattach:   true,
+		Callback:   m.handle,
+	})
+	m.w = w
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-m.ready:
+		return m, nil
+	case <-w.Done():
+		if err := w.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrBufferDetached
+	}
+}
+
+// Buffer returns the mirrored buffer.
+func (m *BufferMirror) Buffer() Buffer {
+	return m.w.Buffer()
+}
+
+// Close stops updating the mirror. The lines of the mirror can be read after
+// Close.
+func (m *BufferMirror) Close() error {
+	return m.w.Close()
+}
+
+// Done returns a channel that is closed when the mirror stops updating.
+func (m *BufferMirror) Done() <-chan struct{} {
+	return m.w.Done()
+}
+
+// Err returns nil if Done is not yet closed. After Done is closed, Err
+// returns the reason the mirror stopped updating. See BufferWatch.Err.
+func (m *BufferMirror) Err() error {
+	return m.w.Err()
+}
+
+// Changedtick returns the changedtick of the buffer after the last change
+// applied to the mirror.
+func (m *BufferMirror) Changedtick() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.tick
+}
+
+// Resyncs returns the number of times the mirror read the lines of the buffer
+// again because of a changedtick gap.
+func (m *BufferMirror) Resyncs() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.resyncs
+}
+
+// LineCount returns the number of lines in the mirror.
+func (m *BufferMirror) LineCount() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.lines)
+}
+
+// Lines returns the lines from start up to, but not including, end. Indexing
+// is zero-based and negative indices count from the end like in
+// nvim_buf_get_lines: -1 refers to the index after the last line. Lines
+// returns an error for indices out of range.
+func (m *BufferMirror) Lines(start, end int) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return lineSlice(m.lines, start, end)
+}
+
+// Snapshot returns an immutable copy of the lines of the mirror.
+func (m *BufferMirror) Snapshot() *BufferSnapshot {
+	m.mu.RLock()
+	snap := m.snap
+	m.mu.RUnlock()
+	if snap != nil {
+		return snap
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.snap == nil {
+		m.snap = &BufferSnapshot{
+			Buffer:      m.w.Buffer(),
+			Changedtick: m.tick,
+			lines:       append([]string(nil), m.lines...),
+		}
+	}
+	return m.snap
+}
+
+// handle applies ev to the mirror. It is the Callback of the watch.
+func (m *BufferMirror) handle(ev BufferEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch ev := ev.(type) {
+	case *BufLinesEvent:
+		m.applyLines(ev)
+	case *ChangedtickEvent:
+		if !m.synced || m.next != nil {
+			return
+		}
+		// The changedtick can increase by more than one without a lines
+		// event, for example after undoing to the same text.
+		if ev.Changetick <= m.tick {
+			m.resync()
+			return
+		}
+		m.tick = ev.Changetick
+		m.snap = nil
+	}
+}
+
+// applyLines applies ev to the mirror. The parts of a multipart change are
+// applied when the last part is received. The caller must hold m.mu.
+func (m *BufferMirror) applyLines(ev *BufLinesEvent) {
+	// The watch delivers the whole buffer with FirstLine 0 and LastLine -1
+	// after attaching and when the mirror resyncs.
+	whole := ev.FirstLine == 0 && ev.LastLine == -1
+	if whole && m.next == nil {
+		m.synced = true
+		m.next = []string{}
+		m.nextTick = ev.Changetick
+	}
+	if !m.synced {
+		return
+	}
+
+	if m.next == nil {
+		// The first part of a change. Lines events without a changedtick
+		// are not checked.
+		if ev.Changetick != 0 && ev.Changetick != m.tick+1 {
+			m.resync()
+			return
+		}
+		if ev.IsMultipart {
+			m.next = append([]string(nil), m.lines...)
+		} else {
+			m.next = m.lines
+		}
+		m.nextTick = ev.Changetick
+	} else if ev.Changetick != m.nextTick {
+		m.resync()
+		return
+	}
+
+	first, last := int(ev.FirstLine), int(ev.LastLine)
+	if last == -1 {
+		last = len(m.next)
+	}
+	if first < 0 || first > last || last > len(m.next) {
+		m.resync()
+		return
+	}
+	m.next = replaceLines(m.next, first, last, ev.LineData)
+	if ev.IsMultipart {
+		return
+	}
+
+	m.lines = m.next
+	if m.nextTick != 0 {
+		m.tick = m.nextTick
+	}
+	m.next = nil
+	m.snap = nil
+	if whole {
+		select {
+		case <-m.ready:
+		default:
+			close(m.ready)
+		}
+	}
+}
+
+// resync discards the changes until the watch delivers the whole buffer. The
+// caller must hold m.mu.
+func (m *BufferMirror) resync() {
+	m.synced = false
+	m.next = nil
+	m.resyncs++
+	m.w.resync()
+}
+
+// replaceLines replaces lines[first:last] with data. The lines are replaced in
+// place when the capacity of lines allows.
+func replaceLines(lines []string, first, last int, data []string) []string {
+	n := len(lines) - (last - first) + len(data)
+	if n > cap(lines) {
+		r := make([]string, n, n+n/4)
+		copy(r, lines[:first])
+		copy(r[first:], data)
+		copy(r[first+len(data):], lines[last:])
+		return r
+	}
+
+	r := lines[:n]
+	copy(r[first+len(data):], lines[last:])
+	copy(r[first:], data)
+	for i := n; i < len(lines); i++ {
+		lines[i] = ""
+	}
+	return r
+}
+
+// lineSlice returns lines[start:end] with the indexing of nvim_buf_get_lines.
+func lineSlice(lines []string, start, end int) ([]string, error) {
+	n := len(lines)
+	s, e := start, end
+	if s < 0 {
+		s += n + 1
+	}
+	if e < 0 {
+		e += n + 1
+	}
+	if s < 0 || s > n || e < 0 || e > n {
+		return nil, fmt.Errorf("nvim: index out of bounds: [%d:%d] of %d lines", start, end, n)
+	}
+	if s >= e {
+		return []string{}, nil
+	}
+	return append([]string(nil), lines[s:e]...), nil
+}
+
+// BufferSnapshot is an immutable copy of the lines of a buffer. Byte offsets
+// count one end of line byte after each line, like nvim_buf_get_offset for a
+// buffer with 'fileformat' "unix".
+type BufferSnapshot struct {
+	// Buffer is the buffer of the snapshot.
+	Buffer Buffer
+
+	// Changedtick is the changedtick of the buffer when the snapshot was
+	// taken.
+	Changedtick int64
+
+	lines []string
+
+	offsetsOnce sync.Once
+	offsets     []int
+}
+
+// LineCount returns the number of lines in the snapshot.
+func (s *BufferSnapshot) LineCount() int {
+	return len(s.lines)
+}
+
+// Lines returns the lines from start up to, but not including, end. See
+// BufferMirror.Lines.
+func (s *BufferSnapshot) Lines(start, end int) ([]string, error) {
+	return lineSlice(s.lines, start, end)
+}
+
+// Offset returns the byte offset of the start of the zero-based line. The
+// offset of the line after the last line is the size of the buffer.
+func (s *BufferSnapshot) Offset(line int) (int, error) {
+	offsets := s.lineOffsets()
+	if line < 0 || line >= len(offsets) {
+		return 0, fmt.Errorf("nvim: line index out of bounds: %d of %d lines", line, len(s.lines))
+	}
+	return offsets[line], nil
+}
+
+// Position returns the zero-based line and byte column of the byte offset. An
+// offset of an end of line byte is the position after the last byte of the
+// line.
+func (s *BufferSnapshot) Position(offset int) (line, col int, err error) {
+	offsets := s.lineOffsets()
+	if offset < 0 || offset >= offsets[len(offsets)-1] {
+		return 0, 0, fmt.Errorf("nvim: byte offset out of bounds: %d of %d bytes", offset, offsets[len(offsets)-1])
+	}
+	line = sort.SearchInts(offsets, offset+1) - 1
+	return line, offset - offsets[line], nil
+}
+
+// Text returns the text from the byte offset start up to, but not including,
+// the byte offset end. Lines are joined with "\n".
+func (s *BufferSnapshot) Text(start, end int) (string, error) {
+	offsets := s.lineOffsets()
+	size := offsets[len(offsets)-1]
+	if start < 0 || end > size || start > end {
+		return "", fmt.Errorf("nvim: byte range out of bounds: [%d:%d] of %d bytes", start, end, size)
+	}
+	if start == end {
+		return "", nil
+	}
+
+	first := sort.SearchInts(offsets, start+1) - 1
+	last := sort.SearchInts(offsets, end) - 1
+	var b strings.Builder
+	b.Grow(end - start)
+	for i := first; i <= last; i++ {
+		b.WriteString(s.lines[i])
+		b.WriteByte('\n')
+	}
+	text := b.String()
+	return text[start-offsets[first] : end-offsets[first]], nil
+}
+
+// lineOffsets returns the byte offsets of the lines and the size of the
+// buffer.
+func (s *BufferSnapshot) lineOffsets() []int {
+	s.offsetsOnce.Do(func() {
+		s.offsets = make([]int, len(s.lines)+1)
+		for i, line := range s.lines {
+			s.offsets[i+1] = s.offsets[i] + len(line) + 1
+		}
+	})
+	return s.offsets
+}
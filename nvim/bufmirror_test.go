@@ -0,0 +1,205 @@
+package nvim_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/neovim/go-client/nvim"
+	"github.com/neovim/go-client/nvim/nvimtest/fake"
+)
+
+// waitChangedtick waits until the changedtick of m is tick.
+func waitChangedtick(tb testing.TB, m *nvim.BufferMirror, tick int64) {
+	tb.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for m.Changedtick() != tick {
+		if time.Now().After(deadline) {
+			tb.Fatalf("timeout waiting for changedtick %d, changedtick is %d", tick, m.Changedtick())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func mirrorLines(tb testing.TB, m *nvim.BufferMirror) []string {
+	tb.Helper()
+
+	lines, err := m.Lines(0, -1)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return lines
+}
+
+func TestBufferMirror(t *testing.T) {
+	t.Parallel()
+
+	v, _ := fake.New(t)
+	if err := v.SetBufferLines(1, 0, -1, true, bytesLines("a", "b", "c")); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := v.MirrorBuffer(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if got, want := mirrorLines(t, m), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("initial lines are %q, want %q", got, want)
+	}
+	if got := m.Changedtick(); got != 3 {
+		t.Fatalf("Changedtick() = %d, want 3", got)
+	}
+	snap := m.Snapshot()
+
+	edits := []struct {
+		start, end int
+		lines      []string
+	}{
+		{1, 2, []string{"x", "y"}},
+		{0, 0, []string{"first"}},
+		{4, 5, nil},
+		{-1, -1, []string{"last"}},
+		{0, -1, []string{"one"}},
+	}
+	tick := int64(3)
+	for _, e := range edits {
+		if err := v.SetBufferLines(1, e.start, e.end, true, bytesLines(e.lines...)); err != nil {
+			t.Fatal(err)
+		}
+		tick++
+		waitChangedtick(t, m, tick)
+
+		want, err := v.BufferLines(1, 0, -1, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := mirrorLines(t, m); !reflect.DeepEqual(bytesLines(got...), want) {
+			t.Fatalf("after edit %v lines are %q, want %q", e, got, want)
+		}
+	}
+	if n := m.Resyncs(); n != 0 {
+		t.Fatalf("Resyncs() = %d, want 0", n)
+	}
+
+	// Snapshots are not changed by later edits.
+	if got, want := snap.Changedtick, int64(3); got != want {
+		t.Fatalf("snapshot Changedtick = %d, want %d", got, want)
+	}
+	if got, err := snap.Lines(0, -1); err != nil || !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Fatalf("snapshot Lines() = %q, %v, want %q", got, err, []string{"a", "b", "c"})
+	}
+	if _, err := m.Lines(0, 3); err == nil {
+		t.Fatal("Lines() out of range returned nil error")
+	}
+}
+
+func TestBufferSnapshot(t *testing.T) {
+	t.Parallel()
+
+	v, _ := fake.New(t)
+	if err := v.SetBufferLines(1, 0, -1, true, bytesLines("ab", "", "cde")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := v.MirrorBuffer(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	snap := m.Snapshot()
+
+	for line, want := range []int{0, 3, 4, 8} {
+		if got, err := snap.Offset(line); err != nil || got != want {
+			t.Errorf("Offset(%d) = %d, %v, want %d", line, got, err, want)
+		}
+	}
+	if _, err := snap.Offset(4); err == nil {
+		t.Error("Offset(4) returned nil error")
+	}
+
+	positions := [][2]int{{0, 0}, {0, 1}, {0, 2}, {1, 0}, {2, 0}, {2, 1}, {2, 2}, {2, 3}}
+	for offset, want := range positions {
+		line, col, err := snap.Position(offset)
+		if err != nil || [2]int{line, col} != want {
+			t.Errorf("Position(%d) = %d, %d, %v, want %v", offset, line, col, err, want)
+		}
+	}
+	if _, _, err := snap.Position(8); err == nil {
+		t.Error("Position(8) returned nil error")
+	}
+
+	texts := []struct {
+		start, end int
+		want       string
+	}{
+		{0, 8, "ab\n\ncde\n"},
+		{1, 5, "b\n\nc"},
+		{3, 4, "\n"},
+		{5, 5, ""},
+		{4, 7, "cde"},
+	}
+	for _, tt := range texts {
+		if got, err := snap.Text(tt.start, tt.end); err != nil || got != tt.want {
+			t.Errorf("Text(%d, %d) = %q, %v, want %q", tt.start, tt.end, got, err, tt.want)
+		}
+	}
+	if _, err := snap.Text(4, 9); err == nil {
+		t.Error("Text(4, 9) returned nil error")
+	}
+}
+
+func TestBufferMirrorEvents(t *testing.T) {
+	t.Parallel()
+
+	v, s := fake.New(t)
+	if err := v.SetBufferLines(1, 0, -1, true, bytesLines("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := v.MirrorBuffer(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	notify := func(args ...any) {
+		t.Helper()
+		if err := s.Endpoint().Notify(nvim.EventBufLines, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A multipart change is applied when the last part is received.
+	notify(nvim.Buffer(1), 4, 0, 1, []string{"x"}, true)
+	notify(nvim.Buffer(1), 4, 1, 2, []string{"y", "z"}, false)
+	waitChangedtick(t, m, 4)
+	if got, want := mirrorLines(t, m), []string{"x", "y", "z"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("lines after multipart change are %q, want %q", got, want)
+	}
+
+	// The changedtick can skip values without a lines event.
+	if err := s.Endpoint().Notify(nvim.EventBufChangedtick, nvim.Buffer(1), 7); err != nil {
+		t.Fatal(err)
+	}
+	waitChangedtick(t, m, 7)
+	notify(nvim.Buffer(1), 8, 3, 3, []string{"w"}, false)
+	waitChangedtick(t, m, 8)
+	if got, want := mirrorLines(t, m), []string{"x", "y", "z", "w"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("lines after changedtick event are %q, want %q", got, want)
+	}
+	if n := m.Resyncs(); n != 0 {
+		t.Fatalf("Resyncs() = %d, want 0", n)
+	}
+
+	// A changedtick gap makes the mirror read the lines from the server.
+	notify(nvim.Buffer(1), 12, 0, 0, []string{"lost"}, false)
+	waitChangedtick(t, m, 3)
+	if got, want := mirrorLines(t, m), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("lines after resync are %q, want %q", got, want)
+	}
+	if n := m.Resyncs(); n != 1 {
+		t.Fatalf("Resyncs() = %d, want 1", n)
+	}
+}
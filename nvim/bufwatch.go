@@ -0,0 +1,547 @@
+package nvim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrBufferDetached is the error returned by BufferWatch.Err when Nvim
+// detached the buffer, for example because the buffer was unloaded, and the
+// watch was not reattached.
+var ErrBufferDetached = errors.New("nvim: buffer detached")
+
+// BufferEvent is an event delivered by a BufferWatch. The dynamic type of a
+// BufferEvent is *BufLinesEvent, *ChangedtickEvent or *BufDetachEvent.
+type BufferEvent interface {
+	bufferEvent()
+}
+
+func (*BufLinesEvent) bufferEvent()    {}
+func (*ChangedtickEvent) bufferEvent() {}
+func (*BufDetachEvent) bufferEvent()   {}
+
+// compile time check whether the event types implement BufferEvent interface.
+var (
+	_ BufferEvent = (*BufLinesEvent)(nil)
+	_ BufferEvent = (*ChangedtickEvent)(nil)
+	_ BufferEvent = (*BufDetachEvent)(nil)
+)
+
+// BufferWatchOptions specifies the options for WatchBuffer.
+type BufferWatchOptions struct {
+	// SendBuffer specifies whether the first event is a *BufLinesEvent with
+	// the contents of the whole buffer. The event has FirstLine 0 and
+	// LastLine -1. Events for changes made before the contents were read are
+	// not delivered.
+	//
+	// The contents are read with nvim_buf_get_lines instead of the
+	// send_buffer argument of nvim_buf_attach, so one attachment serves all
+	// watches of the buffer.
+	SendBuffer bool
+
+	// Reattach specifies whether to attach to the buffer again when Nvim
+	// detaches it, for example when the buffer is reloaded with :edit. The
+	// watch delivers a *BufLinesEvent with the contents of the whole buffer
+	// after reattaching. If attaching fails, the watch ends with a
+	// *BufDetachEvent.
+	Reattach bool
+
+	// Callback is called with each event instead of sending the event on
+	// the Events channel. Callback is called from a single goroutine; events
+	// for the buffer are not processed until Callback returns.
+	Callback func(BufferEvent)
+
+	// EventBuffer is the capacity of the Events channel.
+	EventBuffer int
+
+	// AttachOpts are the options passed to nvim_buf_attach. The options of
+	// the first watch of a buffer are used until all watches of the buffer
+	// are closed.
+	AttachOpts map[string]any
+}
+
+// BufferWatch delivers the events of an attached buffer. Create a BufferWatch
+// with WatchBuffer.
+type BufferWatch struct {
+	v      *Nvim
+	bw     *bufferWatches
+	buffer Buffer
+	opts   BufferWatchOptions
+	events chan BufferEvent
+
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+
+	// mu serializes the delivery of events.
+	mu      sync.Mutex
+	ready   bool
+	gen     int
+	pending []pendingEvent
+
+	// tick is the changedtick of the last contents read by sync.
+	tick int64
+}
+
+// pendingEvent is an event received while the contents of the buffer are
+// read.
+type pendingEvent struct {
+	ev      BufferEvent
+	tick    int64
+	hasTick bool
+}
+
+// WatchBuffer attaches to buffer and returns a watch that delivers the events
+// of the buffer. Buffer 0 is the current buffer. Multiple watches of the same
+// buffer share one attachment; the buffer is detached when the last watch is
+// closed. The watch is closed when ctx is done.
+//
+// WatchBuffer registers handlers for EventBufLines, EventBufChangedtick and
+// EventBufDetach. Do not register other handlers for these events on v.
+//
+// The watch ends with a *BufDetachEvent when Nvim detaches the buffer and
+// Reattach is not set. On a client created with DialReconnect or
+// ChildProcessRestart, the watch also ends when the connection to Nvim is
+// lost. After the watch ends, Err reports the reason.
+func (v *Nvim) WatchBuffer(ctx context.Context, buffer Buffer, opts *BufferWatchOptions) (*BufferWatch, error) {
+	bw, err := v.bufferWatches()
+	if err != nil {
+		return nil, err
+	}
+
+	cv := v.WithContext(ctx)
+	if buffer == 0 {
+		buffer, err = cv.CurrentBuffer()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	w := &BufferWatch{
+		v:      v.root(),
+		bw:     bw,
+		buffer: buffer,
+		done:   make(chan struct{}),
+	}
+	if opts != nil {
+		w.opts = *opts
+	}
+	if w.opts.Callback == nil {
+		w.events = make(chan BufferEvent, w.opts.EventBuffer)
+	}
+	w.ready = !w.opts.SendBuffer
+
+	if err := bw.attach(cv, buffer, w.opts.AttachOpts, w); err != nil {
+		return nil, err
+	}
+	if w.opts.SendBuffer {
+		if err := w.sync(cv); err != nil {
+			w.finish(err, true)
+			return nil, err
+		}
+	}
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				w.finish(ctx.Err(), true)
+			case <-w.done:
+			}
+		}()
+	}
+	return w, nil
+}
+
+// Buffer returns the watched buffer.
+func (w *BufferWatch) Buffer() Buffer {
+	return w.buffer
+}
+
+// Events returns the channel of events. The channel is closed when the watch
+// ends. Events returns nil if the Callback option is set.
+func (w *BufferWatch) Events() <-chan BufferEvent {
+	return w.events
+}
+
+// Done returns a channel that is closed when the watch ends.
+func (w *BufferWatch) Done() <-chan struct{} {
+	return w.done
+}
+
+// Err returns nil if Done is not yet closed. After Done is closed, Err returns
+// nil if the watch was closed with Close, the context error if the context
+// passed to WatchBuffer is done, the reason Nvim detached the buffer, or an
+// error that wraps ErrConnectionLost if the connection to Nvim was lost.
+func (w *BufferWatch) Err() error {
+	select {
+	case <-w.done:
+		return w.err
+	default:
+		return nil
+	}
+}
+
+// Close ends the watch and detaches the buffer if there are no other watches
+// of the buffer.
+func (w *BufferWatch) Close() error {
+	return w.finish(nil, true)
+}
+
+// finish ends the watch with err. If detach is true and w is the last watch
+// of the buffer, finish detaches the buffer.
+func (w *BufferWatch) finish(err error, detach bool) error {
+	first := false
+	w.closeOnce.Do(func() {
+		first = true
+		w.err = err
+		close(w.done)
+	})
+	if !first {
+		return nil
+	}
+
+	if w.events != nil {
+		// send returns after done is closed, so the channel can be closed
+		// once the delivery in progress, if any, is finished.
+		w.mu.Lock()
+		close(w.events)
+		w.mu.Unlock()
+	}
+
+	if last := w.bw.remove(w, detach); last && detach {
+		return w.bw.detach(w.v, w.buffer)
+	}
+	return nil
+}
+
+// sync reads the contents of the buffer and queues them as the next event of
+// the watch. Events for changes made before the contents were read are
+// dropped.
+func (w *BufferWatch) sync(v *Nvim) error {
+	w.mu.Lock()
+	w.ready = false
+	w.gen++
+	gen := w.gen
+	w.mu.Unlock()
+
+	var (
+		lines [][]byte
+		tick  int
+	)
+	b := v.NewBatch()
+	b.BufferLines(w.buffer, 0, -1, true, &lines)
+	b.BufferChangedTick(w.buffer, &tick)
+	if err := b.Execute(); err != nil {
+		return err
+	}
+
+	data := make([]string, len(lines))
+	for i, line := range lines {
+		data[i] = string(line)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if gen != w.gen {
+		// A later sync delivers the contents.
+		return nil
+	}
+	w.tick = int64(tick)
+	pending := []pendingEvent{{ev: &BufLinesEvent{
+		Buffer:     w.buffer,
+		Changetick: int64(tick),
+		FirstLine:  0,
+		LastLine:   -1,
+		LineData:   data,
+	}}}
+	for _, p := range w.pending {
+		if !p.hasTick || p.tick > w.tick {
+			pending = append(pending, p)
+		}
+	}
+	w.pending = pending
+
+	// The events are delivered in a goroutine because the caller of
+	// WatchBuffer cannot receive them yet.
+	go w.flush(gen)
+	return nil
+}
+
+// resync reads the contents of the buffer again in a new goroutine. The
+// contents are delivered like the contents sent for the SendBuffer option.
+// The watch ends if the contents cannot be read.
+func (w *BufferWatch) resync() {
+	go func() {
+		if err := w.sync(w.v); err != nil {
+			w.finish(err, true)
+		}
+	}()
+}
+
+// flush delivers the queued events.
+func (w *BufferWatch) flush(gen int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if gen != w.gen {
+		return
+	}
+	for _, p := range w.pending {
+		w.send(p.ev)
+	}
+	w.pending = nil
+	w.ready = true
+}
+
+// deliver delivers ev, or queues ev if the contents of the buffer are being
+// read. Events older than the contents are dropped.
+func (w *BufferWatch) deliver(ev BufferEvent, tick int64, hasTick bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if hasTick && tick <= w.tick {
+		return
+	}
+	if !w.ready {
+		w.pending = append(w.pending, pendingEvent{ev: ev, tick: tick, hasTick: hasTick})
+		return
+	}
+	w.send(ev)
+}
+
+// send sends ev to the callback or the events channel. The caller must hold
+// w.mu.
+func (w *BufferWatch) send(ev BufferEvent) {
+	select {
+	case <-w.done:
+		return
+	default:
+	}
+	if w.opts.Callback != nil {
+		w.opts.Callback(ev)
+		return
+	}
+	select {
+	case w.events <- ev:
+	case <-w.done:
+	}
+}
+
+// bufferWatches tracks the watches of the buffers of a client.
+type bufferWatches struct {
+	v *Nvim
+
+	mu      sync.Mutex
+	watches map[Buffer][]*BufferWatch
+
+	// detaching counts the detach events caused by DetachBuffer calls that
+	// are not yet received.
+	detaching map[Buffer]int
+}
+
+// bufferWatches returns the buffer watches of the client and registers the
+// buffer event handlers on first use.
+func (v *Nvim) bufferWatches() (*bufferWatches, error) {
+	v = v.root()
+	v.bufWatchesOnce.Do(func() {
+		bw := &bufferWatches{
+			v:         v,
+			watches:   make(map[Buffer][]*BufferWatch),
+			detaching: make(map[Buffer]int),
+		}
+		for method, fn := range map[string]any{
+			EventBufLines:       bw.handleLines,
+			EventBufChangedtick: bw.handleChangedtick,
+			EventBufDetach:      bw.handleDetach,
+		} {
+			if err := v.RegisterHandlerWithLane(method, bufferLane, fn); err != nil {
+				v.bufWatchesErr = err
+				return
+			}
+		}
+		v.bufWatches = bw
+		if v.rc != nil {
+			v.rc.setBufferWatches(bw)
+		}
+	})
+	return v.bufWatches, v.bufWatchesErr
+}
+
+// bufferLane is a rpc.LaneFunc that processes the events of each buffer in
+// order in a separate lane.
+func bufferLane(method string, args []any) string {
+	if len(args) == 0 {
+		return method
+	}
+	return fmt.Sprintf("nvim_buf_event\x00%v", args[0])
+}
+
+// attach adds ws to the watches of buffer and attaches the buffer if it has
+// no other watches.
+func (bw *bufferWatches) attach(v *Nvim, buffer Buffer, opts map[string]any, ws ...*BufferWatch) error {
+	bw.mu.Lock()
+	first := len(bw.watches[buffer]) == 0
+	bw.watches[buffer] = append(bw.watches[buffer], ws...)
+	bw.mu.Unlock()
+
+	if !first {
+		return nil
+	}
+	ok, err := v.AttachBuffer(buffer, false, opts)
+	if err == nil && !ok {
+		err = fmt.Errorf("nvim: could not attach %v", buffer)
+	}
+	if err != nil {
+		for _, w := range ws {
+			bw.remove(w, false)
+		}
+		return err
+	}
+	return nil
+}
+
+// remove removes w from the watches of its buffer and reports whether w was
+// the last watch. If detach is true and w was the last watch, the caller must
+// detach the buffer.
+func (bw *bufferWatches) remove(w *BufferWatch, detach bool) bool {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	ws := bw.watches[w.buffer]
+	found := false
+	for i := range ws {
+		if ws[i] == w {
+			ws = append(ws[:i:i], ws[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	if len(ws) > 0 {
+		bw.watches[w.buffer] = ws
+		return false
+	}
+	delete(bw.watches, w.buffer)
+	if detach {
+		bw.detaching[w.buffer]++
+	}
+	return true
+}
+
+// detach detaches buffer after its last watch is removed.
+func (bw *bufferWatches) detach(v *Nvim, buffer Buffer) error {
+	ok, err := v.DetachBuffer(buffer)
+	if err != nil || !ok {
+		// No detach event is sent.
+		bw.mu.Lock()
+		if bw.detaching[buffer]--; bw.detaching[buffer] <= 0 {
+			delete(bw.detaching, buffer)
+		}
+		bw.mu.Unlock()
+	}
+	return err
+}
+
+// watchers returns the watches of buffer.
+func (bw *bufferWatches) watchers(buffer Buffer) []*BufferWatch {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	return append([]*BufferWatch(nil), bw.watches[buffer]...)
+}
+
+func (bw *bufferWatches) handleLines(buffer Buffer, tick *int64, first, last int64, lines []string, more bool) {
+	ev := &BufLinesEvent{
+		Buffer:      buffer,
+		FirstLine:   first,
+		LastLine:    last,
+		LineData:    lines,
+		IsMultipart: more,
+	}
+	if tick != nil {
+		ev.Changetick = *tick
+	}
+	for _, w := range bw.watchers(buffer) {
+		w.deliver(ev, ev.Changetick, tick != nil)
+	}
+}
+
+func (bw *bufferWatches) handleChangedtick(buffer Buffer, tick int64) {
+	ev := &ChangedtickEvent{Buffer: buffer, Changetick: tick}
+	for _, w := range bw.watchers(buffer) {
+		w.deliver(ev, tick, true)
+	}
+}
+
+func (bw *bufferWatches) handleDetach(buffer Buffer) {
+	bw.mu.Lock()
+	if n := bw.detaching[buffer]; n > 0 {
+		// The event is caused by the DetachBuffer call of the last watch.
+		if n == 1 {
+			delete(bw.detaching, buffer)
+		} else {
+			bw.detaching[buffer] = n - 1
+		}
+		bw.mu.Unlock()
+		return
+	}
+	ws := bw.watches[buffer]
+	delete(bw.watches, buffer)
+	bw.mu.Unlock()
+
+	var reattach []*BufferWatch
+	for _, w := range ws {
+		if w.opts.Reattach {
+			reattach = append(reattach, w)
+		} else {
+			w.end(ErrBufferDetached, false)
+		}
+	}
+	if len(reattach) == 0 {
+		return
+	}
+
+	if err := bw.attach(bw.v, buffer, reattach[0].opts.AttachOpts, reattach...); err != nil {
+		for _, w := range reattach {
+			w.end(fmt.Errorf("%w: %v", ErrBufferDetached, err), false)
+		}
+		return
+	}
+	for _, w := range reattach {
+		if err := w.sync(bw.v); err != nil {
+			w.end(fmt.Errorf("%w: %v", ErrBufferDetached, err), true)
+		}
+	}
+}
+
+// connectionLost ends all watches with err. The attachments of the watches
+// are lost with the connection to Nvim.
+func (bw *bufferWatches) connectionLost(err error) {
+	bw.mu.Lock()
+	watches := bw.watches
+	bw.watches = make(map[Buffer][]*BufferWatch)
+	bw.detaching = make(map[Buffer]int)
+	bw.mu.Unlock()
+
+	for _, ws := range watches {
+		for _, w := range ws {
+			// end blocks until the *BufDetachEvent is received from the
+			// Events channel.
+			go w.end(err, false)
+		}
+	}
+}
+
+// end delivers a *BufDetachEvent and ends the watch with err. If detach is
+// true and w is the last watch of the buffer, the buffer is detached.
+func (w *BufferWatch) end(err error, detach bool) {
+	w.mu.Lock()
+	w.ready = true
+	w.gen++
+	w.pending = nil
+	w.send(&BufDetachEvent{Buffer: w.buffer})
+	w.mu.Unlock()
+	w.finish(err, detach)
+}
@@ -0,0 +1,226 @@
+package nvim_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/neovim/go-client/nvim"
+	"github.com/neovim/go-client/nvim/nvimtest/fake"
+)
+
+func bytesLines(lines ...string) [][]byte {
+	p := make([][]byte, len(lines))
+	for i, line := range lines {
+		p[i] = []byte(line)
+	}
+	return p
+}
+
+func nextEvent(tb testing.TB, w *nvim.BufferWatch) nvim.BufferEvent {
+	tb.Helper()
+
+	select {
+	case ev, ok := <-w.Events():
+		if !ok {
+			tb.Fatalf("watch ended: %v", w.Err())
+		}
+		return ev
+	case <-time.After(10 * time.Second):
+		tb.Fatal("timeout waiting for event")
+		return nil
+	}
+}
+
+func waitWatchDone(tb testing.TB, w *nvim.BufferWatch) {
+	tb.Helper()
+
+	select {
+	case <-w.Done():
+	case <-time.After(10 * time.Second):
+		tb.Fatal("timeout waiting for the watch to end")
+	}
+	if _, ok := <-w.Events(); ok {
+		tb.Fatal("event received after the watch ended")
+	}
+}
+
+func linesEvent(b nvim.Buffer, tick, first, last int64, lines ...string) *nvim.BufLinesEvent {
+	if lines == nil {
+		lines = []string{}
+	}
+	return &nvim.BufLinesEvent{Buffer: b, Changetick: tick, FirstLine: first, LastLine: last, LineData: lines}
+}
+
+func TestWatchBuffer(t *testing.T) {
+	t.Parallel()
+
+	v, _ := fake.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := v.SetBufferLines(1, 0, -1, true, bytesLines("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	w1, err := v.WatchBuffer(ctx, 0, &nvim.BufferWatchOptions{SendBuffer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := w1.Buffer(); got != 1 {
+		t.Fatalf("Buffer() = %v, want 1", got)
+	}
+	if got, want := nextEvent(t, w1), linesEvent(1, 3, 0, -1, "a", "b"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got event %#v, want %#v", got, want)
+	}
+
+	w2, err := v.WatchBuffer(ctx, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.SetBufferLines(1, 1, 2, true, bytesLines("x", "y")); err != nil {
+		t.Fatal(err)
+	}
+	want := linesEvent(1, 4, 1, 2, "x", "y")
+	for _, w := range []*nvim.BufferWatch{w1, w2} {
+		if got := nextEvent(t, w); !reflect.DeepEqual(got, want) {
+			t.Fatalf("got event %#v, want %#v", got, want)
+		}
+	}
+
+	// Closing one watch does not detach the buffer.
+	if err := w1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitWatchDone(t, w1)
+	if err := w1.Err(); err != nil {
+		t.Fatalf("Err() after Close = %v, want nil", err)
+	}
+	if err := v.SetBufferLines(1, 0, 1, true, bytesLines("z")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := nextEvent(t, w2), linesEvent(1, 5, 0, 1, "z"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got event %#v, want %#v", got, want)
+	}
+
+	cancel()
+	waitWatchDone(t, w2)
+	if err := w2.Err(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Err() after cancel = %v, want %v", err, context.Canceled)
+	}
+
+	// The buffer is detached after the last watch ends. A new watch attaches
+	// again and receives no events from the old attachment.
+	w3, err := v.WatchBuffer(context.Background(), 1, &nvim.BufferWatchOptions{SendBuffer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w3.Close()
+	if got, want := nextEvent(t, w3), linesEvent(1, 5, 0, -1, "z", "x", "y"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got event %#v, want %#v", got, want)
+	}
+}
+
+func TestWatchBufferDetach(t *testing.T) {
+	t.Parallel()
+
+	v, s := fake.New(t)
+
+	b, err := v.CreateBuffer(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.SetBufferLines(b, 0, -1, true, bytesLines("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := v.WatchBuffer(context.Background(), b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reattach, err := v.WatchBuffer(context.Background(), b, &nvim.BufferWatchOptions{Reattach: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nvim detaches the buffer, for example on :edit.
+	if err := s.Endpoint().Notify(nvim.EventBufDetach, b); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := nextEvent(t, w), (&nvim.BufDetachEvent{Buffer: b}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got event %#v, want %#v", got, want)
+	}
+	waitWatchDone(t, w)
+	if err := w.Err(); !errors.Is(err, nvim.ErrBufferDetached) {
+		t.Fatalf("Err() = %v, want %v", err, nvim.ErrBufferDetached)
+	}
+
+	if got, want := nextEvent(t, reattach), linesEvent(b, 3, 0, -1, "a"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got event after reattach %#v, want %#v", got, want)
+	}
+
+	// Reattaching a deleted buffer fails.
+	if err := v.DeleteBuffer(b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := nextEvent(t, reattach), (&nvim.BufDetachEvent{Buffer: b}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got event %#v, want %#v", got, want)
+	}
+	waitWatchDone(t, reattach)
+	if err := reattach.Err(); !errors.Is(err, nvim.ErrBufferDetached) {
+		t.Fatalf("Err() = %v, want %v", err, nvim.ErrBufferDetached)
+	}
+
+	if _, err := v.WatchBuffer(context.Background(), b, nil); err == nil {
+		t.Fatal("WatchBuffer of deleted buffer returned nil error")
+	}
+}
+
+func TestWatchBufferCallback(t *testing.T) {
+	t.Parallel()
+
+	v, _ := fake.New(t)
+
+	events := make(chan nvim.BufferEvent, 4)
+	w, err := v.WatchBuffer(context.Background(), 1, &nvim.BufferWatchOptions{
+		Callback: func(ev nvim.BufferEvent) { events <- ev },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Events() != nil {
+		t.Fatal("Events() is not nil with Callback")
+	}
+
+	if err := v.SetBufferLines(1, 0, -1, true, bytesLines("a")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-events:
+		if want := linesEvent(1, 3, 0, 1, "a"); !reflect.DeepEqual(got, want) {
+			t.Fatalf("got event %#v, want %#v", got, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.SetBufferLines(1, 0, -1, true, bytesLines("b")); err != nil {
+		t.Fatal(err)
+	}
+	// The lines are read after the update, so the update event, if any, was
+	// processed.
+	if _, err := v.BufferLines(1, 0, -1, true); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("got event %#v after Close", ev)
+	default:
+	}
+}
@@ -0,0 +1,128 @@
+package nvim
+
+import (
+	"log"
+	"net"
+)
+
+// ListenOption specifies an option for listening for connections from Nvim.
+type ListenOption struct {
+	f func(*listenOptions)
+}
+
+type listenOptions struct {
+	logf     func(string, ...any)
+	onAccept func(v *Nvim) error
+	serve    bool
+}
+
+// ListenLogf specifies function for logging output. The log.Printf function
+// is used by default.
+func ListenLogf(logf func(string, ...any)) ListenOption {
+	return ListenOption{func(los *listenOptions) {
+		los.logf = logf
+	}}
+}
+
+// ListenOnAccept specifies a function called with each accepted session
+// before Serve is started. Handlers registered by the function are in place
+// before Nvim sends the first message on the channel. The session is not
+// served while the function runs; the function must not call the Nvim API. If
+// the function returns an error, the connection is closed and the error is
+// logged.
+//
+// The function is called from Accept, and no other connection is accepted
+// while it runs. The function must not block.
+func ListenOnAccept(f func(v *Nvim) error) ListenOption {
+	return ListenOption{func(los *listenOptions) {
+		los.onAccept = f
+	}}
+}
+
+// ListenServe specifies whether Serve should be run in a goroutine for each
+// accepted session. The default is to run Serve().
+func ListenServe(serve bool) ListenOption {
+	return ListenOption{func(los *listenOptions) {
+		los.serve = serve
+	}}
+}
+
+// Listener accepts connections from Nvim instances. Nvim connects to the
+// listener with sockconnect():
+//
+//	let chan = sockconnect('tcp', 'localhost:6666', {'rpc': v:true})
+//	call rpcrequest(chan, 'hello', 'world')
+//
+// Each connection is a session with its own handlers.
+//
+//	:help sockconnect()
+type Listener struct {
+	ln  net.Listener
+	los listenOptions
+}
+
+// Listen announces on the local network address and returns a Listener. The
+// network must be "tcp", "tcp4", "tcp6" or "unix".
+func Listen(network, address string, options ...ListenOption) (*Listener, error) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(ln, options...), nil
+}
+
+// NewListener returns a Listener that accepts connections from Nvim on ln.
+func NewListener(ln net.Listener, options ...ListenOption) *Listener {
+	l := &Listener{
+		ln: ln,
+		los: listenOptions{
+			logf:  log.Printf,
+			serve: true,
+		},
+	}
+	for _, lo := range options {
+		lo.f(&l.los)
+	}
+	return l
+}
+
+// Accept waits for and returns the next session. The session is served in a
+// goroutine unless the ListenServe(false) option is set. Close the session to
+// close the connection.
+func (l *Listener) Accept() (*Nvim, error) {
+	for {
+		c, err := l.ln.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := New(c, c, c, l.los.logf)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		if l.los.onAccept != nil {
+			if err := l.los.onAccept(v); err != nil {
+				l.los.logf("nvim: session from %v rejected: %v", c.RemoteAddr(), err)
+				v.Close()
+				continue
+			}
+		}
+
+		if l.los.serve {
+			v.startServe()
+		}
+		return v, nil
+	}
+}
+
+// Close closes the listener. Sessions returned by Accept are not closed.
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+// Addr returns the listener's network address.
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
@@ -0,0 +1,114 @@
+package nvim
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/neovim/go-client/msgpack/rpc"
+)
+
+// connectFakeNvim connects to addr like sockconnect() in an Nvim instance
+// that assigned channelID to the connection.
+func connectFakeNvim(tb testing.TB, addr string, channelID int) *rpc.Endpoint {
+	tb.Helper()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ep, err := rpc.NewEndpoint(c, c, c, rpc.WithLogf(tb.Logf))
+	if err != nil {
+		c.Close()
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ep.Close() })
+
+	if err := ep.Register("nvim_get_api_info", func() ([]any, error) {
+		return []any{channelID, map[string]any{}}, nil
+	}); err != nil {
+		tb.Fatal(err)
+	}
+	go ep.Serve()
+	return ep
+}
+
+func TestListener(t *testing.T) {
+	t.Parallel()
+
+	var accepted int32
+	l, err := Listen("tcp", "127.0.0.1:0",
+		ListenLogf(t.Logf),
+		ListenOnAccept(func(v *Nvim) error {
+			if atomic.AddInt32(&accepted, 1) == 1 {
+				return errors.New("first session rejected")
+			}
+			return v.RegisterHandler("hello", func(v *Nvim, name string) (string, error) {
+				return fmt.Sprintf("%s on channel %d", name, v.ChannelID()), nil
+			})
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	sessions := make(chan *Nvim)
+	go func() {
+		defer close(sessions)
+		for {
+			v, err := l.Accept()
+			if err != nil {
+				return
+			}
+			sessions <- v
+		}
+	}()
+
+	// The first session is closed and not returned by Accept.
+	rejected := connectFakeNvim(t, l.Addr().String(), 3)
+
+	nvim1 := connectFakeNvim(t, l.Addr().String(), 1)
+	v1 := <-sessions
+	defer v1.Close()
+
+	nvim2 := connectFakeNvim(t, l.Addr().String(), 2)
+	v2 := <-sessions
+	defer v2.Close()
+
+	var result string
+	if err := nvim1.Call("hello", &result, "world"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "world on channel 1"; result != want {
+		t.Fatalf("got %q, want %q", result, want)
+	}
+	if err := nvim2.Call("hello", &result, "world"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "world on channel 2"; result != want {
+		t.Fatalf("got %q, want %q", result, want)
+	}
+	if err := rejected.Call("hello", &result, "world"); err == nil {
+		t.Fatal("call on rejected session returned nil error")
+	}
+
+	// Handlers are registered per session.
+	if err := v1.RegisterHandler("bye", func() (string, error) { return "bye", nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := nvim1.Call("bye", &result); err != nil {
+		t.Fatal(err)
+	}
+	if err := nvim2.Call("bye", &result); err == nil {
+		t.Fatal("handler registered on session 1 was called on session 2")
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-sessions; ok {
+		t.Fatal("Accept returned a session after Close")
+	}
+}
@@ -8,9 +8,7 @@ import (
 	"io"
 	"log"
 	"net"
-	"os/exec"
 	"reflect"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -23,17 +21,39 @@ import (
 
 var embedProcAttr *syscall.SysProcAttr
 
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 // Nvim represents a remote instance of Nvim. It is safe to call Nvim methods
 // concurrently.
 type Nvim struct {
 	ep *rpc.Endpoint
 
-	// cmd is the child process, if any.
-	cmd         *exec.Cmd
+	// rc is the reconnector of a client created by Dial with the
+	// DialReconnect option.
+	rc *reconnector
+
+	// ctx is the context used for API calls. The background context is used
+	// when ctx is nil.
+	ctx context.Context
+
+	// parent is the Nvim that owns the connection when this Nvim was
+	// returned from WithContext.
+	parent *Nvim
+
+	// epOptions are the options used to create the endpoints of the client.
+	epOptions []rpc.Option
+
+	// child supervises the child process, if any.
+	child       *childProcess
 	serveCh     chan error
 	channelID   int
 	channelIDMu sync.Mutex
 
+	// bufWatches tracks the watches created by WatchBuffer.
+	bufWatchesOnce sync.Once
+	bufWatches     *bufferWatches
+	bufWatchesErr  error
+
 	// readMu prevents concurrent calls to read on the child process stdout pipe and
 	// calls to cmd.Wait().
 	readMu sync.Mutex
@@ -45,9 +65,22 @@ type Nvim struct {
 // By default, the NewChildProcess and Dial functions start a goroutine to run Serve().
 // Callers of the low-level New function are responsible for running Serve().
 func (v *Nvim) Serve() error {
+	v = v.root()
 	v.readMu.Lock()
 	defer v.readMu.Unlock()
-	return v.ep.Serve()
+
+	var err error
+	if v.rc != nil {
+		err = v.rc.serve()
+	} else {
+		err = v.ep.Serve()
+	}
+
+	if v.child != nil {
+		proc := v.child.current()
+		go func() { v.child.finish(proc.wait()) }()
+	}
+	return err
 }
 
 func (v *Nvim) startServe() {
@@ -60,20 +93,27 @@ func (v *Nvim) startServe() {
 
 // Close releases the resources used the client.
 func (v *Nvim) Close() error {
-	if v.cmd != nil && v.cmd.Process != nil {
+	v = v.root()
+	if v.child != nil {
+		v.child.close()
+
 		// The child process should exit cleanly on call to v.ep.Close(). Kill
 		// the process if it does not exit as expected.
-		t := time.AfterFunc(10*time.Second, func() { v.cmd.Process.Kill() })
+		proc := v.child.current()
+		t := time.AfterFunc(10*time.Second, func() { proc.cmd.Process.Kill() })
 		defer t.Stop()
 	}
 
-	err := v.ep.Close()
+	if v.rc != nil {
+		v.rc.close()
+	}
+	err := v.endpoint().Close()
 
-	if v.cmd != nil {
+	if v.child != nil {
 		v.readMu.Lock()
 		defer v.readMu.Unlock()
 
-		_ = v.cmd.Wait()
+		v.child.finish(v.child.current().wait())
 	}
 
 	if v.serveCh != nil {
@@ -91,10 +131,109 @@ func (v *Nvim) Close() error {
 	return err
 }
 
-// ExitCode returns the exit code of the exited nvim process.
+// Shutdown gracefully shuts down the client. Shutdown stops handling new
+// requests and notifications from Nvim, waits for running handlers and
+// queued notifications to complete and then closes the connection. If the
+// client started a child process, Shutdown waits for the process to exit.
+//
+// If ctx is done before the shutdown completes, the connection is closed,
+// the child process is killed and ctx.Err() is returned.
+func (v *Nvim) Shutdown(ctx context.Context) error {
+	v = v.root()
+
+	if v.child != nil {
+		v.child.close()
+
+		proc := v.child.current()
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				proc.cmd.Process.Kill()
+			case <-done:
+			}
+		}()
+	}
+
+	if v.rc != nil {
+		v.rc.close()
+	}
+	err := v.endpoint().Shutdown(ctx)
+
+	if v.child != nil {
+		v.readMu.Lock()
+		defer v.readMu.Unlock()
+
+		v.child.finish(v.child.current().wait())
+	}
+
+	if v.serveCh != nil {
+		var errServe error
+		select {
+		case errServe = <-v.serveCh:
+		case <-ctx.Done():
+			errServe = ctx.Err()
+		}
+		if err == nil && errServe != nil {
+			err = errServe
+		}
+	}
+
+	return err
+}
+
+// ExitCode waits for the nvim process to exit and returns its exit code, or -1
+// if the process was terminated by a signal. With ChildProcessRestart,
+// ExitCode waits until the process is no longer restarted and returns the
+// exit code of the last process. ExitCode returns -1 immediately for clients
+// not created by NewChildProcess.
+//
+// To check the status without blocking, use Done and Err.
 func (v *Nvim) ExitCode() int {
-	v.cmd.Wait()
-	return v.cmd.ProcessState.ExitCode()
+	v = v.root()
+	if v.child == nil {
+		return -1
+	}
+	<-v.child.done
+	return v.child.current().exitCode()
+}
+
+// callContext returns the context used for API calls made with v.
+func (v *Nvim) callContext() context.Context {
+	if v.ctx != nil {
+		return v.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of v whose API calls use ctx. When ctx
+// is done, calls in progress return ctx.Err() without waiting for Nvim to
+// reply. The returned Nvim shares the connection with v.
+//
+//	err := v.WithContext(ctx).SetBufferLines(b, 0, -1, true, lines)
+func (v *Nvim) WithContext(ctx context.Context) *Nvim {
+	if ctx == nil {
+		panic("nil context")
+	}
+	return &Nvim{ep: v.ep, ctx: ctx, parent: v.root()}
+}
+
+// endpoint returns the endpoint of the current connection to Nvim.
+func (v *Nvim) endpoint() *rpc.Endpoint {
+	v = v.root()
+	if v.rc != nil {
+		return v.rc.endpoint()
+	}
+	return v.ep
+}
+
+// root returns the Nvim that owns the connection.
+func (v *Nvim) root() *Nvim {
+	if v.parent != nil {
+		return v.parent
+	}
+	return v
 }
 
 // New creates an Nvim client. When connecting to Nvim over stdio, use stdin as
@@ -105,11 +244,63 @@ func (v *Nvim) ExitCode() int {
 //
 //	:help rpc-connecting
 func New(r io.Reader, w io.Writer, c io.Closer, logf func(string, ...any)) (*Nvim, error) {
-	ep, err := rpc.NewEndpoint(r, w, c, rpc.WithLogf(logf), withExtensions())
+	return newNvim(r, w, c, endpointOptions(logf, false))
+}
+
+func newNvim(r io.Reader, w io.Writer, c io.Closer, options []rpc.Option) (*Nvim, error) {
+	ep, err := rpc.NewEndpoint(r, w, c, options...)
 	if err != nil {
 		return nil, err
 	}
-	return &Nvim{ep: ep}, nil
+	return &Nvim{ep: ep, epOptions: options}, nil
+}
+
+// endpointOptions returns the options of the endpoints of a client.
+func endpointOptions(logf func(string, ...any), callStats bool) []rpc.Option {
+	options := []rpc.Option{rpc.WithLogf(logf), withExtensions()}
+	if callStats {
+		options = append(options, rpc.WithCallStats())
+	}
+	return options
+}
+
+// NewPipe returns an Nvim client connected to peer by an in-memory transport.
+// The Serve loops of v and peer are running. Register handlers for the Nvim
+// API methods on peer to test code that uses v without an Nvim process:
+//
+//	v, peer, err := nvim.NewPipe(t.Logf)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer v.Close()
+//	peer.Register("nvim_get_current_line", func() ([]byte, error) {
+//		return []byte("hello"), nil
+//	})
+//	line, err := v.CurrentLine()
+//
+// The options are applied to peer. Closing v closes peer. If logf is nil,
+// log.Printf is used.
+func NewPipe(logf func(string, ...any), options ...rpc.Option) (v *Nvim, peer *rpc.Endpoint, err error) {
+	vConn, peerConn := net.Pipe()
+
+	v, err = New(vConn, vConn, vConn, logf)
+	if err != nil {
+		vConn.Close()
+		peerConn.Close()
+		return nil, nil, err
+	}
+
+	options = append([]rpc.Option{rpc.WithLogf(logf), withExtensions()}, options...)
+	peer, err = rpc.NewEndpoint(peerConn, peerConn, peerConn, options...)
+	if err != nil {
+		vConn.Close()
+		peerConn.Close()
+		return nil, nil, err
+	}
+
+	go peer.Serve()
+	v.startServe()
+	return v, peer, nil
 }
 
 // ChildProcessOption specifies an option for creating a child process.
@@ -118,14 +309,23 @@ type ChildProcessOption struct {
 }
 
 type childProcessOptions struct {
-	ctx          context.Context
-	logf         func(string, ...any)
-	command      string
-	dir          string
-	args         []string
-	env          []string
-	serve        bool
-	disableEmbed bool
+	ctx           context.Context
+	logf          func(string, ...any)
+	command       string
+	dir           string
+	args          []string
+	env           []string
+	serve         bool
+	disableEmbed  bool
+	stderr        io.Writer
+	restart       bool
+	maxRestarts   int
+	minDelay      time.Duration
+	maxDelay      time.Duration
+	connState     func(ConnState, error)
+	probeInterval time.Duration
+	probeTimeout  time.Duration
+	callStats     bool
 }
 
 // ChildProcessArgs specifies the command line arguments. The application must
@@ -193,6 +393,13 @@ func ChildProcessDisableEmbed() ChildProcessOption {
 	}}
 }
 
+// ChildProcessCallStats enables the per-method metrics reported by CallStats.
+func ChildProcessCallStats() ChildProcessOption {
+	return ChildProcessOption{func(cpos *childProcessOptions) {
+		cpos.callStats = true
+	}}
+}
+
 // appendEmbedFlagIfNeeded appends the --embed flag, if it is not yet added.
 // This behavior can be overriden by setting the ChildProcessDisableEmbed() process option.
 func appendEmbedFlagIfNeeded(cpos *childProcessOptions) {
@@ -223,34 +430,32 @@ func NewChildProcess(options ...ChildProcessOption) (*Nvim, error) {
 
 	appendEmbedFlagIfNeeded(cpos)
 
-	cmd := exec.CommandContext(cpos.ctx, cpos.command, cpos.args...)
-	cmd.Env = cpos.env
-	cmd.Dir = cpos.dir
-	cmd.SysProcAttr = embedProcAttr
-
-	inw, err := cmd.StdinPipe()
+	child := &childProcess{cpos: cpos, done: make(chan struct{})}
+	c, err := child.start()
 	if err != nil {
 		return nil, err
 	}
 
-	outr, err := cmd.StdoutPipe()
-	if err != nil {
-		inw.Close()
-		return nil, err
-	}
+	v, _ := newNvim(c, c, c, endpointOptions(cpos.logf, cpos.callStats))
+	v.child = child
 
-	err = cmd.Start()
-	if err != nil {
-		return nil, err
+	if cpos.restart {
+		v.rc = newReconnector(v, cpos.ctx, cpos.logf, cpos.connState, cpos.minDelay, cpos.maxDelay,
+			func(context.Context) (io.ReadWriteCloser, error) {
+				return child.start()
+			})
+		v.rc.lost = child.lost(v.rc)
+		v.rc.dialFailed = child.startFailed
 	}
 
-	v, _ := New(outr, inw, inw, cpos.logf)
-	v.cmd = cmd
-
 	if cpos.serve {
 		v.startServe()
 	}
 
+	if cpos.probeInterval > 0 {
+		go child.probe(v)
+	}
+
 	return v, nil
 }
 
@@ -260,10 +465,15 @@ type DialOption struct {
 }
 
 type dialOptions struct {
-	ctx     context.Context
-	logf    func(string, ...any)
-	netDial func(ctx context.Context, network, address string) (net.Conn, error)
-	serve   bool
+	ctx       context.Context
+	logf      func(string, ...any)
+	netDial   func(ctx context.Context, network, address string) (net.Conn, error)
+	serve     bool
+	reconnect bool
+	minDelay  time.Duration
+	maxDelay  time.Duration
+	connState func(ConnState, error)
+	callStats bool
 }
 
 // DialContext specifies the context to use when starting the command.
@@ -297,8 +507,15 @@ func DialLogf(logf func(string, ...any)) DialOption {
 	}}
 }
 
+// DialCallStats enables the per-method metrics reported by CallStats.
+func DialCallStats() DialOption {
+	return DialOption{func(dos *dialOptions) {
+		dos.callStats = true
+	}}
+}
+
 // Dial dials an Nvim instance given an address in the format used by
-// $NVIM_LISTEN_ADDRESS.
+// $NVIM_LISTEN_ADDRESS. See ParseAddress for the supported address forms.
 //
 //	:help rpc-connecting
 //	:help $NVIM_LISTEN_ADDRESS
@@ -315,9 +532,9 @@ func Dial(address string, options ...DialOption) (*Nvim, error) {
 		do.f(dos)
 	}
 
-	network := "unix"
-	if strings.Contains(address, ":") {
-		network = "tcp"
+	network, address, err := ParseAddress(address)
+	if err != nil {
+		return nil, err
 	}
 
 	c, err := dos.netDial(dos.ctx, network, address)
@@ -325,12 +542,19 @@ func Dial(address string, options ...DialOption) (*Nvim, error) {
 		return nil, err
 	}
 
-	v, err := New(c, c, c, dos.logf)
+	v, err := newNvim(c, c, c, endpointOptions(dos.logf, dos.callStats))
 	if err != nil {
 		c.Close()
 		return nil, err
 	}
 
+	if dos.reconnect {
+		v.rc = newReconnector(v, dos.ctx, dos.logf, dos.connState, dos.minDelay, dos.maxDelay,
+			func(ctx context.Context) (io.ReadWriteCloser, error) {
+				return dos.netDial(ctx, network, address)
+			})
+	}
+
 	if dos.serve {
 		v.startServe()
 	}
@@ -340,27 +564,69 @@ func Dial(address string, options ...DialOption) (*Nvim, error) {
 // RegisterHandler registers fn as a MessagePack RPC handler for the named
 // method. The function signature for fn is one of
 //
-//	func([v *nvim.Nvim,] {args}) ({resultType}, error)
-//	func([v *nvim.Nvim,] {args}) error
-//	func([v *nvim.Nvim,] {args})
+//	func([ctx context.Context,] [v *nvim.Nvim,] {args}) ({resultType}, error)
+//	func([ctx context.Context,] [v *nvim.Nvim,] {args}) error
+//	func([ctx context.Context,] [v *nvim.Nvim,] {args})
 //
 // where {args} is zero or more arguments and {resultType} is the type of a
-// return value. Call the handler from Nvim using the rpcnotify and rpcrequest
+// return value. The optional ctx is canceled when the connection to Nvim is
+// closed. Call the handler from Nvim using the rpcnotify and rpcrequest
 // functions:
 //
 //	:help rpcrequest()
 //	:help rpcnotify()
 func (v *Nvim) RegisterHandler(method string, fn any) error {
+	v = v.root()
+	if v.rc != nil {
+		return v.rc.register(registeredHandler{method: method, fn: fn, args: v.handlerArgs(fn)})
+	}
+	return v.ep.Register(method, fn, v.handlerArgs(fn)...)
+}
+
+// RegisterHandlerWithLane registers fn as a MessagePack RPC handler for the
+// named method like RegisterHandler. Notifications for the method are
+// processed in order within the lane returned by lane, and concurrently with
+// notifications in other lanes. For example, use rpc.FirstArgLane to process
+// buffer events for different buffers concurrently:
+//
+//	v.RegisterHandlerWithLane(nvim.EventBufLines, rpc.FirstArgLane, fn)
+func (v *Nvim) RegisterHandlerWithLane(method string, lane rpc.LaneFunc, fn any) error {
+	v = v.root()
+	if v.rc != nil {
+		return v.rc.register(registeredHandler{method: method, lane: lane, fn: fn, args: v.handlerArgs(fn)})
+	}
+	return v.ep.RegisterWithLane(method, lane, fn, v.handlerArgs(fn)...)
+}
+
+// UnregisterHandler removes the MessagePack RPC handler for the named method.
+func (v *Nvim) UnregisterHandler(method string) {
+	v = v.root()
+	if v.rc != nil {
+		v.rc.unregister(method)
+		return
+	}
+	v.ep.Unregister(method)
+}
+
+// handlerArgs returns the leading handler arguments for fn.
+func (v *Nvim) handlerArgs(fn any) []any {
 	var args []any
 	t := reflect.TypeOf(fn)
-	if t.Kind() == reflect.Func && t.NumIn() > 0 && t.In(0) == reflect.TypeOf(v) {
-		args = append(args, v)
+	if t.Kind() == reflect.Func {
+		i := 0
+		if t.NumIn() > 0 && t.In(0) == contextType {
+			i = 1
+		}
+		if t.NumIn() > i && t.In(i) == reflect.TypeOf(v) {
+			args = append(args, v)
+		}
 	}
-	return v.ep.Register(method, fn, args...)
+	return args
 }
 
 // ChannelID returns Nvim's channel id for this client.
 func (v *Nvim) ChannelID() int {
+	v = v.root()
 	v.channelIDMu.Lock()
 	defer v.channelIDMu.Unlock()
 	if v.channelID != 0 {
@@ -370,20 +636,37 @@ func (v *Nvim) ChannelID() int {
 		ChannelID int `msgpack:",array"`
 		Info      any `msgpack:"-"`
 	}
-	if err := v.ep.Call("nvim_get_api_info", &info); err != nil {
+	if err := v.endpoint().Call("nvim_get_api_info", &info); err != nil {
 		// TODO: log error and exit process?
 	}
 	v.channelID = info.ChannelID
 	return v.channelID
 }
 
+// CallStats returns a snapshot of the per-method metrics of the calls and
+// notifications exchanged with Nvim. The metrics of a reconnecting client
+// cover the current connection. The snapshot is empty unless the client was
+// created with the ChildProcessCallStats or DialCallStats option.
+func (v *Nvim) CallStats() rpc.CallStats {
+	return v.endpoint().CallStats()
+}
+
+// PublishExpvar publishes the CallStats of the client as the expvar variable
+// name. PublishExpvar panics if name is already registered.
+func (v *Nvim) PublishExpvar(name string) {
+	v.endpoint().PublishExpvar(name)
+}
+
 func (v *Nvim) call(sm string, result any, args ...any) error {
-	return fixError(sm, v.ep.Call(sm, result, args...))
+	if rc := v.root().rc; rc != nil {
+		return rc.call(v.callContext(), sm, result, args)
+	}
+	return fixError(sm, v.ep.CallContext(v.callContext(), sm, result, args...))
 }
 
-// NewBatch creates a new batch.
+// NewBatch creates a new batch. The batch is executed using the context of v.
 func (v *Nvim) NewBatch() *Batch {
-	b := &Batch{ep: v.ep}
+	b := &Batch{ep: v.endpoint(), rc: v.root().rc, ctx: v.callContext()}
 	b.enc = msgpack.NewEncoder(&b.buf)
 	return b
 }
@@ -403,7 +686,9 @@ func (v *Nvim) NewBatch() *Batch {
 // A Batch does not support concurrent calls by the application.
 type Batch struct {
 	err     error
+	ctx     context.Context
 	ep      *rpc.Endpoint
+	rc      *reconnector
 	enc     *msgpack.Encoder
 	sms     []string
 	results []any
@@ -435,9 +720,9 @@ func (b *Batch) Execute() error {
 		nil,
 	}
 
-	err := b.ep.Call("nvim_call_atomic", &result, &batchArg{n: len(b.sms), p: b.buf.Bytes()})
+	err := b.ep.CallContext(b.ctx, "nvim_call_atomic", &result, &batchArg{n: len(b.sms), p: b.buf.Bytes()})
 	if err != nil {
-		return err
+		return b.rc.connectionError(err)
 	}
 
 	e := result.Error
@@ -449,13 +734,13 @@ func (b *Batch) Execute() error {
 		(e.Type != exceptionError && e.Type != validationError) {
 		return fmt.Errorf("nvim:nvim_call_atomic %d %d %s", e.Index, e.Type, e.Message)
 	}
-	errorType := "exception"
-	if e.Type == validationError {
-		errorType = "validation"
-	}
 	return &BatchError{
 		Index: e.Index,
-		Err:   fmt.Errorf("nvim:%s %s: %s", b.sms[e.Index], errorType, e.Message),
+		Err: &APIError{
+			Method:  b.sms[e.Index],
+			Kind:    ErrorKind(e.Type),
+			Message: e.Message,
+		},
 	}
 }
 
@@ -493,7 +778,7 @@ func (a *batchArg) MarshalMsgPack(enc *msgpack.Encoder) error {
 
 // BatchError represents an error from a API function call in a Batch.
 type BatchError struct {
-	// Err is the error.
+	// Err is the error. Err is an *APIError for errors reported by Nvim.
 	Err error
 
 	// Index is a zero-based index of the function call which resulted in the
@@ -506,14 +791,76 @@ func (e *BatchError) Error() string {
 	return e.Err.Error()
 }
 
+// Unwrap returns the underlying error.
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorKind represents a kind of Nvim API error.
+type ErrorKind int
+
+// list of ErrorKind.
+const (
+	ExceptionErrorKind  ErrorKind = exceptionError
+	ValidationErrorKind ErrorKind = validationError
+)
+
+// String returns a string representation of the ErrorKind.
+func (kind ErrorKind) String() string {
+	switch kind {
+	case ExceptionErrorKind:
+		return "exception"
+	case ValidationErrorKind:
+		return "validation"
+	default:
+		return "unknown"
+	}
+}
+
+// APIError represents an error returned from a Nvim API function.
+//
+// Use errors.As to get the APIError from an error returned by a Nvim or Batch
+// method:
+//
+//	var apiErr *nvim.APIError
+//	if errors.As(err, &apiErr) && apiErr.Kind == nvim.ValidationErrorKind {
+//		// handle invalid argument
+//	}
+//
+// Handlers can return an *APIError to reply to Nvim with an error in the
+// same format as Nvim's own API errors.
+type APIError struct {
+	// Method is the name of the API function.
+	Method string
+
+	// Message is the error message from Nvim.
+	Message string
+
+	// Kind is the kind of error.
+	Kind ErrorKind
+}
+
+// compile time check whether the APIError implements msgpack.Marshaler interface.
+var _ msgpack.Marshaler = (*APIError)(nil)
+
+// Error implements the error interface.
+func (e *APIError) Error() string {
+	return fmt.Sprintf("nvim:%s %s: %s", e.Method, e.Kind, e.Message)
+}
+
+// MarshalMsgPack implements msgpack.Marshaler.
+func (e *APIError) MarshalMsgPack(enc *msgpack.Encoder) error {
+	return (&rpc.TypedError{Type: int(e.Kind), Message: e.Message}).MarshalMsgPack(enc)
+}
+
 func fixError(sm string, err error) error {
 	if e, ok := err.(rpc.Error); ok {
 		if a, ok := e.Value.([]any); ok && len(a) == 2 {
 			switch a[0] {
 			case int64(exceptionError), uint64(exceptionError):
-				return fmt.Errorf("nvim:%s exception: %v", sm, a[1])
+				return &APIError{Method: sm, Kind: ExceptionErrorKind, Message: fmt.Sprint(a[1])}
 			case int64(validationError), uint64(validationError):
-				return fmt.Errorf("nvim:%s validation: %v", sm, a[1])
+				return &APIError{Method: sm, Kind: ValidationErrorKind, Message: fmt.Sprint(a[1])}
 			}
 		}
 	}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -11,6 +12,8 @@ import (
 	"runtime"
 	"testing"
 	"time"
+
+	"github.com/neovim/go-client/msgpack/rpc"
 )
 
 // newChildProcess returns the new *Nvim, and registers cleanup to tb.Cleanup.
@@ -238,3 +241,202 @@ func TestStructValue(t *testing.T) {
 		}
 	})
 }
+
+func TestWithContext(t *testing.T) {
+	t.Parallel()
+
+	v := newChildProcess(t)
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if _, err := v.WithContext(ctx).APIInfo(); !errors.Is(err, context.Canceled) {
+			t.Fatalf("got error %v, want %v", err, context.Canceled)
+		}
+	})
+
+	t.Run("DeadlineExceeded", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		if err := v.WithContext(ctx).Command("sleep 1"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		b := v.WithContext(ctx).NewBatch()
+		var n int
+		b.Eval("1+2", &n)
+		if err := b.Execute(); !errors.Is(err, context.Canceled) {
+			t.Fatalf("got error %v, want %v", err, context.Canceled)
+		}
+	})
+
+	var n int
+	if err := v.WithContext(context.Background()).Eval("1+2", &n); err != nil {
+		t.Fatal(err)
+	}
+	if want := 3; n != want {
+		t.Fatalf("got %d, want %d", n, want)
+	}
+}
+
+func TestFixError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		err  error
+		want *APIError
+	}{
+		{
+			name: "Exception",
+			err:  rpc.Error{Value: []any{int64(exceptionError), "Vim:E121: Undefined variable: foo"}},
+			want: &APIError{Method: "nvim_eval", Kind: ExceptionErrorKind, Message: "Vim:E121: Undefined variable: foo"},
+		},
+		{
+			name: "Validation",
+			err:  rpc.Error{Value: []any{uint64(validationError), "Invalid buffer id: 100"}},
+			want: &APIError{Method: "nvim_eval", Kind: ValidationErrorKind, Message: "Invalid buffer id: 100"},
+		},
+		{
+			name: "Other",
+			err:  rpc.Error{Value: "unknown request method: nvim_eval"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := fixError("nvim_eval", tt.err)
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				if tt.want != nil {
+					t.Fatalf("got %T %v, want *APIError", err, err)
+				}
+				return
+			}
+			if !reflect.DeepEqual(apiErr, tt.want) {
+				t.Fatalf("got %#v, want %#v", apiErr, tt.want)
+			}
+			if got, want := apiErr.Error(), fmt.Sprintf("nvim:nvim_eval %s: %s", tt.want.Kind, tt.want.Message); got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// TestNewPipeNilLogf does not run in parallel because it replaces the output
+// of the standard logger.
+func TestNewPipeNilLogf(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	v, _, err := NewPipe(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	// The peer has no handler for nvim_get_current_line.
+	if _, err := v.CurrentLine(); err == nil {
+		t.Fatal("CurrentLine() returned nil error, want unknown method error")
+	}
+}
+
+func TestNewPipe(t *testing.T) {
+	t.Parallel()
+
+	v, peer, err := NewPipe(t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	if err := peer.Register("nvim_get_current_line", func() ([]byte, error) {
+		return []byte("hello"), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.Register("nvim_buf_get_name", func(b Buffer) (string, error) {
+		if b != 1 {
+			return "", &APIError{Kind: ValidationErrorKind, Message: "Invalid buffer id: " + fmt.Sprint(int(b))}
+		}
+		return "/tmp/hello.txt", nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := v.CurrentLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(line) != "hello" {
+		t.Fatalf("CurrentLine() = %q, want %q", line, "hello")
+	}
+
+	name, err := v.BufferName(Buffer(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "/tmp/hello.txt" {
+		t.Fatalf("BufferName(1) = %q, want %q", name, "/tmp/hello.txt")
+	}
+
+	_, err = v.BufferName(Buffer(2))
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("BufferName(2) returned %T %v, want *APIError", err, err)
+	}
+	if want := (&APIError{Method: "nvim_buf_get_name", Kind: ValidationErrorKind, Message: "Invalid buffer id: 2"}); !reflect.DeepEqual(apiErr, want) {
+		t.Fatalf("BufferName(2) returned %#v, want %#v", apiErr, want)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	t.Parallel()
+
+	v, err := NewChildProcess(
+		ChildProcessCommand(BinaryName),
+		ChildProcessArgs("-u", "NONE", "-n", "--headless", "--embed"),
+		ChildProcessLogf(t.Logf),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := make(chan struct{})
+	if err := v.RegisterHandler("save", func(v *Nvim) {
+		// The handler can call Nvim while shutting down.
+		var n int
+		if err := v.Eval("1+2", &n); err != nil {
+			t.Error(err)
+		}
+		close(saved)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var ok bool
+	if err := v.Eval(fmt.Sprintf("rpcnotify(%d, 'save')", v.ChannelID()), &ok); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := v.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-saved:
+	default:
+		t.Fatal("handler not run before Shutdown returned")
+	}
+}
@@ -0,0 +1,144 @@
+package fake
+
+import (
+	"github.com/neovim/go-client/nvim"
+)
+
+// args is the arguments of an API call. The accessors record the first
+// conversion error in err and return the zero value on error.
+type args struct {
+	err    error
+	method string
+	values []any
+}
+
+// check checks that the number of arguments is n.
+func (a *args) check(n int) error {
+	if len(a.values) != n {
+		a.err = validationErrorf("Wrong number of arguments: expecting %d but got %d", n, len(a.values))
+	}
+	return a.err
+}
+
+func (a *args) fail(i int, want string) {
+	if a.err == nil {
+		a.err = validationErrorf("Wrong type for argument %d when calling %s, expecting %s", i+1, a.method, want)
+	}
+}
+
+func (a *args) int(i int) int {
+	n, ok := toInt(a.values[i])
+	if !ok {
+		a.fail(i, "Integer")
+	}
+	return n
+}
+
+func (a *args) bool(i int) bool {
+	b, ok := a.values[i].(bool)
+	if !ok {
+		a.fail(i, "Boolean")
+	}
+	return b
+}
+
+func (a *args) string(i int) string {
+	s, ok := toString(a.values[i])
+	if !ok {
+		a.fail(i, "String")
+	}
+	return s
+}
+
+func (a *args) array(i int) []any {
+	v, ok := a.values[i].([]any)
+	if !ok && a.values[i] != nil {
+		a.fail(i, "Array")
+	}
+	return v
+}
+
+func (a *args) dict(i int) map[string]any {
+	v, ok := a.values[i].(map[string]any)
+	if !ok && a.values[i] != nil {
+		a.fail(i, "Dictionary")
+	}
+	return v
+}
+
+func (a *args) lines(i int) []string {
+	values := a.array(i)
+	lines := make([]string, len(values))
+	for j, v := range values {
+		s, ok := toString(v)
+		if !ok {
+			a.fail(i, "ArrayOf(String)")
+			return nil
+		}
+		lines[j] = s
+	}
+	return lines
+}
+
+func (a *args) buffer(i int) nvim.Buffer {
+	switch v := a.values[i].(type) {
+	case nvim.Buffer:
+		return v
+	default:
+		n, ok := toInt(v)
+		if !ok {
+			a.fail(i, "Buffer")
+		}
+		return nvim.Buffer(n)
+	}
+}
+
+func (a *args) window(i int) nvim.Window {
+	switch v := a.values[i].(type) {
+	case nvim.Window:
+		return v
+	default:
+		n, ok := toInt(v)
+		if !ok {
+			a.fail(i, "Window")
+		}
+		return nvim.Window(n)
+	}
+}
+
+func (a *args) tabpage(i int) nvim.Tabpage {
+	switch v := a.values[i].(type) {
+	case nvim.Tabpage:
+		return v
+	default:
+		n, ok := toInt(v)
+		if !ok {
+			a.fail(i, "Tabpage")
+		}
+		return nvim.Tabpage(n)
+	}
+}
+
+func toInt(v any) (int, bool) {
+	switch v := v.(type) {
+	case int64:
+		return int(v), true
+	case uint64:
+		return int(v), true
+	case int:
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
+func toString(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	default:
+		return "", false
+	}
+}
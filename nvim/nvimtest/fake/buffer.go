@@ -0,0 +1,425 @@
+package fake
+
+import (
+	"sort"
+
+	"github.com/neovim/go-client/nvim"
+)
+
+var bufferMethods = map[string]method{
+	"nvim_create_buf":          (*Server).createBuf,
+	"nvim_list_bufs":           (*Server).listBufs,
+	"nvim_get_current_buf":     (*Server).getCurrentBuf,
+	"nvim_set_current_buf":     (*Server).setCurrentBuf,
+	"nvim_buf_is_valid":        (*Server).bufIsValid,
+	"nvim_buf_is_loaded":       (*Server).bufIsValid,
+	"nvim_buf_get_number":      (*Server).bufGetNumber,
+	"nvim_buf_get_name":        (*Server).bufGetName,
+	"nvim_buf_set_name":        (*Server).bufSetName,
+	"nvim_buf_line_count":      (*Server).bufLineCount,
+	"nvim_buf_get_lines":       (*Server).bufGetLines,
+	"nvim_buf_set_lines":       (*Server).bufSetLines,
+	"nvim_buf_get_offset":      (*Server).bufGetOffset,
+	"nvim_buf_get_changedtick": (*Server).bufGetChangedtick,
+	"nvim_buf_delete":          (*Server).bufDelete,
+	"nvim_buf_attach":          (*Server).bufAttach,
+	"nvim_buf_detach":          (*Server).bufDetach,
+	"nvim_get_current_line":    (*Server).getCurrentLine,
+	"nvim_set_current_line":    (*Server).setCurrentLine,
+	"nvim_del_current_line":    (*Server).delCurrentLine,
+}
+
+// newBuffer creates a buffer with one empty line.
+func (s *Server) newBuffer() nvim.Buffer {
+	b := s.nextBuffer
+	s.nextBuffer++
+	s.buffers[b] = &buffer{
+		lines:       []string{""},
+		vars:        make(map[string]any),
+		options:     make(map[string]any),
+		changedtick: 2,
+	}
+	return b
+}
+
+// buffer returns the buffer b or the current buffer if b is 0.
+func (s *Server) buffer(b nvim.Buffer) (nvim.Buffer, *buffer, error) {
+	if b == 0 {
+		b = s.windows[s.curWin].buffer
+	}
+	buf := s.buffers[b]
+	if buf == nil {
+		return 0, nil, validationErrorf("Invalid buffer id: %d", int(b))
+	}
+	return b, buf, nil
+}
+
+func (s *Server) createBuf(a *args) (any, error) {
+	if err := a.check(2); err != nil {
+		return nil, err
+	}
+	listed, scratch := a.bool(0), a.bool(1)
+	if a.err != nil {
+		return nil, a.err
+	}
+	b := s.newBuffer()
+	buf := s.buffers[b]
+	if !listed {
+		buf.options["buflisted"] = false
+	}
+	if scratch {
+		buf.options["buftype"] = "nofile"
+		buf.options["bufhidden"] = "hide"
+		buf.options["swapfile"] = false
+	}
+	return b, nil
+}
+
+func (s *Server) listBufs(a *args) (any, error) {
+	if err := a.check(0); err != nil {
+		return nil, err
+	}
+	bufs := make([]nvim.Buffer, 0, len(s.buffers))
+	for b := range s.buffers {
+		bufs = append(bufs, b)
+	}
+	sort.Slice(bufs, func(i, j int) bool { return bufs[i] < bufs[j] })
+	return bufs, nil
+}
+
+func (s *Server) getCurrentBuf(a *args) (any, error) {
+	if err := a.check(0); err != nil {
+		return nil, err
+	}
+	return s.windows[s.curWin].buffer, nil
+}
+
+func (s *Server) setCurrentBuf(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	b, _, err := s.buffer(a.buffer(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.setWindowBuffer(s.windows[s.curWin], b)
+	return nil, nil
+}
+
+func (s *Server) bufIsValid(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	b := a.buffer(0)
+	if a.err != nil {
+		return nil, a.err
+	}
+	_, ok := s.buffers[b]
+	return ok, nil
+}
+
+func (s *Server) bufGetNumber(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	b, _, err := s.buffer(a.buffer(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return int(b), nil
+}
+
+func (s *Server) bufGetName(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	_, buf, err := s.buffer(a.buffer(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.name, nil
+}
+
+func (s *Server) bufSetName(a *args) (any, error) {
+	if err := a.check(2); err != nil {
+		return nil, err
+	}
+	_, buf, err := s.buffer(a.buffer(0))
+	name := a.string(1)
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf.name = name
+	return nil, nil
+}
+
+func (s *Server) bufLineCount(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	_, buf, err := s.buffer(a.buffer(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return len(buf.lines), nil
+}
+
+// lineRange converts the line range start, end to indices in lines. Negative
+// indices are interpreted as len(lines)+1+index. Out-of-bounds indices are
+// clamped unless strict is set.
+func lineRange(lines []string, start, end int, strict bool) (int, int, error) {
+	n := len(lines)
+	normalize := func(i int) (int, bool) {
+		if i < 0 {
+			i = n + 1 + i
+		}
+		if i < 0 || i > n {
+			if strict {
+				return 0, false
+			}
+			if i < 0 {
+				return 0, true
+			}
+			return n, true
+		}
+		return i, true
+	}
+	start, ok1 := normalize(start)
+	end, ok2 := normalize(end)
+	if !ok1 || !ok2 {
+		return 0, 0, validationErrorf("Index out of bounds")
+	}
+	return start, end, nil
+}
+
+func (s *Server) bufGetLines(a *args) (any, error) {
+	if err := a.check(4); err != nil {
+		return nil, err
+	}
+	_, buf, err := s.buffer(a.buffer(0))
+	start, end, strict := a.int(1), a.int(2), a.bool(3)
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	start, end, err = lineRange(buf.lines, start, end, strict)
+	if err != nil {
+		return nil, err
+	}
+	if start >= end {
+		return []string{}, nil
+	}
+	return append([]string{}, buf.lines[start:end]...), nil
+}
+
+func (s *Server) bufSetLines(a *args) (any, error) {
+	if err := a.check(5); err != nil {
+		return nil, err
+	}
+	b, buf, err := s.buffer(a.buffer(0))
+	start, end, strict, replacement := a.int(1), a.int(2), a.bool(3), a.lines(4)
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.setLines(b, buf, start, end, strict, replacement)
+}
+
+// setLines replaces the lines start to end of buf with replacement and sends
+// the buffer update event to the client when the buffer is attached.
+func (s *Server) setLines(b nvim.Buffer, buf *buffer, start, end int, strict bool, replacement []string) error {
+	start, end, err := lineRange(buf.lines, start, end, strict)
+	if err != nil {
+		return err
+	}
+	if start > end {
+		return validationErrorf("'start' is higher than 'end'")
+	}
+
+	lines := make([]string, 0, len(buf.lines)-(end-start)+len(replacement))
+	lines = append(lines, buf.lines[:start]...)
+	lines = append(lines, replacement...)
+	lines = append(lines, buf.lines[end:]...)
+	if len(lines) == 0 {
+		// A buffer always has at least one line.
+		lines = append(lines, "")
+		replacement = []string{""}
+	}
+	buf.lines = lines
+	buf.changedtick++
+	buf.options["modified"] = true
+
+	for _, w := range s.windows {
+		if w.buffer == b && w.cursor[0] > len(lines) {
+			w.cursor = [2]int{len(lines), 0}
+		}
+	}
+
+	if buf.attached {
+		s.notify(nvim.EventBufLines, b, buf.changedtick, start, end, replacement, false)
+	}
+	return nil
+}
+
+func (s *Server) bufGetOffset(a *args) (any, error) {
+	if err := a.check(2); err != nil {
+		return nil, err
+	}
+	_, buf, err := s.buffer(a.buffer(0))
+	index := a.int(1)
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 || index > len(buf.lines) {
+		return nil, validationErrorf("Index out of bounds")
+	}
+	offset := 0
+	for _, line := range buf.lines[:index] {
+		offset += len(line) + 1
+	}
+	return offset, nil
+}
+
+func (s *Server) bufGetChangedtick(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	_, buf, err := s.buffer(a.buffer(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.changedtick, nil
+}
+
+func (s *Server) bufDelete(a *args) (any, error) {
+	if err := a.check(2); err != nil {
+		return nil, err
+	}
+	b, buf, err := s.buffer(a.buffer(0))
+	a.dict(1)
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	delete(s.buffers, b)
+	if buf.attached {
+		s.notify(nvim.EventBufDetach, b)
+	}
+
+	// Show another buffer in the windows showing the deleted buffer.
+	var other nvim.Buffer
+	for ob := range s.buffers {
+		if other == 0 || ob < other {
+			other = ob
+		}
+	}
+	if other == 0 {
+		other = s.newBuffer()
+	}
+	for _, w := range s.windows {
+		if w.buffer == b {
+			s.setWindowBuffer(w, other)
+		}
+	}
+	return nil, nil
+}
+
+func (s *Server) bufAttach(a *args) (any, error) {
+	if err := a.check(3); err != nil {
+		return nil, err
+	}
+	b, buf, err := s.buffer(a.buffer(0))
+	sendBuffer := a.bool(1)
+	a.dict(2)
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf.attached = true
+	if sendBuffer {
+		s.notify(nvim.EventBufLines, b, buf.changedtick, 0, -1, append([]string{}, buf.lines...), false)
+	}
+	return true, nil
+}
+
+func (s *Server) bufDetach(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	b, buf, err := s.buffer(a.buffer(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if buf.attached {
+		buf.attached = false
+		s.notify(nvim.EventBufDetach, b)
+	}
+	return true, nil
+}
+
+// currentLine returns the current buffer and the 0-indexed cursor line.
+func (s *Server) currentLine() (nvim.Buffer, *buffer, int) {
+	w := s.windows[s.curWin]
+	return w.buffer, s.buffers[w.buffer], w.cursor[0] - 1
+}
+
+func (s *Server) getCurrentLine(a *args) (any, error) {
+	if err := a.check(0); err != nil {
+		return nil, err
+	}
+	_, buf, line := s.currentLine()
+	return buf.lines[line], nil
+}
+
+func (s *Server) setCurrentLine(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	text := a.string(0)
+	if a.err != nil {
+		return nil, a.err
+	}
+	b, buf, line := s.currentLine()
+	return nil, s.setLines(b, buf, line, line+1, true, []string{text})
+}
+
+func (s *Server) delCurrentLine(a *args) (any, error) {
+	if err := a.check(0); err != nil {
+		return nil, err
+	}
+	b, buf, line := s.currentLine()
+	return nil, s.setLines(b, buf, line, line+1, true, []string{})
+}
@@ -0,0 +1,261 @@
+// Package fake implements an in-process fake Nvim server for testing code
+// that uses *nvim.Nvim without the nvim binary.
+//
+// The server implements a subset of the Nvim API: buffers and lines, buffer,
+// window, tabpage and global variables, options, the current buffer, window
+// and tabpage, buffer update events, nvim_call_atomic and nvim_get_api_info.
+// Requests for other methods are replied with an error. Register additional
+// handlers on the server Endpoint to fake more methods.
+package fake
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/neovim/go-client/msgpack/rpc"
+	"github.com/neovim/go-client/nvim"
+)
+
+// New returns an *nvim.Nvim connected to a new fake server, and registers
+// cleanup to tb.Cleanup.
+func New(tb testing.TB) (*nvim.Nvim, *Server) {
+	tb.Helper()
+
+	v, peer, err := nvim.NewPipe(tb.Logf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if err := v.Close(); err != nil {
+			tb.Error(err)
+		}
+	})
+
+	s, err := NewServer(peer)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return v, s
+}
+
+// channelID is the channel id of the client returned from nvim_get_api_info.
+const channelID = 1
+
+// Server is a fake Nvim server. The state of the server is modified by the
+// API calls of the client.
+type Server struct {
+	ep *rpc.Endpoint
+
+	buffers  map[nvim.Buffer]*buffer
+	windows  map[nvim.Window]*window
+	tabpages map[nvim.Tabpage]*tabpage
+	vars     map[string]any
+	options  map[string]any
+
+	curWin nvim.Window
+	curTab nvim.Tabpage
+
+	nextBuffer nvim.Buffer
+
+	mu sync.Mutex
+}
+
+type buffer struct {
+	lines   []string
+	name    string
+	vars    map[string]any
+	options map[string]any
+
+	changedtick int
+	attached    bool
+}
+
+type window struct {
+	vars    map[string]any
+	options map[string]any
+
+	buffer  nvim.Buffer
+	tabpage nvim.Tabpage
+
+	// cursor is the (1,0)-indexed cursor position.
+	cursor [2]int
+}
+
+type tabpage struct {
+	vars    map[string]any
+	windows []nvim.Window
+	curWin  nvim.Window
+}
+
+// NewServer returns a fake server that handles the requests from the peer of
+// ep. NewServer registers the handlers for the Nvim API methods on ep.
+//
+// The initial state of the server is a tabpage with a window showing an
+// empty buffer.
+func NewServer(ep *rpc.Endpoint) (*Server, error) {
+	s := &Server{
+		ep:         ep,
+		buffers:    make(map[nvim.Buffer]*buffer),
+		windows:    make(map[nvim.Window]*window),
+		tabpages:   make(map[nvim.Tabpage]*tabpage),
+		vars:       make(map[string]any),
+		options:    make(map[string]any),
+		nextBuffer: 1,
+		curWin:     1000,
+		curTab:     1,
+	}
+	for name, o := range options {
+		s.options[name] = o.value
+	}
+
+	b := s.newBuffer()
+	s.windows[s.curWin] = &window{
+		vars:    make(map[string]any),
+		options: make(map[string]any),
+		buffer:  b,
+		tabpage: s.curTab,
+		cursor:  [2]int{1, 0},
+	}
+	s.tabpages[s.curTab] = &tabpage{
+		vars:    make(map[string]any),
+		windows: []nvim.Window{s.curWin},
+		curWin:  s.curWin,
+	}
+
+	for name, m := range methods {
+		name, m := name, m
+		if err := ep.Register(name, func(values ...any) (any, error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return m(s, &args{method: name, values: values})
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Endpoint returns the endpoint of the server. Register handlers on the
+// endpoint to fake methods that are not implemented by the server.
+func (s *Server) Endpoint() *rpc.Endpoint {
+	return s.ep
+}
+
+// method is the implementation of an API method. Methods are called with s.mu
+// held.
+type method func(s *Server, a *args) (any, error)
+
+// methods is the API methods implemented by Server. methods is populated in
+// init to avoid an initialization cycle with nvim_call_atomic.
+var methods map[string]method
+
+func init() {
+	methods = map[string]method{
+		"nvim_get_api_info": (*Server).getAPIInfo,
+		"nvim_call_atomic":  (*Server).callAtomic,
+	}
+	for _, m := range []map[string]method{bufferMethods, windowMethods, tabpageMethods, varMethods, optionMethods} {
+		for name, fn := range m {
+			methods[name] = fn
+		}
+	}
+}
+
+func (s *Server) getAPIInfo(a *args) (any, error) {
+	if err := a.check(0); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	functions := make([]any, len(names))
+	for i, name := range names {
+		functions[i] = map[string]any{"name": name, "since": 1}
+	}
+
+	return []any{
+		channelID,
+		map[string]any{
+			"version": map[string]any{
+				"major":          0,
+				"minor":          10,
+				"patch":          0,
+				"api_level":      12,
+				"api_compatible": 0,
+				"api_prerelease": false,
+			},
+			"functions":  functions,
+			"ui_events":  []any{},
+			"ui_options": []any{},
+			"error_types": map[string]any{
+				"Exception":  map[string]any{"id": int(nvim.ExceptionErrorKind)},
+				"Validation": map[string]any{"id": int(nvim.ValidationErrorKind)},
+			},
+			"types": map[string]any{
+				"Buffer":  map[string]any{"id": 0, "prefix": "nvim_buf_"},
+				"Window":  map[string]any{"id": 1, "prefix": "nvim_win_"},
+				"Tabpage": map[string]any{"id": 2, "prefix": "nvim_tabpage_"},
+			},
+		},
+	}, nil
+}
+
+// callAtomic calls the methods in a batch. The batch stops at the first
+// error. The result is the list of results and the error as
+// [index, type, message] or nil.
+func (s *Server) callAtomic(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	calls := a.array(0)
+	if a.err != nil {
+		return nil, a.err
+	}
+
+	results := []any{}
+	for i, c := range calls {
+		call, ok := c.([]any)
+		if !ok || len(call) != 2 {
+			return nil, validationErrorf("Items in calls array must be arrays of size 2")
+		}
+		name, ok := toString(call[0])
+		if !ok {
+			return nil, validationErrorf("Name must be String")
+		}
+		values, ok := call[1].([]any)
+		if !ok {
+			return nil, validationErrorf("Args must be Array")
+		}
+
+		m := methods[name]
+		if m == nil || name == "nvim_call_atomic" {
+			return []any{results, []any{i, int(nvim.ValidationErrorKind), "Invalid method: " + name}}, nil
+		}
+		result, err := m(s, &args{method: name, values: values})
+		if err != nil {
+			kind, msg := nvim.ExceptionErrorKind, err.Error()
+			if apiErr, ok := err.(*nvim.APIError); ok {
+				kind, msg = apiErr.Kind, apiErr.Message
+			}
+			return []any{results, []any{i, int(kind), msg}}, nil
+		}
+		results = append(results, result)
+	}
+	return []any{results, nil}, nil
+}
+
+// notify sends a notification to the client. notify is called with s.mu held
+// so that the notifications are sent in order.
+func (s *Server) notify(method string, args ...any) {
+	// Notify fails only when the client is closed.
+	_ = s.ep.Notify(method, args...)
+}
+
+func validationErrorf(format string, args ...any) error {
+	return &nvim.APIError{Kind: nvim.ValidationErrorKind, Message: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,358 @@
+package fake
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/neovim/go-client/nvim"
+)
+
+func bytesLines(lines ...string) [][]byte {
+	p := make([][]byte, len(lines))
+	for i, line := range lines {
+		p[i] = []byte(line)
+	}
+	return p
+}
+
+func TestBuffer(t *testing.T) {
+	t.Parallel()
+
+	v, _ := New(t)
+
+	b, err := v.CurrentBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b != 1 {
+		t.Fatalf("CurrentBuffer() = %v, want 1", b)
+	}
+
+	if err := v.SetBufferLines(b, 0, -1, true, bytesLines("a", "b", "c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.SetBufferLines(b, 1, 2, true, bytesLines("x", "y")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		start, end int
+		want       [][]byte
+	}{
+		{0, -1, bytesLines("a", "x", "y", "c")},
+		{-2, -1, bytesLines("c")},
+		{1, 3, bytesLines("x", "y")},
+		{2, 100, bytesLines("y", "c")},
+	}
+	for _, tt := range tests {
+		lines, err := v.BufferLines(b, tt.start, tt.end, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(lines, tt.want) {
+			t.Errorf("BufferLines(%d, %d) = %q, want %q", tt.start, tt.end, lines, tt.want)
+		}
+	}
+
+	_, err = v.BufferLines(b, 0, 100, true)
+	var apiErr *nvim.APIError
+	if !errors.As(err, &apiErr) || apiErr.Kind != nvim.ValidationErrorKind {
+		t.Fatalf("strict BufferLines returned %v, want validation error", err)
+	}
+
+	if n, err := v.BufferLineCount(b); err != nil || n != 4 {
+		t.Fatalf("BufferLineCount() = %d, %v, want 4", n, err)
+	}
+	if tick, err := v.BufferChangedTick(b); err != nil || tick != 4 {
+		t.Fatalf("BufferChangedTick() = %d, %v, want 4", tick, err)
+	}
+	if offset, err := v.BufferOffset(b, 2); err != nil || offset != 4 {
+		t.Fatalf("BufferOffset(2) = %d, %v, want 4", offset, err)
+	}
+
+	if err := v.SetBufferName(b, "/tmp/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := v.BufferName(b); err != nil || name != "/tmp/a.txt" {
+		t.Fatalf("BufferName() = %q, %v, want /tmp/a.txt", name, err)
+	}
+
+	b2, err := v.CreateBuffer(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bufs, err := v.Buffers(); err != nil || !reflect.DeepEqual(bufs, []nvim.Buffer{b, b2}) {
+		t.Fatalf("Buffers() = %v, %v, want [%v %v]", bufs, err, b, b2)
+	}
+	if err := v.SetCurrentBuffer(b2); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.SetCurrentLine([]byte("current")); err != nil {
+		t.Fatal(err)
+	}
+	if lines, err := v.BufferLines(0, 0, -1, true); err != nil || !reflect.DeepEqual(lines, bytesLines("current")) {
+		t.Fatalf("BufferLines(0) = %q, %v, want [current]", lines, err)
+	}
+
+	if err := v.DeleteBuffer(b2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if valid, err := v.IsBufferValid(b2); err != nil || valid {
+		t.Fatalf("IsBufferValid(%v) = %v, %v, want false", b2, valid, err)
+	}
+	if cur, err := v.CurrentBuffer(); err != nil || cur != b {
+		t.Fatalf("CurrentBuffer() = %v, %v, want %v", cur, err, b)
+	}
+	if _, err := v.BufferName(b2); !errors.As(err, &apiErr) {
+		t.Fatalf("BufferName(deleted) returned %v, want *nvim.APIError", err)
+	}
+}
+
+func TestWindowAndTabpage(t *testing.T) {
+	t.Parallel()
+
+	v, _ := New(t)
+
+	w, err := v.CurrentWindow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tab, err := v.CurrentTabpage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wins, err := v.TabpageWindows(tab); err != nil || !reflect.DeepEqual(wins, []nvim.Window{w}) {
+		t.Fatalf("TabpageWindows() = %v, %v, want [%v]", wins, err, w)
+	}
+
+	b, err := v.CreateBuffer(false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.SetBufferLines(b, 0, -1, true, bytesLines("one", "two")); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.SetCurrentBuffer(b); err != nil {
+		t.Fatal(err)
+	}
+	if wb, err := v.WindowBuffer(w); err != nil || wb != b {
+		t.Fatalf("WindowBuffer() = %v, %v, want %v", wb, err, b)
+	}
+
+	if err := v.SetWindowCursor(w, [2]int{2, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if pos, err := v.WindowCursor(w); err != nil || pos != [2]int{2, 1} {
+		t.Fatalf("WindowCursor() = %v, %v, want [2 1]", pos, err)
+	}
+	if line, err := v.CurrentLine(); err != nil || string(line) != "two" {
+		t.Fatalf("CurrentLine() = %q, %v, want two", line, err)
+	}
+	if err := v.SetWindowCursor(w, [2]int{3, 0}); err == nil {
+		t.Fatal("SetWindowCursor outside buffer returned nil error")
+	}
+}
+
+func TestVars(t *testing.T) {
+	t.Parallel()
+
+	v, _ := New(t)
+
+	if err := v.SetVar("answer", 42); err != nil {
+		t.Fatal(err)
+	}
+	var answer int
+	if err := v.Var("answer", &answer); err != nil || answer != 42 {
+		t.Fatalf("Var(answer) = %d, %v, want 42", answer, err)
+	}
+	if err := v.DeleteVar("answer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Var("answer", &answer); err == nil {
+		t.Fatal("Var of deleted variable returned nil error")
+	}
+
+	if err := v.SetBufferVar(0, "name", "buf"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.SetWindowVar(0, "name", "win"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.SetTabpageVar(0, "name", "tab"); err != nil {
+		t.Fatal(err)
+	}
+	var bufVar, winVar, tabVar string
+	if err := v.BufferVar(1, "name", &bufVar); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.WindowVar(1000, "name", &winVar); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.TabpageVar(1, "name", &tabVar); err != nil {
+		t.Fatal(err)
+	}
+	if bufVar != "buf" || winVar != "win" || tabVar != "tab" {
+		t.Fatalf("vars = %q, %q, %q, want buf, win, tab", bufVar, winVar, tabVar)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	t.Parallel()
+
+	v, _ := New(t)
+
+	var tabstop int
+	if err := v.BufferOption(0, "tabstop", &tabstop); err != nil || tabstop != 8 {
+		t.Fatalf("BufferOption(tabstop) = %d, %v, want 8", tabstop, err)
+	}
+	if err := v.SetBufferOption(0, "tabstop", 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.BufferOption(0, "tabstop", &tabstop); err != nil || tabstop != 4 {
+		t.Fatalf("BufferOption(tabstop) = %d, %v, want 4", tabstop, err)
+	}
+	if err := v.OptionValue("tabstop", map[string]nvim.OptionValueScope{"scope": nvim.GlobalScope}, &tabstop); err != nil || tabstop != 8 {
+		t.Fatalf("global OptionValue(tabstop) = %d, %v, want 8", tabstop, err)
+	}
+
+	b, err := v.CreateBuffer(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.BufferOption(b, "tabstop", &tabstop); err != nil || tabstop != 8 {
+		t.Fatalf("BufferOption(%v, tabstop) = %d, %v, want 8", b, tabstop, err)
+	}
+
+	if err := v.SetOptionValue("ignorecase", true, nil); err != nil {
+		t.Fatal(err)
+	}
+	var ignorecase bool
+	if err := v.Option("ignorecase", &ignorecase); err != nil || !ignorecase {
+		t.Fatalf("Option(ignorecase) = %v, %v, want true", ignorecase, err)
+	}
+
+	var apiErr *nvim.APIError
+	if err := v.Option("nosuchoption", new(any)); !errors.As(err, &apiErr) || apiErr.Kind != nvim.ValidationErrorKind {
+		t.Fatalf("Option(nosuchoption) returned %v, want validation error", err)
+	}
+}
+
+func TestCallAtomic(t *testing.T) {
+	t.Parallel()
+
+	v, _ := New(t)
+
+	b := v.NewBatch()
+	var lines [][]byte
+	var count int
+	b.SetBufferLines(0, 0, -1, true, bytesLines("a", "b"))
+	b.BufferLines(0, 0, -1, true, &lines)
+	b.BufferLineCount(0, &count)
+	if err := b.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lines, bytesLines("a", "b")) || count != 2 {
+		t.Fatalf("batch results = %q, %d, want [a b], 2", lines, count)
+	}
+
+	var name string
+	b.SetVar("x", 1)
+	b.BufferName(100, &name)
+	err := b.Execute()
+	var batchErr *nvim.BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("Execute() returned %v, want *nvim.BatchError", err)
+	}
+	var apiErr *nvim.APIError
+	if batchErr.Index != 1 || !errors.As(err, &apiErr) || apiErr.Method != "nvim_buf_get_name" || apiErr.Kind != nvim.ValidationErrorKind {
+		t.Fatalf("Execute() returned %#v, want error at index 1 from nvim_buf_get_name", batchErr)
+	}
+}
+
+func TestAPIInfo(t *testing.T) {
+	t.Parallel()
+
+	v, _ := New(t)
+
+	if id := v.ChannelID(); id != channelID {
+		t.Fatalf("ChannelID() = %d, want %d", id, channelID)
+	}
+	info, err := v.APIInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info) != 2 {
+		t.Fatalf("APIInfo() = %v, want [channel-id, api-metadata]", info)
+	}
+	metadata, ok := info[1].(map[string]any)
+	if !ok {
+		t.Fatalf("APIInfo()[1] = %T, want map", info[1])
+	}
+	functions, _ := metadata["functions"].([]any)
+	if len(functions) != len(methods) {
+		t.Fatalf("got %d functions, want %d", len(functions), len(methods))
+	}
+}
+
+func TestBufferEvents(t *testing.T) {
+	t.Parallel()
+
+	v, _ := New(t)
+
+	type linesEvent struct {
+		Buffer      nvim.Buffer
+		Changedtick int
+		FirstLine   int
+		LastLine    int
+		Lines       []string
+		More        bool
+	}
+	events := make(chan any, 10)
+	if err := v.RegisterHandler(nvim.EventBufLines, func(b nvim.Buffer, tick, first, last int, lines []string, more bool) {
+		events <- linesEvent{b, tick, first, last, lines, more}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.RegisterHandler(nvim.EventBufDetach, func(b nvim.Buffer) {
+		events <- b
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	next := func() any {
+		t.Helper()
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout waiting for event")
+			return nil
+		}
+	}
+
+	if err := v.SetBufferLines(1, 0, -1, true, bytesLines("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := v.AttachBuffer(1, true, nil); err != nil || !ok {
+		t.Fatalf("AttachBuffer() = %v, %v, want true", ok, err)
+	}
+	if got, want := next(), (linesEvent{1, 3, 0, -1, []string{"a", "b"}, false}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got event %v, want %v", got, want)
+	}
+
+	if err := v.SetBufferLines(1, 1, 2, true, bytesLines("x", "y")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := next(), (linesEvent{1, 4, 1, 2, []string{"x", "y"}, false}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got event %v, want %v", got, want)
+	}
+
+	if ok, err := v.DetachBuffer(1); err != nil || !ok {
+		t.Fatalf("DetachBuffer() = %v, %v, want true", ok, err)
+	}
+	if got := next(); got != nvim.Buffer(1) {
+		t.Fatalf("got event %v, want detach of buffer 1", got)
+	}
+}
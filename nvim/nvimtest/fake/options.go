@@ -0,0 +1,279 @@
+package fake
+
+import "github.com/neovim/go-client/nvim"
+
+var optionMethods = map[string]method{
+	"nvim_get_option":       (*Server).getOption,
+	"nvim_set_option":       (*Server).setOption,
+	"nvim_buf_get_option":   (*Server).bufGetOption,
+	"nvim_buf_set_option":   (*Server).bufSetOption,
+	"nvim_win_get_option":   (*Server).winGetOption,
+	"nvim_win_set_option":   (*Server).winSetOption,
+	"nvim_get_option_value": (*Server).getOptionValue,
+	"nvim_set_option_value": (*Server).setOptionValue,
+}
+
+// optionScope is the scope of the local value of an option.
+type optionScope int
+
+// list of optionScope.
+const (
+	globalOption optionScope = iota
+	bufferOption
+	windowOption
+)
+
+type option struct {
+	value any
+	scope optionScope
+}
+
+// options is the options known to the server and their default values.
+var options = map[string]option{
+	"autoindent":     {false, bufferOption},
+	"bufhidden":      {"", bufferOption},
+	"buflisted":      {true, bufferOption},
+	"buftype":        {"", bufferOption},
+	"expandtab":      {false, bufferOption},
+	"fileencoding":   {"", bufferOption},
+	"fileformat":     {"unix", bufferOption},
+	"filetype":       {"", bufferOption},
+	"modifiable":     {true, bufferOption},
+	"modified":       {false, bufferOption},
+	"readonly":       {false, bufferOption},
+	"shiftwidth":     {8, bufferOption},
+	"softtabstop":    {0, bufferOption},
+	"swapfile":       {true, bufferOption},
+	"syntax":         {"", bufferOption},
+	"tabstop":        {8, bufferOption},
+	"textwidth":      {0, bufferOption},
+	"cursorline":     {false, windowOption},
+	"foldenable":     {true, windowOption},
+	"list":           {false, windowOption},
+	"number":         {false, windowOption},
+	"relativenumber": {false, windowOption},
+	"signcolumn":     {"auto", windowOption},
+	"spell":          {false, windowOption},
+	"wrap":           {true, windowOption},
+	"background":     {"dark", globalOption},
+	"encoding":       {"utf-8", globalOption},
+	"hidden":         {true, globalOption},
+	"ignorecase":     {false, globalOption},
+	"laststatus":     {2, globalOption},
+	"shell":          {"sh", globalOption},
+	"smartcase":      {false, globalOption},
+	"termguicolors":  {false, globalOption},
+	"updatetime":     {4000, globalOption},
+}
+
+// lookupOption returns the scope of the option name.
+func lookupOption(name string) (optionScope, error) {
+	o, ok := options[name]
+	if !ok {
+		return 0, validationErrorf("Invalid option name: '%s'", name)
+	}
+	return o.scope, nil
+}
+
+// localOptions returns the local option values of the buffer or window for
+// an option with scope. The local option values of the current buffer or
+// window are returned when b or w is 0.
+func (s *Server) localOptions(scope optionScope, b nvim.Buffer, w nvim.Window) (map[string]any, error) {
+	switch scope {
+	case bufferOption:
+		_, buf, err := s.buffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return buf.options, nil
+	case windowOption:
+		_, win, err := s.window(w)
+		if err != nil {
+			return nil, err
+		}
+		return win.options, nil
+	default:
+		return nil, nil
+	}
+}
+
+// optionValue returns the local value of the option name if set, otherwise
+// the global value.
+func (s *Server) optionValue(name string, local map[string]any) any {
+	if v, ok := local[name]; ok {
+		return v
+	}
+	return s.options[name]
+}
+
+func (s *Server) getOption(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	name := a.string(0)
+	if a.err != nil {
+		return nil, a.err
+	}
+	if _, err := lookupOption(name); err != nil {
+		return nil, err
+	}
+	return s.options[name], nil
+}
+
+func (s *Server) setOption(a *args) (any, error) {
+	if err := a.check(2); err != nil {
+		return nil, err
+	}
+	name := a.string(0)
+	if a.err != nil {
+		return nil, a.err
+	}
+	if _, err := lookupOption(name); err != nil {
+		return nil, err
+	}
+	s.options[name] = a.values[1]
+	return nil, nil
+}
+
+// scopedOption returns the local option values for a nvim_buf_*_option or
+// nvim_win_*_option call.
+func (s *Server) scopedOption(a *args, scope optionScope, n int) (string, map[string]any, error) {
+	if err := a.check(n); err != nil {
+		return "", nil, err
+	}
+	var b nvim.Buffer
+	var w nvim.Window
+	if scope == bufferOption {
+		b = a.buffer(0)
+	} else {
+		w = a.window(0)
+	}
+	name := a.string(1)
+	if a.err != nil {
+		return "", nil, a.err
+	}
+	if optScope, err := lookupOption(name); err != nil {
+		return "", nil, err
+	} else if optScope != scope {
+		return "", nil, validationErrorf("Invalid option name: '%s'", name)
+	}
+	local, err := s.localOptions(scope, b, w)
+	return name, local, err
+}
+
+func (s *Server) bufGetOption(a *args) (any, error) {
+	name, local, err := s.scopedOption(a, bufferOption, 2)
+	if err != nil {
+		return nil, err
+	}
+	return s.optionValue(name, local), nil
+}
+
+func (s *Server) bufSetOption(a *args) (any, error) {
+	name, local, err := s.scopedOption(a, bufferOption, 3)
+	if err != nil {
+		return nil, err
+	}
+	local[name] = a.values[2]
+	return nil, nil
+}
+
+func (s *Server) winGetOption(a *args) (any, error) {
+	name, local, err := s.scopedOption(a, windowOption, 2)
+	if err != nil {
+		return nil, err
+	}
+	return s.optionValue(name, local), nil
+}
+
+func (s *Server) winSetOption(a *args) (any, error) {
+	name, local, err := s.scopedOption(a, windowOption, 3)
+	if err != nil {
+		return nil, err
+	}
+	local[name] = a.values[2]
+	return nil, nil
+}
+
+// optionValueArgs parses the name and opts arguments of
+// nvim_get_option_value and nvim_set_option_value.
+func (s *Server) optionValueArgs(a *args, optsIndex int) (name, scope string, local map[string]any, err error) {
+	name = a.string(0)
+	opts := a.dict(optsIndex)
+	if a.err != nil {
+		return "", "", nil, a.err
+	}
+	optScope, err := lookupOption(name)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	var b nvim.Buffer
+	var w nvim.Window
+	for k, v := range opts {
+		switch k {
+		case "scope":
+			scope, _ = toString(v)
+			if scope != string(nvim.GlobalScope) && scope != string(nvim.LocalScope) {
+				return "", "", nil, validationErrorf("Invalid 'scope': expected 'local' or 'global'")
+			}
+		case "buf":
+			n, ok := toInt(v)
+			if bv, isBuf := v.(nvim.Buffer); isBuf {
+				n, ok = int(bv), true
+			}
+			if !ok {
+				return "", "", nil, validationErrorf("Invalid 'buf': expected Integer")
+			}
+			b = nvim.Buffer(n)
+		case "win":
+			n, ok := toInt(v)
+			if wv, isWin := v.(nvim.Window); isWin {
+				n, ok = int(wv), true
+			}
+			if !ok {
+				return "", "", nil, validationErrorf("Invalid 'win': expected Integer")
+			}
+			w = nvim.Window(n)
+		default:
+			return "", "", nil, validationErrorf("Invalid key: '%s'", k)
+		}
+	}
+	if scope != "" && (b != 0 || w != 0) {
+		return "", "", nil, validationErrorf("Can't use both 'scope' and 'buf'/'win'")
+	}
+	local, err = s.localOptions(optScope, b, w)
+	return name, scope, local, err
+}
+
+func (s *Server) getOptionValue(a *args) (any, error) {
+	if err := a.check(2); err != nil {
+		return nil, err
+	}
+	name, scope, local, err := s.optionValueArgs(a, 1)
+	if err != nil {
+		return nil, err
+	}
+	if scope == string(nvim.GlobalScope) {
+		return s.options[name], nil
+	}
+	return s.optionValue(name, local), nil
+}
+
+func (s *Server) setOptionValue(a *args) (any, error) {
+	if err := a.check(3); err != nil {
+		return nil, err
+	}
+	name, scope, local, err := s.optionValueArgs(a, 2)
+	if err != nil {
+		return nil, err
+	}
+	value := a.values[1]
+	if scope != string(nvim.LocalScope) || local == nil {
+		s.options[name] = value
+	}
+	if scope != string(nvim.GlobalScope) && local != nil {
+		local[name] = value
+	}
+	return nil, nil
+}
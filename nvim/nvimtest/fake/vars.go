@@ -0,0 +1,120 @@
+package fake
+
+var varMethods = map[string]method{
+	"nvim_get_var":         (*Server).getVar,
+	"nvim_set_var":         (*Server).setVar,
+	"nvim_del_var":         (*Server).delVar,
+	"nvim_buf_get_var":     (*Server).bufGetVar,
+	"nvim_buf_set_var":     (*Server).bufSetVar,
+	"nvim_buf_del_var":     (*Server).bufDelVar,
+	"nvim_win_get_var":     (*Server).winGetVar,
+	"nvim_win_set_var":     (*Server).winSetVar,
+	"nvim_win_del_var":     (*Server).winDelVar,
+	"nvim_tabpage_get_var": (*Server).tabpageGetVar,
+	"nvim_tabpage_set_var": (*Server).tabpageSetVar,
+	"nvim_tabpage_del_var": (*Server).tabpageDelVar,
+}
+
+// varOp is an operation on a variable scope.
+type varOp int
+
+// list of varOp.
+const (
+	getVarOp varOp = iota
+	setVarOp
+	delVarOp
+)
+
+// nargs returns the number of arguments of op after the scope argument.
+func (op varOp) nargs() int {
+	if op == setVarOp {
+		return 2
+	}
+	return 1
+}
+
+// doVar runs op on vars with the arguments starting at i.
+func doVar(a *args, vars map[string]any, op varOp, i int) (any, error) {
+	name := a.string(i)
+	if a.err != nil {
+		return nil, a.err
+	}
+	switch op {
+	case getVarOp:
+		v, ok := vars[name]
+		if !ok {
+			return nil, validationErrorf("Key not found: %s", name)
+		}
+		return v, nil
+	case setVarOp:
+		vars[name] = a.values[i+1]
+	case delVarOp:
+		if _, ok := vars[name]; !ok {
+			return nil, validationErrorf("Key not found: %s", name)
+		}
+		delete(vars, name)
+	}
+	return nil, nil
+}
+
+func (s *Server) globalVar(a *args, op varOp) (any, error) {
+	if err := a.check(op.nargs()); err != nil {
+		return nil, err
+	}
+	return doVar(a, s.vars, op, 0)
+}
+
+func (s *Server) bufferVar(a *args, op varOp) (any, error) {
+	if err := a.check(1 + op.nargs()); err != nil {
+		return nil, err
+	}
+	_, buf, err := s.buffer(a.buffer(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doVar(a, buf.vars, op, 1)
+}
+
+func (s *Server) windowVar(a *args, op varOp) (any, error) {
+	if err := a.check(1 + op.nargs()); err != nil {
+		return nil, err
+	}
+	_, win, err := s.window(a.window(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doVar(a, win.vars, op, 1)
+}
+
+func (s *Server) tabpageVar(a *args, op varOp) (any, error) {
+	if err := a.check(1 + op.nargs()); err != nil {
+		return nil, err
+	}
+	_, tab, err := s.tabpage(a.tabpage(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doVar(a, tab.vars, op, 1)
+}
+
+func (s *Server) getVar(a *args) (any, error)        { return s.globalVar(a, getVarOp) }
+func (s *Server) setVar(a *args) (any, error)        { return s.globalVar(a, setVarOp) }
+func (s *Server) delVar(a *args) (any, error)        { return s.globalVar(a, delVarOp) }
+func (s *Server) bufGetVar(a *args) (any, error)     { return s.bufferVar(a, getVarOp) }
+func (s *Server) bufSetVar(a *args) (any, error)     { return s.bufferVar(a, setVarOp) }
+func (s *Server) bufDelVar(a *args) (any, error)     { return s.bufferVar(a, delVarOp) }
+func (s *Server) winGetVar(a *args) (any, error)     { return s.windowVar(a, getVarOp) }
+func (s *Server) winSetVar(a *args) (any, error)     { return s.windowVar(a, setVarOp) }
+func (s *Server) winDelVar(a *args) (any, error)     { return s.windowVar(a, delVarOp) }
+func (s *Server) tabpageGetVar(a *args) (any, error) { return s.tabpageVar(a, getVarOp) }
+func (s *Server) tabpageSetVar(a *args) (any, error) { return s.tabpageVar(a, setVarOp) }
+func (s *Server) tabpageDelVar(a *args) (any, error) { return s.tabpageVar(a, delVarOp) }
@@ -0,0 +1,328 @@
+package fake
+
+import (
+	"sort"
+
+	"github.com/neovim/go-client/nvim"
+)
+
+var windowMethods = map[string]method{
+	"nvim_list_wins":       (*Server).listWins,
+	"nvim_get_current_win": (*Server).getCurrentWin,
+	"nvim_set_current_win": (*Server).setCurrentWin,
+	"nvim_win_is_valid":    (*Server).winIsValid,
+	"nvim_win_get_buf":     (*Server).winGetBuf,
+	"nvim_win_set_buf":     (*Server).winSetBuf,
+	"nvim_win_get_cursor":  (*Server).winGetCursor,
+	"nvim_win_set_cursor":  (*Server).winSetCursor,
+	"nvim_win_get_tabpage": (*Server).winGetTabpage,
+	"nvim_win_get_number":  (*Server).winGetNumber,
+}
+
+var tabpageMethods = map[string]method{
+	"nvim_list_tabpages":       (*Server).listTabpages,
+	"nvim_get_current_tabpage": (*Server).getCurrentTabpage,
+	"nvim_set_current_tabpage": (*Server).setCurrentTabpage,
+	"nvim_tabpage_is_valid":    (*Server).tabpageIsValid,
+	"nvim_tabpage_list_wins":   (*Server).tabpageListWins,
+	"nvim_tabpage_get_win":     (*Server).tabpageGetWin,
+	"nvim_tabpage_get_number":  (*Server).tabpageGetNumber,
+}
+
+// window returns the window w or the current window if w is 0.
+func (s *Server) window(w nvim.Window) (nvim.Window, *window, error) {
+	if w == 0 {
+		w = s.curWin
+	}
+	win := s.windows[w]
+	if win == nil {
+		return 0, nil, validationErrorf("Invalid window id: %d", int(w))
+	}
+	return w, win, nil
+}
+
+// tabpage returns the tabpage t or the current tabpage if t is 0.
+func (s *Server) tabpage(t nvim.Tabpage) (nvim.Tabpage, *tabpage, error) {
+	if t == 0 {
+		t = s.curTab
+	}
+	tab := s.tabpages[t]
+	if tab == nil {
+		return 0, nil, validationErrorf("Invalid tabpage id: %d", int(t))
+	}
+	return t, tab, nil
+}
+
+// setWindowBuffer shows buffer b in window w.
+func (s *Server) setWindowBuffer(w *window, b nvim.Buffer) {
+	if w.buffer != b {
+		w.buffer = b
+		w.cursor = [2]int{1, 0}
+	}
+}
+
+// setCurrentWindow makes w the current window and its tabpage the current
+// tabpage.
+func (s *Server) setCurrentWindow(w nvim.Window) {
+	win := s.windows[w]
+	s.curWin = w
+	s.curTab = win.tabpage
+	s.tabpages[win.tabpage].curWin = w
+}
+
+func (s *Server) listWins(a *args) (any, error) {
+	if err := a.check(0); err != nil {
+		return nil, err
+	}
+	wins := make([]nvim.Window, 0, len(s.windows))
+	for w := range s.windows {
+		wins = append(wins, w)
+	}
+	sort.Slice(wins, func(i, j int) bool { return wins[i] < wins[j] })
+	return wins, nil
+}
+
+func (s *Server) getCurrentWin(a *args) (any, error) {
+	if err := a.check(0); err != nil {
+		return nil, err
+	}
+	return s.curWin, nil
+}
+
+func (s *Server) setCurrentWin(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	w, _, err := s.window(a.window(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.setCurrentWindow(w)
+	return nil, nil
+}
+
+func (s *Server) winIsValid(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	w := a.window(0)
+	if a.err != nil {
+		return nil, a.err
+	}
+	_, ok := s.windows[w]
+	return ok, nil
+}
+
+func (s *Server) winGetBuf(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	_, win, err := s.window(a.window(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return win.buffer, nil
+}
+
+func (s *Server) winSetBuf(a *args) (any, error) {
+	if err := a.check(2); err != nil {
+		return nil, err
+	}
+	_, win, err := s.window(a.window(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, _, err := s.buffer(a.buffer(1))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.setWindowBuffer(win, b)
+	return nil, nil
+}
+
+func (s *Server) winGetCursor(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	_, win, err := s.window(a.window(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return win.cursor, nil
+}
+
+func (s *Server) winSetCursor(a *args) (any, error) {
+	if err := a.check(2); err != nil {
+		return nil, err
+	}
+	_, win, err := s.window(a.window(0))
+	pos := a.array(1)
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(pos) != 2 {
+		return nil, validationErrorf("Argument \"pos\" must be a [row, col] array")
+	}
+	row, ok1 := toInt(pos[0])
+	col, ok2 := toInt(pos[1])
+	if !ok1 || !ok2 {
+		return nil, validationErrorf("Cannot convert cursor position")
+	}
+	lines := s.buffers[win.buffer].lines
+	if row <= 0 || row > len(lines) {
+		return nil, validationErrorf("Cursor position outside buffer")
+	}
+	if col < 0 {
+		col = 0
+	}
+	if n := len(lines[row-1]); col > n {
+		col = n
+	}
+	win.cursor = [2]int{row, col}
+	return nil, nil
+}
+
+func (s *Server) winGetTabpage(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	_, win, err := s.window(a.window(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return win.tabpage, nil
+}
+
+func (s *Server) winGetNumber(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	w, win, err := s.window(a.window(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, tw := range s.tabpages[win.tabpage].windows {
+		if tw == w {
+			return i + 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func (s *Server) listTabpages(a *args) (any, error) {
+	if err := a.check(0); err != nil {
+		return nil, err
+	}
+	tabs := make([]nvim.Tabpage, 0, len(s.tabpages))
+	for t := range s.tabpages {
+		tabs = append(tabs, t)
+	}
+	sort.Slice(tabs, func(i, j int) bool { return tabs[i] < tabs[j] })
+	return tabs, nil
+}
+
+func (s *Server) getCurrentTabpage(a *args) (any, error) {
+	if err := a.check(0); err != nil {
+		return nil, err
+	}
+	return s.curTab, nil
+}
+
+func (s *Server) setCurrentTabpage(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	_, tab, err := s.tabpage(a.tabpage(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.setCurrentWindow(tab.curWin)
+	return nil, nil
+}
+
+func (s *Server) tabpageIsValid(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	t := a.tabpage(0)
+	if a.err != nil {
+		return nil, a.err
+	}
+	_, ok := s.tabpages[t]
+	return ok, nil
+}
+
+func (s *Server) tabpageListWins(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	_, tab, err := s.tabpage(a.tabpage(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]nvim.Window{}, tab.windows...), nil
+}
+
+func (s *Server) tabpageGetWin(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	_, tab, err := s.tabpage(a.tabpage(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tab.curWin, nil
+}
+
+func (s *Server) tabpageGetNumber(a *args) (any, error) {
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+	t, _, err := s.tabpage(a.tabpage(0))
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	for ot := range s.tabpages {
+		if ot <= t {
+			n++
+		}
+	}
+	return n, nil
+}
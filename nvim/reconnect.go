@@ -0,0 +1,435 @@
+package nvim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/neovim/go-client/msgpack/rpc"
+)
+
+// ErrConnectionLost is returned by API calls on a reconnecting client when the
+// connection to Nvim is lost before the call completes, or when the call is
+// made while the client is reconnecting. The returned error wraps
+// ErrConnectionLost; test for it with errors.Is.
+var ErrConnectionLost = errors.New("nvim: connection lost")
+
+// ConnState represents the state of the connection of a reconnecting client.
+type ConnState int
+
+// list of ConnState.
+const (
+	// ConnStateConnected is reported when the client has reconnected to Nvim
+	// and restored its handlers, subscriptions and client info.
+	ConnStateConnected ConnState = iota
+
+	// ConnStateReconnecting is reported when the connection to Nvim is lost
+	// and the client starts redialing.
+	ConnStateReconnecting
+
+	// ConnStateClosed is reported when the client is closed or gives up
+	// redialing because the dial context is done.
+	ConnStateClosed
+)
+
+// String returns a string representation of the ConnState.
+func (s ConnState) String() string {
+	switch s {
+	case ConnStateConnected:
+		return "Connected"
+	case ConnStateReconnecting:
+		return "Reconnecting"
+	case ConnStateClosed:
+		return "Closed"
+	default:
+		return "unknown ConnState"
+	}
+}
+
+// DialReconnect enables reconnecting. When the connection to Nvim is lost,
+// the client redials the address, first immediately and then with an
+// exponential backoff from minDelay up to maxDelay between attempts.
+//
+// After reconnecting, the client registers the handlers registered with
+// RegisterHandler and RegisterHandlerWithLane on the new connection and
+// repeats the Subscribe and SetClientInfo calls made with the client. Calls
+// made in a Batch are not repeated.
+//
+// Calls in flight when the connection is lost, and calls made while the
+// client is reconnecting, return an error that wraps ErrConnectionLost.
+// Redialing stops when the client is closed or when the context set with
+// DialContext is done.
+func DialReconnect(minDelay, maxDelay time.Duration) DialOption {
+	return DialOption{func(dos *dialOptions) {
+		dos.reconnect = true
+		dos.minDelay = minDelay
+		dos.maxDelay = maxDelay
+	}}
+}
+
+// DialConnStateFunc specifies a function called when the connection state of
+// a reconnecting client changes. The err argument is the reason for the
+// change, or nil. The function is called from the goroutine running Serve and
+// must not block.
+func DialConnStateFunc(f func(state ConnState, err error)) DialOption {
+	return DialOption{func(dos *dialOptions) {
+		dos.connState = f
+	}}
+}
+
+// registeredHandler is a handler registered with a reconnecting client.
+type registeredHandler struct {
+	method string
+	lane   rpc.LaneFunc
+	fn     any
+	args   []any
+}
+
+// reconnector redials Nvim and restores the client state when the connection
+// is lost.
+type reconnector struct {
+	v         *Nvim
+	ctx       context.Context
+	cancel    context.CancelFunc
+	dial      func(ctx context.Context) (io.ReadWriteCloser, error)
+	logf      func(string, ...any)
+	connState func(ConnState, error)
+	minDelay  time.Duration
+	maxDelay  time.Duration
+
+	// lost is called with the error returned by Serve when the connection is
+	// lost. Reconnecting stops when lost returns an error.
+	lost func(err error) error
+
+	// dialFailed is called with the error returned by dial. Redialing stops
+	// when dialFailed returns an error.
+	dialFailed func(err error) error
+
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	// closed is set when the client is closed and stopped is set when
+	// reconnecting fails.
+	mu            sync.Mutex
+	ep            *rpc.Endpoint
+	closed        bool
+	stopped       bool
+	handlers      []registeredHandler
+	subscriptions map[string]bool
+	clientInfo    []any
+
+	// watches are the buffer watches of the client. The watches end when
+	// the connection is lost.
+	watches *bufferWatches
+}
+
+func newReconnector(v *Nvim, ctx context.Context, logf func(string, ...any), connState func(ConnState, error),
+	minDelay, maxDelay time.Duration, dial func(ctx context.Context) (io.ReadWriteCloser, error)) *reconnector {
+	if minDelay <= 0 {
+		minDelay = 10 * time.Millisecond
+	}
+	if maxDelay < minDelay {
+		maxDelay = minDelay
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &reconnector{
+		v:             v,
+		ctx:           ctx,
+		cancel:        cancel,
+		dial:          dial,
+		logf:          logf,
+		connState:     connState,
+		minDelay:      minDelay,
+		maxDelay:      maxDelay,
+		quit:          make(chan struct{}),
+		ep:            v.ep,
+		subscriptions: make(map[string]bool),
+	}
+}
+
+// endpoint returns the endpoint of the current connection.
+func (rc *reconnector) endpoint() *rpc.Endpoint {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.ep
+}
+
+// close stops reconnecting when the client is closed.
+func (rc *reconnector) close() {
+	rc.mu.Lock()
+	done := rc.closed || rc.stopped
+	rc.closed = true
+	rc.mu.Unlock()
+
+	rc.quitOnce.Do(func() { close(rc.quit) })
+	rc.cancel()
+	if !done {
+		rc.setState(ConnStateClosed, nil)
+	}
+}
+
+func (rc *reconnector) isClosed() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.closed
+}
+
+func (rc *reconnector) setState(state ConnState, err error) {
+	if rc.connState != nil {
+		rc.connState(state, err)
+	}
+}
+
+// setBufferWatches sets the buffer watches to end when the connection is lost.
+func (rc *reconnector) setBufferWatches(bw *bufferWatches) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.watches = bw
+}
+
+// endBufferWatches ends the buffer watches after the connection is lost. The
+// buffers are not attached on the new connection.
+func (rc *reconnector) endBufferWatches(err error) {
+	rc.mu.Lock()
+	bw := rc.watches
+	rc.mu.Unlock()
+	if bw == nil {
+		return
+	}
+	if err == nil {
+		err = ErrConnectionLost
+	} else {
+		err = fmt.Errorf("%w: %v", ErrConnectionLost, err)
+	}
+	bw.connectionLost(err)
+}
+
+// register registers a handler on the current endpoint and records it for
+// registration on later connections.
+func (rc *reconnector) register(h registeredHandler) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if err := registerHandler(rc.ep, h); err != nil {
+		return err
+	}
+	rc.unregisterLocked(h.method)
+	rc.handlers = append(rc.handlers, h)
+	return nil
+}
+
+func (rc *reconnector) unregister(method string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.ep.Unregister(method)
+	rc.unregisterLocked(method)
+}
+
+func (rc *reconnector) unregisterLocked(method string) {
+	for i, h := range rc.handlers {
+		if h.method == method {
+			rc.handlers = append(rc.handlers[:i], rc.handlers[i+1:]...)
+			return
+		}
+	}
+}
+
+func registerHandler(ep *rpc.Endpoint, h registeredHandler) error {
+	if h.lane != nil {
+		return ep.RegisterWithLane(h.method, h.lane, h.fn, h.args...)
+	}
+	return ep.Register(h.method, h.fn, h.args...)
+}
+
+// call calls the method on the current endpoint and records the client state
+// changed by the call.
+func (rc *reconnector) call(ctx context.Context, sm string, result any, args []any) error {
+	err := rc.endpoint().CallContext(ctx, sm, result, args...)
+	if err != nil {
+		return rc.connectionError(fixError(sm, err))
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	switch sm {
+	case "nvim_subscribe", "nvim_unsubscribe":
+		if len(args) == 1 {
+			if event, ok := args[0].(string); ok {
+				if sm == "nvim_subscribe" {
+					rc.subscriptions[event] = true
+				} else {
+					delete(rc.subscriptions, event)
+				}
+			}
+		}
+	case "nvim_set_client_info":
+		rc.clientInfo = args
+	}
+	return nil
+}
+
+// connectionError wraps err with ErrConnectionLost when err is caused by the
+// loss of the connection. A nil rc returns err unchanged.
+func (rc *reconnector) connectionError(err error) error {
+	if rc == nil || err == nil || !isConnectionError(err) || rc.isClosed() {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrConnectionLost, err)
+}
+
+// isConnectionError reports whether err is a transport error.
+func isConnectionError(err error) bool {
+	if errors.Is(err, rpc.ErrClosed) || errors.Is(err, rpc.ErrShutdown) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// serve serves the current connection and reconnects when the connection is
+// lost. Serve returns when the client is closed or redialing fails.
+func (rc *reconnector) serve() error {
+	ep := rc.endpoint()
+	err := ep.Serve()
+	for {
+		if rc.isClosed() {
+			return err
+		}
+		rc.endBufferWatches(err)
+
+		if rc.lost != nil {
+			if err := rc.lost(err); err != nil {
+				rc.stop(err)
+				return err
+			}
+		}
+
+		cause := err
+		if cause == nil {
+			cause = ErrConnectionLost
+		}
+		rc.setState(ConnStateReconnecting, cause)
+
+		ep, err = rc.redial()
+		if err != nil {
+			rc.stop(err)
+			return err
+		}
+
+		serveCh := make(chan error, 1)
+		go func() { serveCh <- ep.Serve() }()
+		rc.restore(ep)
+		rc.setState(ConnStateConnected, nil)
+		err = <-serveCh
+	}
+}
+
+// stop stops reconnecting after an error.
+func (rc *reconnector) stop(err error) {
+	rc.mu.Lock()
+	done := rc.closed || rc.stopped
+	rc.stopped = true
+	rc.mu.Unlock()
+	if !done {
+		rc.setState(ConnStateClosed, err)
+	}
+}
+
+// sleep waits for d. Sleep returns an error when the client is closed or the
+// context is done.
+func (rc *reconnector) sleep(d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-rc.quit:
+		return rpc.ErrClosed
+	case <-rc.ctx.Done():
+		return rc.ctx.Err()
+	}
+}
+
+// redial dials Nvim until a connection is established, and then swaps in a
+// new endpoint with the registered handlers.
+func (rc *reconnector) redial() (*rpc.Endpoint, error) {
+	delay := rc.minDelay
+	for {
+		c, err := rc.dial(rc.ctx)
+		if err == nil {
+			return rc.swap(c)
+		}
+		if rc.isClosed() {
+			return nil, rpc.ErrClosed
+		}
+		rc.logf("nvim: redial failed: %v", err)
+		if rc.dialFailed != nil {
+			if err := rc.dialFailed(err); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := rc.sleep(delay); err != nil {
+			return nil, err
+		}
+
+		delay *= 2
+		if delay > rc.maxDelay {
+			delay = rc.maxDelay
+		}
+	}
+}
+
+func (rc *reconnector) swap(c io.ReadWriteCloser) (*rpc.Endpoint, error) {
+	ep, err := rpc.NewEndpoint(c, c, c, rc.v.epOptions...)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		c.Close()
+		return nil, rpc.ErrClosed
+	}
+	for _, h := range rc.handlers {
+		if err := registerHandler(ep, h); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	rc.ep = ep
+
+	rc.v.channelIDMu.Lock()
+	rc.v.channelID = 0
+	rc.v.channelIDMu.Unlock()
+
+	return ep, nil
+}
+
+// restore repeats the Subscribe and SetClientInfo calls on ep.
+func (rc *reconnector) restore(ep *rpc.Endpoint) {
+	rc.mu.Lock()
+	events := make([]string, 0, len(rc.subscriptions))
+	for event := range rc.subscriptions {
+		events = append(events, event)
+	}
+	clientInfo := rc.clientInfo
+	rc.mu.Unlock()
+
+	for _, event := range events {
+		if err := ep.CallContext(rc.ctx, "nvim_subscribe", nil, event); err != nil {
+			rc.logf("nvim: restore subscription %q: %v", event, err)
+		}
+	}
+	if clientInfo != nil {
+		if err := ep.CallContext(rc.ctx, "nvim_set_client_info", nil, clientInfo...); err != nil {
+			rc.logf("nvim: restore client info: %v", err)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package nvim
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/neovim/go-client/msgpack/rpc"
+)
+
+type connStateEvent struct {
+	state ConnState
+	err   error
+}
+
+// reconnectServer accepts connections on a local listener and serves a
+// subset of the Nvim API on each connection.
+type reconnectServer struct {
+	ln         net.Listener
+	conns      chan *rpc.Endpoint
+	subscribed chan string
+	clientInfo chan string
+	blocked    chan struct{}
+}
+
+func newReconnectServer(tb testing.TB) *reconnectServer {
+	tb.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+
+	s := &reconnectServer{
+		ln:         ln,
+		conns:      make(chan *rpc.Endpoint, 4),
+		subscribed: make(chan string, 4),
+		clientInfo: make(chan string, 4),
+		blocked:    make(chan struct{}, 4),
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			ep, err := rpc.NewEndpoint(c, c, c, rpc.WithLogf(tb.Logf))
+			if err != nil {
+				c.Close()
+				return
+			}
+			ep.Register("nvim_subscribe", func(event string) {
+				s.subscribed <- event
+			})
+			ep.Register("nvim_set_client_info", func(name string, version, typ, methods, attributes any) {
+				s.clientInfo <- name
+			})
+			ep.Register("nvim_buf_attach", func(buffer, sendBuffer, opts any) (bool, error) {
+				return true, nil
+			})
+			ep.Register("block", func(ctx context.Context) {
+				s.blocked <- struct{}{}
+				<-ctx.Done()
+			})
+			go ep.Serve()
+			s.conns <- ep
+		}
+	}()
+	return s
+}
+
+func (s *reconnectServer) conn(tb testing.TB) *rpc.Endpoint {
+	tb.Helper()
+
+	select {
+	case ep := <-s.conns:
+		tb.Cleanup(func() { ep.Close() })
+		return ep
+	case <-time.After(10 * time.Second):
+		tb.Fatal("timeout waiting for connection")
+		return nil
+	}
+}
+
+func receive[T any](tb testing.TB, ch <-chan T) T {
+	tb.Helper()
+
+	select {
+	case x := <-ch:
+		return x
+	case <-time.After(10 * time.Second):
+		tb.Fatal("timeout waiting for value")
+		var zero T
+		return zero
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	t.Parallel()
+
+	s := newReconnectServer(t)
+	states := make(chan connStateEvent, 8)
+	v, err := Dial(s.ln.Addr().String(),
+		DialLogf(t.Logf),
+		DialReconnect(time.Millisecond, 10*time.Millisecond),
+		DialConnStateFunc(func(state ConnState, err error) {
+			states <- connStateEvent{state, err}
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	ep := s.conn(t)
+
+	if err := v.RegisterHandler("hello", func(v *Nvim, name string) (string, error) {
+		return "hello, " + name, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Subscribe("event"); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, s.subscribed); got != "event" {
+		t.Fatalf("subscribed to %q, want %q", got, "event")
+	}
+	if err := v.SetClientInfo("test", ClientVersion{Major: 1}, RemoteClientType, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, s.clientInfo); got != "test" {
+		t.Fatalf("client info name is %q, want %q", got, "test")
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- v.Request("block", nil) }()
+	receive(t, s.blocked)
+	ep.Close()
+
+	if err := receive(t, errc); !errors.Is(err, ErrConnectionLost) {
+		t.Fatalf("in-flight call returned %v, want %v", err, ErrConnectionLost)
+	}
+	if e := receive(t, states); e.state != ConnStateReconnecting || e.err == nil {
+		t.Fatalf("state is (%v, %v), want (%v, non-nil)", e.state, e.err, ConnStateReconnecting)
+	}
+	if e := receive(t, states); e.state != ConnStateConnected || e.err != nil {
+		t.Fatalf("state is (%v, %v), want (%v, nil)", e.state, e.err, ConnStateConnected)
+	}
+
+	ep = s.conn(t)
+	if got := receive(t, s.subscribed); got != "event" {
+		t.Fatalf("resubscribed to %q, want %q", got, "event")
+	}
+	if got := receive(t, s.clientInfo); got != "test" {
+		t.Fatalf("restored client info name is %q, want %q", got, "test")
+	}
+
+	var result string
+	if err := ep.Call("hello", &result, "world"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "hello, world"; result != want {
+		t.Fatalf("hello returned %q, want %q", result, want)
+	}
+
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if e := receive(t, states); e.state != ConnStateClosed || e.err != nil {
+		t.Fatalf("state is (%v, %v), want (%v, nil)", e.state, e.err, ConnStateClosed)
+	}
+	if err := v.Request("block", nil); errors.Is(err, ErrConnectionLost) {
+		t.Fatalf("call after Close returned %v", err)
+	}
+}
+
+func TestReconnectCallStats(t *testing.T) {
+	t.Parallel()
+
+	s := newReconnectServer(t)
+	states := make(chan connStateEvent, 8)
+	v, err := Dial(s.ln.Addr().String(),
+		DialLogf(t.Logf),
+		DialCallStats(),
+		DialReconnect(time.Millisecond, 10*time.Millisecond),
+		DialConnStateFunc(func(state ConnState, err error) {
+			states <- connStateEvent{state, err}
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	ep := s.conn(t)
+	if err := v.Subscribe("event"); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, s.subscribed)
+	if got := v.CallStats().Outgoing["nvim_subscribe"].Calls; got != 1 {
+		t.Fatalf("nvim_subscribe calls = %d, want 1", got)
+	}
+
+	// The endpoint of the new connection also collects metrics.
+	ep.Close()
+	for receive(t, states).state != ConnStateConnected {
+	}
+	s.conn(t)
+	receive(t, s.subscribed)
+	deadline := time.Now().Add(10 * time.Second)
+	for v.CallStats().Outgoing["nvim_subscribe"].Calls != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the metrics of the restored subscription")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReconnectContext(t *testing.T) {
+	t.Parallel()
+
+	s := newReconnectServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	states := make(chan connStateEvent, 8)
+	v, err := Dial(s.ln.Addr().String(),
+		DialContext(ctx),
+		DialLogf(t.Logf),
+		DialReconnect(time.Millisecond, 10*time.Millisecond),
+		DialConnStateFunc(func(state ConnState, err error) {
+			states <- connStateEvent{state, err}
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	ep := s.conn(t)
+	s.ln.Close()
+	ep.Close()
+
+	if e := receive(t, states); e.state != ConnStateReconnecting {
+		t.Fatalf("state is %v, want %v", e.state, ConnStateReconnecting)
+	}
+	if err := v.Request("block", nil); !errors.Is(err, ErrConnectionLost) {
+		t.Fatalf("call while reconnecting returned %v, want %v", err, ErrConnectionLost)
+	}
+
+	cancel()
+	if e := receive(t, states); e.state != ConnStateClosed || !errors.Is(e.err, context.Canceled) {
+		t.Fatalf("state is (%v, %v), want (%v, %v)", e.state, e.err, ConnStateClosed, context.Canceled)
+	}
+}
+
+func TestReconnectBufferWatch(t *testing.T) {
+	t.Parallel()
+
+	s := newReconnectServer(t)
+	v, err := Dial(s.ln.Addr().String(),
+		DialLogf(t.Logf),
+		DialReconnect(time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	ep := s.conn(t)
+	w, err := v.WatchBuffer(context.Background(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep.Close()
+
+	if ev, ok := receive(t, w.Events()).(*BufDetachEvent); !ok || ev.Buffer != 1 {
+		t.Fatalf("event is %#v, want *BufDetachEvent for buffer 1", ev)
+	}
+	select {
+	case <-w.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the watch to end")
+	}
+	if err := w.Err(); !errors.Is(err, ErrConnectionLost) {
+		t.Fatalf("Err() = %v, want %v", err, ErrConnectionLost)
+	}
+}
+
+func TestReconnectCloseWhileDialing(t *testing.T) {
+	t.Parallel()
+
+	s := newReconnectServer(t)
+	first := make(chan struct{}, 1)
+	dialing := make(chan struct{}, 1)
+	var d net.Dialer
+	v, err := Dial(s.ln.Addr().String(),
+		DialLogf(t.Logf),
+		DialReconnect(time.Millisecond, 10*time.Millisecond),
+		DialNetDial(func(ctx context.Context, network, address string) (net.Conn, error) {
+			select {
+			case first <- struct{}{}:
+				return d.DialContext(ctx, network, address)
+			default:
+			}
+			// Redialing hangs until the dial context is done.
+			select {
+			case dialing <- struct{}{}:
+			default:
+			}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.conn(t).Close()
+	receive(t, dialing)
+
+	closed := make(chan error, 1)
+	go func() { closed <- v.Close() }()
+	receive(t, closed)
+}
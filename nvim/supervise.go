@@ -0,0 +1,363 @@
+package nvim
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// errProcessExited is the reason reported when a child process that exited
+// cleanly is not restarted.
+var errProcessExited = errors.New("nvim: child process exited")
+
+// ChildProcessStderr specifies a writer for the standard error of the child
+// process. The standard error is discarded by default.
+func ChildProcessStderr(w io.Writer) ChildProcessOption {
+	return ChildProcessOption{func(cpos *childProcessOptions) {
+		cpos.stderr = w
+	}}
+}
+
+// ChildProcessStderrLogf specifies a function for logging the lines written
+// to the standard error of the child process.
+func ChildProcessStderrLogf(logf func(string, ...any)) ChildProcessOption {
+	return ChildProcessOption{func(cpos *childProcessOptions) {
+		cpos.stderr = &lineLogger{logf: logf}
+	}}
+}
+
+// ChildProcessRestart enables restarting the child process when it exits for
+// any reason other than a call to Close or Shutdown. The process is restarted
+// at most maxRestarts times, or without limit when maxRestarts is negative.
+// A restart that fails to start the process counts as a restart.
+// The delay before a restart starts at minDelay and doubles with each
+// restart up to maxDelay.
+//
+// After a restart, the client registers the handlers registered with
+// RegisterHandler and RegisterHandlerWithLane with the new process and repeats
+// the Subscribe and SetClientInfo calls made with the client. Calls in flight
+// when the process exits, and calls made before the process is restarted,
+// return an error that wraps ErrConnectionLost.
+func ChildProcessRestart(maxRestarts int, minDelay, maxDelay time.Duration) ChildProcessOption {
+	return ChildProcessOption{func(cpos *childProcessOptions) {
+		cpos.restart = true
+		cpos.maxRestarts = maxRestarts
+		cpos.minDelay = minDelay
+		cpos.maxDelay = maxDelay
+	}}
+}
+
+// ChildProcessConnStateFunc specifies a function called when the child
+// process exits and when it is restarted. See DialConnStateFunc.
+func ChildProcessConnStateFunc(f func(state ConnState, err error)) ChildProcessOption {
+	return ChildProcessOption{func(cpos *childProcessOptions) {
+		cpos.connState = f
+	}}
+}
+
+// ChildProcessLivenessProbe enables calling nvim_get_mode every interval.
+// Nvim replies to nvim_get_mode even when it waits for input. If the reply
+// does not arrive within timeout, the child process is killed and Err reports
+// the probe failure. Combine with ChildProcessRestart to replace a wedged
+// process.
+func ChildProcessLivenessProbe(interval, timeout time.Duration) ChildProcessOption {
+	return ChildProcessOption{func(cpos *childProcessOptions) {
+		cpos.probeInterval = interval
+		cpos.probeTimeout = timeout
+		if cpos.probeTimeout <= 0 {
+			cpos.probeTimeout = interval
+		}
+	}}
+}
+
+// Done returns a channel that is closed when the child process started by
+// NewChildProcess has exited and will not be restarted. The channel is closed
+// after Serve returns. Done returns nil for clients not created by
+// NewChildProcess.
+func (v *Nvim) Done() <-chan struct{} {
+	v = v.root()
+	if v.child == nil {
+		return nil
+	}
+	return v.child.done
+}
+
+// Err returns nil if Done is not yet closed. After Done is closed, Err
+// returns the error returned by exec.Cmd.Wait for the last child process, an
+// *exec.ExitError for a non-zero exit code, the liveness probe error if the
+// process was killed by the liveness probe, or the error starting the process
+// if the last restart failed.
+func (v *Nvim) Err() error {
+	v = v.root()
+	if v.child == nil {
+		return nil
+	}
+	select {
+	case <-v.child.done:
+		return v.child.err
+	default:
+		return nil
+	}
+}
+
+// process is a started child process.
+type process struct {
+	cmd    *exec.Cmd
+	exited chan struct{}
+
+	waitOnce sync.Once
+	err      error
+
+	mu      sync.Mutex
+	killErr error
+}
+
+// wait waits for the process to exit and returns the exit error. The caller
+// must not read from the process stdout after calling wait.
+func (p *process) wait() error {
+	p.waitOnce.Do(func() {
+		p.err = p.cmd.Wait()
+		if l, ok := p.cmd.Stderr.(*lineLogger); ok {
+			l.flush()
+		}
+
+		p.mu.Lock()
+		if p.killErr != nil {
+			p.err = p.killErr
+		}
+		p.mu.Unlock()
+		close(p.exited)
+	})
+	return p.err
+}
+
+// kill kills the process and records err as the reason.
+func (p *process) kill(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.exited:
+		return
+	default:
+	}
+	if p.killErr == nil {
+		p.killErr = err
+	}
+	p.cmd.Process.Kill()
+}
+
+// exitCode returns the exit code of the process, or -1 if the process has
+// not exited or was terminated by a signal.
+func (p *process) exitCode() int {
+	select {
+	case <-p.exited:
+		return p.cmd.ProcessState.ExitCode()
+	default:
+		return -1
+	}
+}
+
+// processConn is the connection to a child process over its stdin and
+// stdout.
+type processConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// childProcess supervises the child processes of a client.
+type childProcess struct {
+	cpos *childProcessOptions
+
+	done     chan struct{}
+	doneOnce sync.Once
+	err      error
+
+	mu       sync.Mutex
+	proc     *process
+	restarts int
+	closed   bool
+}
+
+// start starts a new child process.
+func (cp *childProcess) start() (io.ReadWriteCloser, error) {
+	cpos := cp.cpos
+	cmd := exec.CommandContext(cpos.ctx, cpos.command, cpos.args...)
+	cmd.Env = cpos.env
+	cmd.Dir = cpos.dir
+	cmd.Stderr = cpos.stderr
+	cmd.SysProcAttr = embedProcAttr
+
+	inw, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	outr, err := cmd.StdoutPipe()
+	if err != nil {
+		inw.Close()
+		return nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	cp.mu.Lock()
+	cp.proc = &process{cmd: cmd, exited: make(chan struct{})}
+	cp.mu.Unlock()
+
+	return processConn{outr, inw}, nil
+}
+
+// current returns the current child process.
+func (cp *childProcess) current() *process {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.proc
+}
+
+// close records that the client is closing.
+func (cp *childProcess) close() {
+	cp.mu.Lock()
+	cp.closed = true
+	cp.mu.Unlock()
+}
+
+func (cp *childProcess) isClosed() bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.closed
+}
+
+// finish closes done and sets the error returned by Err.
+func (cp *childProcess) finish(err error) {
+	cp.doneOnce.Do(func() {
+		cp.err = err
+		close(cp.done)
+	})
+}
+
+// lost waits for the current process to exit and applies the restart policy.
+// It is called by rc when serving the connection to the process ends.
+func (cp *childProcess) lost(rc *reconnector) func(error) error {
+	return func(error) error {
+		err := cp.current().wait()
+
+		cp.mu.Lock()
+		restart := cp.cpos.maxRestarts < 0 || cp.restarts < cp.cpos.maxRestarts
+		if restart {
+			cp.restarts++
+		}
+		restarts := cp.restarts
+		cp.mu.Unlock()
+
+		if !restart {
+			cp.finish(err)
+			if err == nil {
+				err = errProcessExited
+			}
+			return err
+		}
+
+		delay := rc.minDelay << (restarts - 1)
+		if delay > rc.maxDelay || delay <= 0 {
+			delay = rc.maxDelay
+		}
+		rc.logf("nvim: restarting child process in %v: %v", delay, err)
+		if err := rc.sleep(delay); err != nil {
+			cp.finish(cp.current().err)
+			return err
+		}
+		return nil
+	}
+}
+
+// startFailed applies the restart policy to a failed restart. Failed starts
+// count against the restart limit like process exits. When the limit is
+// reached, startFailed closes done with err and returns err.
+func (cp *childProcess) startFailed(err error) error {
+	cp.mu.Lock()
+	restart := cp.cpos.maxRestarts < 0 || cp.restarts < cp.cpos.maxRestarts
+	if restart {
+		cp.restarts++
+	}
+	cp.mu.Unlock()
+
+	if !restart {
+		cp.finish(err)
+		return err
+	}
+	return nil
+}
+
+// probe calls nvim_get_mode every probe interval until done is closed and
+// kills the process when a call times out.
+func (cp *childProcess) probe(v *Nvim) {
+	ticker := time.NewTicker(cp.cpos.probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cp.done:
+			return
+		case <-ticker.C:
+		}
+
+		proc := cp.current()
+		ctx, cancel := context.WithTimeout(context.Background(), cp.cpos.probeTimeout)
+		_, err := v.WithContext(ctx).Mode()
+		cancel()
+		// Other errors mean that the connection to proc is lost. The call
+		// may also have been made on the connection to a restarted process,
+		// so proc is only killed if it is still the current process.
+		if !errors.Is(err, context.DeadlineExceeded) || cp.isClosed() || cp.current() != proc {
+			continue
+		}
+
+		err = fmt.Errorf("nvim: liveness probe failed: %w", err)
+		cp.cpos.logf("%v", err)
+		proc.kill(err)
+	}
+}
+
+// lineLogger logs the lines written to it.
+type lineLogger struct {
+	logf func(string, ...any)
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// Write implements io.Writer.
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		l.logf("%s", bytes.TrimSuffix(l.buf[:i], []byte{'\r'}))
+		l.buf = l.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush logs the last line if it is not terminated by a newline.
+func (l *lineLogger) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.buf) > 0 {
+		l.logf("%s", l.buf)
+		l.buf = nil
+	}
+}
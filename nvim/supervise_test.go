@@ -0,0 +1,278 @@
+package nvim
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/neovim/go-client/msgpack/rpc"
+)
+
+// helperProcessEnv is set in the environment of the helper process started by
+// newHelperProcess.
+const helperProcessEnv = "GO_NVIM_TEST_HELPER_PROCESS"
+
+// TestHelperProcess is not a real test. It serves a subset of the Nvim API on
+// stdin and stdout when run by newHelperProcess.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv(helperProcessEnv) != "1" {
+		return
+	}
+
+	ep, err := rpc.NewEndpoint(os.Stdin, os.Stdout, os.Stdout)
+	if err != nil {
+		os.Exit(2)
+	}
+
+	var (
+		mu   sync.Mutex
+		hung bool
+	)
+	ep.Register("nvim_get_mode", func() (map[string]any, error) {
+		mu.Lock()
+		h := hung
+		mu.Unlock()
+		if h {
+			select {}
+		}
+		return map[string]any{"mode": "n", "blocking": false}, nil
+	})
+	ep.Register("nvim_subscribe", func(event string) {})
+	ep.Register("pid", func() (int, error) {
+		return os.Getpid(), nil
+	})
+	ep.Register("stderr", func(s string) {
+		fmt.Fprint(os.Stderr, s)
+	})
+	ep.Register("hang", func() {
+		mu.Lock()
+		hung = true
+		mu.Unlock()
+	})
+	ep.Register("exit", func(code int) {
+		os.Exit(code)
+	})
+
+	ep.Serve()
+	os.Exit(0)
+}
+
+// newHelperProcess starts the test binary as a child process that runs
+// TestHelperProcess.
+func newHelperProcess(tb testing.TB, opts ...ChildProcessOption) *Nvim {
+	tb.Helper()
+
+	opts = append([]ChildProcessOption{
+		ChildProcessCommand(os.Args[0]),
+		ChildProcessArgs("-test.run=^TestHelperProcess$", "--", "--embed"),
+		ChildProcessEnv(append(os.Environ(), helperProcessEnv+"=1")),
+		ChildProcessLogf(tb.Logf),
+	}, opts...)
+	v, err := NewChildProcess(opts...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { v.Close() })
+	return v
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitDone(tb testing.TB, v *Nvim) {
+	tb.Helper()
+
+	select {
+	case <-v.Done():
+	case <-time.After(10 * time.Second):
+		tb.Fatal("timeout waiting for the child process to exit")
+	}
+}
+
+func TestChildProcessDone(t *testing.T) {
+	t.Parallel()
+
+	var stderr syncBuffer
+	v := newHelperProcess(t, ChildProcessStderr(&stderr))
+
+	if err := v.Err(); err != nil {
+		t.Fatalf("Err() of running process = %v, want nil", err)
+	}
+
+	// ExitCode waits for the process to exit.
+	exitCode := make(chan int, 1)
+	go func() { exitCode <- v.ExitCode() }()
+
+	if err := v.Request("stderr", nil, "hello\n"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case code := <-exitCode:
+		t.Fatalf("ExitCode() of running process returned %d", code)
+	default:
+	}
+	if err := v.Request("exit", nil, 3); err == nil {
+		t.Fatal("exit returned nil error")
+	}
+	if code := receive(t, exitCode); code != 3 {
+		t.Fatalf("ExitCode() = %d, want 3", code)
+	}
+	waitDone(t, v)
+
+	var exitErr *exec.ExitError
+	if err := v.Err(); !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatalf("Err() = %v, want exit status 3", err)
+	}
+	if code := v.ExitCode(); code != 3 {
+		t.Fatalf("ExitCode() = %d, want 3", code)
+	}
+	if got := stderr.String(); got != "hello\n" {
+		t.Fatalf("stderr is %q, want %q", got, "hello\n")
+	}
+}
+
+func TestChildProcessStderrLogf(t *testing.T) {
+	t.Parallel()
+
+	lines := make(chan string, 4)
+	v := newHelperProcess(t, ChildProcessStderrLogf(func(format string, args ...any) {
+		lines <- fmt.Sprintf(format, args...)
+	}))
+
+	if err := v.Request("stderr", nil, "one\r\ntw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Request("stderr", nil, "o\nthree"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(lines)
+
+	var got []string
+	for line := range lines {
+		got = append(got, line)
+	}
+	if want := []string{"one", "two", "three"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("logged lines %q, want %q", got, want)
+	}
+}
+
+func TestChildProcessRestart(t *testing.T) {
+	t.Parallel()
+
+	states := make(chan connStateEvent, 8)
+	v := newHelperProcess(t,
+		ChildProcessRestart(1, time.Millisecond, 10*time.Millisecond),
+		ChildProcessConnStateFunc(func(state ConnState, err error) {
+			states <- connStateEvent{state, err}
+		}))
+
+	var pid1 int
+	if err := v.Request("pid", &pid1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.Request("exit", nil, 3); !errors.Is(err, ErrConnectionLost) {
+		t.Fatalf("exit returned %v, want %v", err, ErrConnectionLost)
+	}
+	if e := receive(t, states); e.state != ConnStateReconnecting {
+		t.Fatalf("state is %v, want %v", e.state, ConnStateReconnecting)
+	}
+	if e := receive(t, states); e.state != ConnStateConnected {
+		t.Fatalf("state is %v, want %v", e.state, ConnStateConnected)
+	}
+
+	var pid2 int
+	if err := v.Request("pid", &pid2); err != nil {
+		t.Fatal(err)
+	}
+	if pid2 == pid1 {
+		t.Fatalf("pid of restarted process is %d, want a new pid", pid2)
+	}
+	select {
+	case <-v.Done():
+		t.Fatal("Done closed after restart")
+	default:
+	}
+
+	// The restart limit is reached.
+	if err := v.Request("exit", nil, 4); !errors.Is(err, ErrConnectionLost) {
+		t.Fatalf("exit returned %v, want %v", err, ErrConnectionLost)
+	}
+	if e := receive(t, states); e.state != ConnStateClosed || e.err == nil {
+		t.Fatalf("state is (%v, %v), want (%v, non-nil)", e.state, e.err, ConnStateClosed)
+	}
+	waitDone(t, v)
+	if code := v.ExitCode(); code != 4 {
+		t.Fatalf("ExitCode() = %d, want 4", code)
+	}
+}
+
+func TestChildProcessRestartStartError(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	v := newHelperProcess(t,
+		ChildProcessDir(dir),
+		ChildProcessRestart(3, time.Millisecond, time.Millisecond))
+
+	// Restarts fail because the working directory is removed.
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Request("exit", nil, 3); !errors.Is(err, ErrConnectionLost) {
+		t.Fatalf("exit returned %v, want %v", err, ErrConnectionLost)
+	}
+	waitDone(t, v)
+
+	var exitErr *exec.ExitError
+	if err := v.Err(); err == nil || errors.As(err, &exitErr) {
+		t.Fatalf("Err() = %v, want the error starting the process", err)
+	}
+}
+
+func TestChildProcessLivenessProbe(t *testing.T) {
+	t.Parallel()
+
+	v := newHelperProcess(t, ChildProcessLivenessProbe(10*time.Millisecond, 50*time.Millisecond))
+
+	// The probe succeeds while the process is responsive.
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-v.Done():
+		t.Fatalf("process killed by liveness probe: %v", v.Err())
+	default:
+	}
+
+	if err := v.Request("hang", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitDone(t, v)
+	if err := v.Err(); !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "liveness probe") {
+		t.Fatalf("Err() = %v, want liveness probe timeout", err)
+	}
+}
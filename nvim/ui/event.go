@@ -0,0 +1,654 @@
+package ui
+
+import (
+	"reflect"
+
+	"github.com/neovim/go-client/msgpack"
+	"github.com/neovim/go-client/nvim"
+)
+
+// Event is a redraw event. The dynamic type of an Event is a pointer to one
+// of the event types in this package.
+type Event interface {
+	// EventName returns the name of the event in the redraw notification,
+	// for example "grid_line".
+	EventName() string
+}
+
+// eventTypes maps the names of the redraw events to functions returning a new
+// event of the type.
+var eventTypes = map[string]func() Event{
+	"mode_info_set":        func() Event { return new(ModeInfoSet) },
+	"update_menu":          func() Event { return new(UpdateMenu) },
+	"busy_start":           func() Event { return new(BusyStart) },
+	"busy_stop":            func() Event { return new(BusyStop) },
+	"mouse_on":             func() Event { return new(MouseOn) },
+	"mouse_off":            func() Event { return new(MouseOff) },
+	"mode_change":          func() Event { return new(ModeChange) },
+	"bell":                 func() Event { return new(Bell) },
+	"visual_bell":          func() Event { return new(VisualBell) },
+	"flush":                func() Event { return new(Flush) },
+	"suspend":              func() Event { return new(Suspend) },
+	"set_title":            func() Event { return new(SetTitle) },
+	"set_icon":             func() Event { return new(SetIcon) },
+	"screenshot":           func() Event { return new(Screenshot) },
+	"option_set":           func() Event { return new(OptionSet) },
+	"chdir":                func() Event { return new(Chdir) },
+	"default_colors_set":   func() Event { return new(DefaultColorsSet) },
+	"hl_attr_define":       func() Event { return new(HLAttrDefine) },
+	"hl_group_set":         func() Event { return new(HLGroupSet) },
+	"grid_resize":          func() Event { return new(GridResize) },
+	"grid_clear":           func() Event { return new(GridClear) },
+	"grid_cursor_goto":     func() Event { return new(GridCursorGoto) },
+	"grid_line":            func() Event { return new(GridLine) },
+	"grid_scroll":          func() Event { return new(GridScroll) },
+	"grid_destroy":         func() Event { return new(GridDestroy) },
+	"win_pos":              func() Event { return new(WinPos) },
+	"win_float_pos":        func() Event { return new(WinFloatPos) },
+	"win_external_pos":     func() Event { return new(WinExternalPos) },
+	"win_hide":             func() Event { return new(WinHide) },
+	"win_close":            func() Event { return new(WinClose) },
+	"msg_set_pos":          func() Event { return new(MsgSetPos) },
+	"win_viewport":         func() Event { return new(WinViewport) },
+	"win_viewport_margins": func() Event { return new(WinViewportMargins) },
+	"win_extmark":          func() Event { return new(WinExtmark) },
+	"popupmenu_show":       func() Event { return new(PopupmenuShow) },
+	"popupmenu_select":     func() Event { return new(PopupmenuSelect) },
+	"popupmenu_hide":       func() Event { return new(PopupmenuHide) },
+	"tabline_update":       func() Event { return new(TablineUpdate) },
+	"cmdline_show":         func() Event { return new(CmdlineShow) },
+	"cmdline_pos":          func() Event { return new(CmdlinePos) },
+	"cmdline_special_char": func() Event { return new(CmdlineSpecialChar) },
+	"cmdline_hide":         func() Event { return new(CmdlineHide) },
+	"cmdline_block_show":   func() Event { return new(CmdlineBlockShow) },
+	"cmdline_block_append": func() Event { return new(CmdlineBlockAppend) },
+	"cmdline_block_hide":   func() Event { return new(CmdlineBlockHide) },
+	"msg_show":             func() Event { return new(MsgShow) },
+	"msg_clear":            func() Event { return new(MsgClear) },
+	"msg_showmode":         func() Event { return new(MsgShowmode) },
+	"msg_showcmd":          func() Event { return new(MsgShowcmd) },
+	"msg_ruler":            func() Event { return new(MsgRuler) },
+	"msg_history_show":     func() Event { return new(MsgHistoryShow) },
+	"msg_history_clear":    func() Event { return new(MsgHistoryClear) },
+}
+
+// Global events.
+//
+//	:help ui-global
+
+// ModeInfoSet is the "mode_info_set" event.
+type ModeInfoSet struct {
+	// CursorStyleEnabled is whether the UI should set the cursor style.
+	CursorStyleEnabled bool `msgpack:",array"`
+
+	// ModeInfo is the cursor style of each mode. ModeChange refers to the
+	// modes by index into ModeInfo.
+	ModeInfo []ModeInfo
+}
+
+// ModeInfo is the cursor style of a mode.
+type ModeInfo struct {
+	// CursorShape is "block", "horizontal" or "vertical".
+	CursorShape string `msgpack:"cursor_shape,omitempty"`
+
+	// CellPercentage is the size of the cursor in percent of the cell.
+	CellPercentage int `msgpack:"cell_percentage,omitempty"`
+
+	// BlinkWait, BlinkOn and BlinkOff are the blink timings in
+	// milliseconds.
+	BlinkWait int `msgpack:"blinkwait,omitempty"`
+	BlinkOn   int `msgpack:"blinkon,omitempty"`
+	BlinkOff  int `msgpack:"blinkoff,omitempty"`
+
+	// AttrID is the highlight attribute id of the cursor.
+	AttrID int `msgpack:"attr_id,omitempty"`
+
+	// AttrIDLM is the highlight attribute id of the cursor for language
+	// mappings.
+	AttrIDLM int `msgpack:"attr_id_lm,omitempty"`
+
+	// ShortName and Name are the names of the mode.
+	ShortName string `msgpack:"short_name,omitempty"`
+	Name      string `msgpack:"name,omitempty"`
+
+	// MouseShape is the mouse shape of the mode.
+	MouseShape int `msgpack:"mouse_shape,omitempty"`
+}
+
+// UpdateMenu is the "update_menu" event.
+type UpdateMenu struct{}
+
+// BusyStart is the "busy_start" event.
+type BusyStart struct{}
+
+// BusyStop is the "busy_stop" event.
+type BusyStop struct{}
+
+// MouseOn is the "mouse_on" event.
+type MouseOn struct{}
+
+// MouseOff is the "mouse_off" event.
+type MouseOff struct{}
+
+// ModeChange is the "mode_change" event.
+type ModeChange struct {
+	// Mode is the name of the mode.
+	Mode string `msgpack:",array"`
+
+	// ModeIdx is the index of the mode in the ModeInfo of ModeInfoSet.
+	ModeIdx int
+}
+
+// Bell is the "bell" event.
+type Bell struct{}
+
+// VisualBell is the "visual_bell" event.
+type VisualBell struct{}
+
+// Flush is the "flush" event. Nvim has finished a redraw and the UI should
+// display the screen state.
+type Flush struct{}
+
+// Suspend is the "suspend" event.
+type Suspend struct{}
+
+// SetTitle is the "set_title" event.
+type SetTitle struct {
+	Title string `msgpack:",array"`
+}
+
+// SetIcon is the "set_icon" event.
+type SetIcon struct {
+	Icon string `msgpack:",array"`
+}
+
+// Screenshot is the "screenshot" event.
+type Screenshot struct {
+	Path string `msgpack:",array"`
+}
+
+// OptionSet is the "option_set" event.
+type OptionSet struct {
+	Name  string `msgpack:",array"`
+	Value any
+}
+
+// Chdir is the "chdir" event.
+type Chdir struct {
+	Path string `msgpack:",array"`
+}
+
+// Grid events.
+//
+//	:help ui-linegrid
+
+// DefaultColorsSet is the "default_colors_set" event. The RGB colors are
+// 24-bit integers and the cterm colors are color indexes. A value of -1 is an
+// unknown color.
+type DefaultColorsSet struct {
+	RGBFg   int `msgpack:",array"`
+	RGBBg   int
+	RGBSp   int
+	CtermFg int
+	CtermBg int
+}
+
+// HLAttrDefine is the "hl_attr_define" event.
+type HLAttrDefine struct {
+	// ID is the highlight attribute id used in GridLine cells.
+	ID int `msgpack:",array"`
+
+	// RGBAttr is the attribute for RGB UIs.
+	RGBAttr HLAttr
+
+	// CtermAttr is the attribute for terminal UIs.
+	CtermAttr HLAttr
+
+	// Info is the highlight state with the ext_hlstate UI option.
+	Info []map[string]any
+}
+
+// HLAttr is a highlight attribute. The colors are -1 when the default color
+// is used.
+//
+//	:help ui-event-hl_attr_define
+type HLAttr struct {
+	Foreground    int    `msgpack:"foreground,omitempty" empty:"-1"`
+	Background    int    `msgpack:"background,omitempty" empty:"-1"`
+	Special       int    `msgpack:"special,omitempty" empty:"-1"`
+	Reverse       bool   `msgpack:"reverse,omitempty"`
+	Italic        bool   `msgpack:"italic,omitempty"`
+	Bold          bool   `msgpack:"bold,omitempty"`
+	Strikethrough bool   `msgpack:"strikethrough,omitempty"`
+	Underline     bool   `msgpack:"underline,omitempty"`
+	Undercurl     bool   `msgpack:"undercurl,omitempty"`
+	Underdouble   bool   `msgpack:"underdouble,omitempty"`
+	Underdotted   bool   `msgpack:"underdotted,omitempty"`
+	Underdashed   bool   `msgpack:"underdashed,omitempty"`
+	Altfont       bool   `msgpack:"altfont,omitempty"`
+	Nocombine     bool   `msgpack:"nocombine,omitempty"`
+	Blend         int    `msgpack:"blend,omitempty"`
+	URL           string `msgpack:"url,omitempty"`
+}
+
+// HLGroupSet is the "hl_group_set" event.
+type HLGroupSet struct {
+	Name string `msgpack:",array"`
+	ID   int
+}
+
+// GridResize is the "grid_resize" event.
+type GridResize struct {
+	Grid   int `msgpack:",array"`
+	Width  int
+	Height int
+}
+
+// GridClear is the "grid_clear" event.
+type GridClear struct {
+	Grid int `msgpack:",array"`
+}
+
+// GridCursorGoto is the "grid_cursor_goto" event.
+type GridCursorGoto struct {
+	Grid int `msgpack:",array"`
+	Row  int
+	Col  int
+}
+
+// GridLine is the "grid_line" event.
+type GridLine struct {
+	Grid     int `msgpack:",array"`
+	Row      int
+	ColStart int
+
+	// Cells are the cells starting at ColStart. The HLID of each cell is
+	// set; cells that omit the highlight id in the event use the highlight
+	// id of the previous cell.
+	Cells []Cell
+
+	// Wrap is whether the line wraps into the next row.
+	Wrap bool
+}
+
+// Cell is a run of cells in a GridLine event.
+type Cell struct {
+	// Text is the text of the cell. The cell after a double-width character
+	// has the empty text.
+	Text string
+
+	// HLID is the highlight attribute id of the cell.
+	HLID int
+
+	// Repeat is the number of times the cell is repeated.
+	Repeat int
+}
+
+var cellType = reflect.TypeOf(Cell{})
+
+// UnmarshalMsgPack implements msgpack.Unmarshaler. A cell is an array of the
+// text, the optional highlight id and the optional repeat count. HLID is -1
+// when the highlight id is omitted.
+func (c *Cell) UnmarshalMsgPack(dec *msgpack.Decoder) error {
+	*c = Cell{HLID: -1, Repeat: 1}
+	if dec.Type() != msgpack.ArrayLen {
+		return &msgpack.DecodeConvertError{SrcType: dec.Type(), DestType: cellType}
+	}
+
+	n := dec.Len()
+	for i := 0; i < n; i++ {
+		if err := dec.Unpack(); err != nil {
+			return err
+		}
+		switch {
+		case i == 0 && (dec.Type() == msgpack.String || dec.Type() == msgpack.Binary):
+			c.Text = dec.String()
+		case i == 1 && (dec.Type() == msgpack.Int || dec.Type() == msgpack.Uint):
+			c.HLID = int(dec.Int())
+		case i == 2 && (dec.Type() == msgpack.Int || dec.Type() == msgpack.Uint):
+			c.Repeat = int(dec.Int())
+		default:
+			if err := dec.Skip(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fillHLIDs sets the omitted highlight ids of the cells.
+func (e *GridLine) fillHLIDs() {
+	hlID := 0
+	for i := range e.Cells {
+		if e.Cells[i].HLID < 0 {
+			e.Cells[i].HLID = hlID
+		}
+		hlID = e.Cells[i].HLID
+	}
+}
+
+// GridScroll is the "grid_scroll" event. The region from rows Top to Bot and
+// columns Left to Right, exclusive of Bot and Right, is scrolled up by Rows,
+// or down if Rows is negative. Cols is always zero.
+type GridScroll struct {
+	Grid  int `msgpack:",array"`
+	Top   int
+	Bot   int
+	Left  int
+	Right int
+	Rows  int
+	Cols  int
+}
+
+// GridDestroy is the "grid_destroy" event.
+type GridDestroy struct {
+	Grid int `msgpack:",array"`
+}
+
+// Multigrid events.
+//
+//	:help ui-multigrid
+
+// WinPos is the "win_pos" event.
+type WinPos struct {
+	Grid     int `msgpack:",array"`
+	Win      nvim.Window
+	StartRow int
+	StartCol int
+	Width    int
+	Height   int
+}
+
+// WinFloatPos is the "win_float_pos" event.
+type WinFloatPos struct {
+	Grid int `msgpack:",array"`
+	Win  nvim.Window
+
+	// Anchor is the corner of the float placed at AnchorRow and AnchorCol:
+	// "NW", "NE", "SW" or "SE".
+	Anchor     string
+	AnchorGrid int
+	AnchorRow  float64
+	AnchorCol  float64
+
+	// MouseEnabled is whether the float receives mouse events.
+	MouseEnabled bool
+
+	// ZIndex is the stacking order of the float.
+	ZIndex int
+
+	// CompIndex is the order in which the float is composited.
+	CompIndex int
+
+	// ScreenRow and ScreenCol are the position of the float on the screen.
+	ScreenRow int
+	ScreenCol int
+}
+
+// WinExternalPos is the "win_external_pos" event.
+type WinExternalPos struct {
+	Grid int `msgpack:",array"`
+	Win  nvim.Window
+}
+
+// WinHide is the "win_hide" event.
+type WinHide struct {
+	Grid int `msgpack:",array"`
+}
+
+// WinClose is the "win_close" event.
+type WinClose struct {
+	Grid int `msgpack:",array"`
+}
+
+// MsgSetPos is the "msg_set_pos" event.
+type MsgSetPos struct {
+	Grid      int `msgpack:",array"`
+	Row       int
+	Scrolled  bool
+	SepChar   string
+	ZIndex    int
+	CompIndex int
+}
+
+// WinViewport is the "win_viewport" event.
+type WinViewport struct {
+	Grid        int `msgpack:",array"`
+	Win         nvim.Window
+	Topline     int
+	Botline     int
+	Curline     int
+	Curcol      int
+	LineCount   int
+	ScrollDelta int
+}
+
+// WinViewportMargins is the "win_viewport_margins" event.
+type WinViewportMargins struct {
+	Grid   int `msgpack:",array"`
+	Win    nvim.Window
+	Top    int
+	Bottom int
+	Left   int
+	Right  int
+}
+
+// WinExtmark is the "win_extmark" event.
+type WinExtmark struct {
+	Grid   int `msgpack:",array"`
+	Win    nvim.Window
+	NSID   int
+	MarkID int
+	Row    int
+	Col    int
+}
+
+// Popupmenu events.
+//
+//	:help ui-popupmenu
+
+// PopupmenuShow is the "popupmenu_show" event.
+type PopupmenuShow struct {
+	Items []PopupmenuItem `msgpack:",array"`
+
+	// Selected is the index of the selected item, or -1.
+	Selected int
+	Row      int
+	Col      int
+	Grid     int
+}
+
+// PopupmenuItem is an item of the popupmenu.
+type PopupmenuItem struct {
+	Word string `msgpack:",array"`
+	Kind string
+	Menu string
+	Info string
+}
+
+// PopupmenuSelect is the "popupmenu_select" event.
+type PopupmenuSelect struct {
+	Selected int `msgpack:",array"`
+}
+
+// PopupmenuHide is the "popupmenu_hide" event.
+type PopupmenuHide struct{}
+
+// Tabline events.
+//
+//	:help ui-tabline
+
+// TablineUpdate is the "tabline_update" event.
+type TablineUpdate struct {
+	Curtab  nvim.Tabpage `msgpack:",array"`
+	Tabs    []TablineTab
+	Curbuf  nvim.Buffer
+	Buffers []TablineBuffer
+}
+
+// TablineTab is a tab of the tabline.
+type TablineTab struct {
+	Tab  nvim.Tabpage `msgpack:"tab"`
+	Name string       `msgpack:"name"`
+}
+
+// TablineBuffer is a buffer of the tabline.
+type TablineBuffer struct {
+	Buffer nvim.Buffer `msgpack:"buffer"`
+	Name   string      `msgpack:"name"`
+}
+
+// Cmdline events.
+//
+//	:help ui-cmdline
+
+// Chunk is a highlighted chunk of text in cmdline and message events.
+type Chunk struct {
+	AttrID int `msgpack:",array"`
+	Text   string
+	HLID   int
+}
+
+// CmdlineShow is the "cmdline_show" event.
+type CmdlineShow struct {
+	Content   []Chunk `msgpack:",array"`
+	Pos       int
+	FirstChar string
+	Prompt    string
+	Indent    int
+	Level     int
+	HLID      int
+}
+
+// CmdlinePos is the "cmdline_pos" event.
+type CmdlinePos struct {
+	Pos   int `msgpack:",array"`
+	Level int
+}
+
+// CmdlineSpecialChar is the "cmdline_special_char" event.
+type CmdlineSpecialChar struct {
+	Char  string `msgpack:",array"`
+	Shift bool
+	Level int
+}
+
+// CmdlineHide is the "cmdline_hide" event.
+type CmdlineHide struct {
+	Level int `msgpack:",array"`
+	Abort bool
+}
+
+// CmdlineBlockShow is the "cmdline_block_show" event.
+type CmdlineBlockShow struct {
+	Lines [][]Chunk `msgpack:",array"`
+}
+
+// CmdlineBlockAppend is the "cmdline_block_append" event.
+type CmdlineBlockAppend struct {
+	Line []Chunk `msgpack:",array"`
+}
+
+// CmdlineBlockHide is the "cmdline_block_hide" event.
+type CmdlineBlockHide struct{}
+
+// Message events.
+//
+//	:help ui-messages
+
+// MsgShow is the "msg_show" event.
+type MsgShow struct {
+	Kind        string `msgpack:",array"`
+	Content     []Chunk
+	ReplaceLast bool
+	History     bool
+	Append      bool
+}
+
+// MsgClear is the "msg_clear" event.
+type MsgClear struct{}
+
+// MsgShowmode is the "msg_showmode" event.
+type MsgShowmode struct {
+	Content []Chunk `msgpack:",array"`
+}
+
+// MsgShowcmd is the "msg_showcmd" event.
+type MsgShowcmd struct {
+	Content []Chunk `msgpack:",array"`
+}
+
+// MsgRuler is the "msg_ruler" event.
+type MsgRuler struct {
+	Content []Chunk `msgpack:",array"`
+}
+
+// MsgHistoryShow is the "msg_history_show" event.
+type MsgHistoryShow struct {
+	Entries []MsgHistoryEntry `msgpack:",array"`
+	PrevCmd bool
+}
+
+// MsgHistoryEntry is an entry of the message history.
+type MsgHistoryEntry struct {
+	Kind    string `msgpack:",array"`
+	Content []Chunk
+	Append  bool
+}
+
+// MsgHistoryClear is the "msg_history_clear" event.
+type MsgHistoryClear struct{}
+
+// EventName implements Event.
+func (*ModeInfoSet) EventName() string        { return "mode_info_set" }
+func (*UpdateMenu) EventName() string         { return "update_menu" }
+func (*BusyStart) EventName() string          { return "busy_start" }
+func (*BusyStop) EventName() string           { return "busy_stop" }
+func (*MouseOn) EventName() string            { return "mouse_on" }
+func (*MouseOff) EventName() string           { return "mouse_off" }
+func (*ModeChange) EventName() string         { return "mode_change" }
+func (*Bell) EventName() string               { return "bell" }
+func (*VisualBell) EventName() string         { return "visual_bell" }
+func (*Flush) EventName() string              { return "flush" }
+func (*Suspend) EventName() string            { return "suspend" }
+func (*SetTitle) EventName() string           { return "set_title" }
+func (*SetIcon) EventName() string            { return "set_icon" }
+func (*Screenshot) EventName() string         { return "screenshot" }
+func (*OptionSet) EventName() string          { return "option_set" }
+func (*Chdir) EventName() string              { return "chdir" }
+func (*DefaultColorsSet) EventName() string   { return "default_colors_set" }
+func (*HLAttrDefine) EventName() string       { return "hl_attr_define" }
+func (*HLGroupSet) EventName() string         { return "hl_group_set" }
+func (*GridResize) EventName() string         { return "grid_resize" }
+func (*GridClear) EventName() string          { return "grid_clear" }
+func (*GridCursorGoto) EventName() string     { return "grid_cursor_goto" }
+func (*GridLine) EventName() string           { return "grid_line" }
+func (*GridScroll) EventName() string         { return "grid_scroll" }
+func (*GridDestroy) EventName() string        { return "grid_destroy" }
+func (*WinPos) EventName() string             { return "win_pos" }
+func (*WinFloatPos) EventName() string        { return "win_float_pos" }
+func (*WinExternalPos) EventName() string     { return "win_external_pos" }
+func (*WinHide) EventName() string            { return "win_hide" }
+func (*WinClose) EventName() string           { return "win_close" }
+func (*MsgSetPos) EventName() string          { return "msg_set_pos" }
+func (*WinViewport) EventName() string        { return "win_viewport" }
+func (*WinViewportMargins) EventName() string { return "win_viewport_margins" }
+func (*WinExtmark) EventName() string         { return "win_extmark" }
+func (*PopupmenuShow) EventName() string      { return "popupmenu_show" }
+func (*PopupmenuSelect) EventName() string    { return "popupmenu_select" }
+func (*PopupmenuHide) EventName() string      { return "popupmenu_hide" }
+func (*TablineUpdate) EventName() string      { return "tabline_update" }
+func (*CmdlineShow) EventName() string        { return "cmdline_show" }
+func (*CmdlinePos) EventName() string         { return "cmdline_pos" }
+func (*CmdlineSpecialChar) EventName() string { return "cmdline_special_char" }
+func (*CmdlineHide) EventName() string        { return "cmdline_hide" }
+func (*CmdlineBlockShow) EventName() string   { return "cmdline_block_show" }
+func (*CmdlineBlockAppend) EventName() string { return "cmdline_block_append" }
+func (*CmdlineBlockHide) EventName() string   { return "cmdline_block_hide" }
+func (*MsgShow) EventName() string            { return "msg_show" }
+func (*MsgClear) EventName() string           { return "msg_clear" }
+func (*MsgShowmode) EventName() string        { return "msg_showmode" }
+func (*MsgShowcmd) EventName() string         { return "msg_showcmd" }
+func (*MsgRuler) EventName() string           { return "msg_ruler" }
+func (*MsgHistoryShow) EventName() string     { return "msg_history_show" }
+func (*MsgHistoryClear) EventName() string    { return "msg_history_clear" }
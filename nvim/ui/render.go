@@ -0,0 +1,332 @@
+package ui
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Format is an output format of Render.
+type Format int
+
+// list of render formats.
+const (
+	// FormatText is plain text.
+	FormatText Format = iota
+
+	// FormatANSI is text with 24-bit color ANSI escape sequences.
+	FormatANSI
+
+	// FormatANSI256 is text with 256-color ANSI escape sequences. RGB
+	// colors are approximated by the colors of the xterm 256-color
+	// palette.
+	FormatANSI256
+
+	// FormatHTML is an HTML table.
+	FormatHTML
+)
+
+// String returns a string representation of the Format.
+func (f Format) String() string {
+	switch f {
+	case FormatText:
+		return "Text"
+	case FormatANSI:
+		return "ANSI"
+	case FormatANSI256:
+		return "ANSI256"
+	case FormatHTML:
+		return "HTML"
+	default:
+		return "unknown Format"
+	}
+}
+
+// RenderOption specifies an option for Render.
+type RenderOption struct {
+	f func(*renderOptions)
+}
+
+type renderOptions struct {
+	cursorMarker string
+}
+
+// RenderCursor specifies a marker written before the cell of the cursor. In
+// the ANSI and HTML formats, the cell of the cursor is also drawn in reverse
+// video. The cursor is not rendered by default, or when the cursor is on a
+// grid that is not composited on the screen.
+func RenderCursor(marker string) RenderOption {
+	return RenderOption{func(ros *renderOptions) {
+		ros.cursorMarker = marker
+	}}
+}
+
+// Render writes the cells of snap to w in the format. The RGB highlight
+// attributes and default colors of snap are used for colors. Each row is
+// terminated by a newline in the text formats.
+func Render(w io.Writer, snap *Snapshot, format Format, options ...RenderOption) error {
+	var ros renderOptions
+	for _, o := range options {
+		o.f(&ros)
+	}
+	r := &renderer{snap: snap, ros: ros, format: format}
+
+	switch format {
+	case FormatText, FormatANSI, FormatANSI256:
+		r.text()
+	case FormatHTML:
+		r.html()
+	default:
+		return fmt.Errorf("ui: unknown render format %v", format)
+	}
+	_, err := io.WriteString(w, r.b.String())
+	return err
+}
+
+// String returns the cells of snap as plain text.
+func (snap *Snapshot) String() string {
+	var b strings.Builder
+	Render(&b, snap, FormatText)
+	return b.String()
+}
+
+// cellStyle is the resolved style of a cell. The colors are -1 for the
+// default color of the terminal.
+type cellStyle struct {
+	fg, bg        int
+	bold          bool
+	italic        bool
+	underline     bool
+	reverse       bool
+	strikethrough bool
+}
+
+type renderer struct {
+	snap   *Snapshot
+	ros    renderOptions
+	format Format
+	b      strings.Builder
+}
+
+// style returns the style of the cell at row and col.
+func (r *renderer) style(row, col int) cellStyle {
+	id := r.snap.Cells[row][col].HLID
+	attr, ok := r.snap.HLAttrs[id]
+	if !ok {
+		attr = HLAttr{Foreground: -1, Background: -1, Special: -1}
+	}
+
+	st := cellStyle{
+		fg:            attr.Foreground,
+		bg:            attr.Background,
+		bold:          attr.Bold,
+		italic:        attr.Italic,
+		underline:     attr.Underline || attr.Undercurl || attr.Underdouble || attr.Underdotted || attr.Underdashed,
+		reverse:       attr.Reverse,
+		strikethrough: attr.Strikethrough,
+	}
+	if st.fg < 0 {
+		st.fg = r.snap.DefaultColors.RGBFg
+	}
+	if st.bg < 0 {
+		st.bg = r.snap.DefaultColors.RGBBg
+	}
+	if r.isCursor(row, col) {
+		st.reverse = !st.reverse
+	}
+	return st
+}
+
+// isCursor reports whether the cursor is rendered at row and col.
+func (r *renderer) isCursor(row, col int) bool {
+	c := r.snap.Cursor
+	return r.ros.cursorMarker != "" && r.snap.cursorOnScreen && c.Row == row && c.Col == col
+}
+
+// text renders the text formats.
+func (r *renderer) text() {
+	color := r.format != FormatText
+	for row, cells := range r.snap.Cells {
+		var prev cellStyle
+		for col, c := range cells {
+			if r.isCursor(row, col) {
+				r.b.WriteString(r.ros.cursorMarker)
+			}
+			if color {
+				if st := r.style(row, col); col == 0 || st != prev {
+					r.sgr(st)
+					prev = st
+				}
+			}
+			r.b.WriteString(c.Text)
+		}
+		if color && len(cells) > 0 {
+			r.b.WriteString("\x1b[0m")
+		}
+		r.b.WriteByte('\n')
+	}
+}
+
+// sgr writes the escape sequence selecting st.
+func (r *renderer) sgr(st cellStyle) {
+	params := []string{"0"}
+	if st.bold {
+		params = append(params, "1")
+	}
+	if st.italic {
+		params = append(params, "3")
+	}
+	if st.underline {
+		params = append(params, "4")
+	}
+	if st.reverse {
+		params = append(params, "7")
+	}
+	if st.strikethrough {
+		params = append(params, "9")
+	}
+	params = append(params, r.color(38, st.fg)...)
+	params = append(params, r.color(48, st.bg)...)
+	r.b.WriteString("\x1b[" + strings.Join(params, ";") + "m")
+}
+
+// color returns the parameters selecting the RGB color c as the foreground
+// (38) or background (48) color.
+func (r *renderer) color(base, c int) []string {
+	if c < 0 {
+		return nil
+	}
+	if r.format == FormatANSI256 {
+		return []string{strconv.Itoa(base), "5", strconv.Itoa(rgbTo256(c))}
+	}
+	return []string{
+		strconv.Itoa(base), "2",
+		strconv.Itoa(c >> 16 & 0xff),
+		strconv.Itoa(c >> 8 & 0xff),
+		strconv.Itoa(c & 0xff),
+	}
+}
+
+// cubeLevels are the levels of the color components of the 6x6x6 color cube
+// of the xterm 256-color palette.
+var cubeLevels = [6]int{0, 0x5f, 0x87, 0xaf, 0xd7, 0xff}
+
+// rgbTo256 returns the index of the color of the xterm 256-color palette
+// closest to the RGB color c.
+func rgbTo256(c int) int {
+	r, g, b := c>>16&0xff, c>>8&0xff, c&0xff
+
+	ri, gi, bi := cubeIndex(r), cubeIndex(g), cubeIndex(b)
+	cube := 16 + 36*ri + 6*gi + bi
+	cubeDist := colorDist(r, g, b, cubeLevels[ri], cubeLevels[gi], cubeLevels[bi])
+
+	// The gray ramp 232-255 has the levels 8, 18, ..., 238.
+	avg := (r + g + b) / 3
+	gi2 := (avg - 3) / 10
+	if gi2 < 0 {
+		gi2 = 0
+	} else if gi2 > 23 {
+		gi2 = 23
+	}
+	level := 8 + 10*gi2
+	if colorDist(r, g, b, level, level, level) < cubeDist {
+		return 232 + gi2
+	}
+	return cube
+}
+
+// cubeIndex returns the index of the cube level closest to v.
+func cubeIndex(v int) int {
+	if v < 48 {
+		return 0
+	}
+	if v < 115 {
+		return 1
+	}
+	return (v - 35) / 40
+}
+
+func colorDist(r1, g1, b1, r2, g2, b2 int) int {
+	dr, dg, db := r1-r2, g1-g2, b1-b2
+	return dr*dr + dg*dg + db*db
+}
+
+// html renders the HTML format. Each row is a table row with a cell that
+// contains a span for each run of cells with the same style.
+func (r *renderer) html() {
+	fg, bg := r.snap.DefaultColors.RGBFg, r.snap.DefaultColors.RGBBg
+	if fg < 0 {
+		fg = 0x000000
+	}
+	if bg < 0 {
+		bg = 0xffffff
+	}
+
+	fmt.Fprintf(&r.b, "<table style=\"border-collapse: collapse; font-family: monospace; white-space: pre; color: %s; background-color: %s\">\n", hexColor(fg), hexColor(bg))
+	for row, cells := range r.snap.Cells {
+		r.b.WriteString("<tr><td>")
+		var (
+			prev cellStyle
+			open bool
+		)
+		for col, c := range cells {
+			if r.isCursor(row, col) {
+				if open {
+					r.b.WriteString("</span>")
+					open = false
+				}
+				r.b.WriteString(html.EscapeString(r.ros.cursorMarker))
+			}
+			if st := r.style(row, col); !open || st != prev {
+				if open {
+					r.b.WriteString("</span>")
+				}
+				r.b.WriteString("<span style=\"" + cssStyle(st, fg, bg) + "\">")
+				prev, open = st, true
+			}
+			r.b.WriteString(html.EscapeString(c.Text))
+		}
+		if open {
+			r.b.WriteString("</span>")
+		}
+		r.b.WriteString("</td></tr>\n")
+	}
+	r.b.WriteString("</table>\n")
+}
+
+// cssStyle returns the CSS declarations of st. The colors fg and bg replace
+// the default colors.
+func cssStyle(st cellStyle, fg, bg int) string {
+	if st.fg >= 0 {
+		fg = st.fg
+	}
+	if st.bg >= 0 {
+		bg = st.bg
+	}
+	if st.reverse {
+		fg, bg = bg, fg
+	}
+
+	decls := []string{"color: " + hexColor(fg), "background-color: " + hexColor(bg)}
+	if st.bold {
+		decls = append(decls, "font-weight: bold")
+	}
+	if st.italic {
+		decls = append(decls, "font-style: italic")
+	}
+	switch {
+	case st.underline && st.strikethrough:
+		decls = append(decls, "text-decoration: underline line-through")
+	case st.underline:
+		decls = append(decls, "text-decoration: underline")
+	case st.strikethrough:
+		decls = append(decls, "text-decoration: line-through")
+	}
+	return strings.Join(decls, "; ")
+}
+
+func hexColor(c int) string {
+	return fmt.Sprintf("#%06x", c&0xffffff)
+}
@@ -0,0 +1,112 @@
+package ui
+
+import (
+	"strings"
+	"testing"
+)
+
+func renderScreen() *Snapshot {
+	s := NewScreen()
+	handleEvents(s,
+		&DefaultColorsSet{RGBFg: 0xffffff, RGBBg: 0x000000, RGBSp: -1, CtermFg: -1, CtermBg: -1},
+		&HLAttrDefine{ID: 1, RGBAttr: HLAttr{Foreground: 0xff0000, Background: -1, Special: -1, Bold: true}},
+		&HLAttrDefine{ID: 2, RGBAttr: HLAttr{Foreground: -1, Background: 0x0000ff, Special: -1, Underline: true}},
+		&GridResize{Grid: 1, Width: 4, Height: 2},
+		line(1, 0, 0, "ab", 1),
+		line(1, 0, 2, "<&", 0),
+		line(1, 1, 0, "cd", 2),
+		&GridCursorGoto{Grid: 1, Row: 1, Col: 1},
+	)
+	return s.Snapshot()
+}
+
+func TestRender(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		format  Format
+		options []RenderOption
+		want    string
+	}{
+		"Text": {
+			format: FormatText,
+			want:   "ab<&\ncd  \n",
+		},
+		"TextCursor": {
+			format:  FormatText,
+			options: []RenderOption{RenderCursor("|")},
+			want:    "ab<&\nc|d  \n",
+		},
+		"ANSI": {
+			format: FormatANSI,
+			want: "\x1b[0;1;38;2;255;0;0;48;2;0;0;0mab\x1b[0;38;2;255;255;255;48;2;0;0;0m<&\x1b[0m\n" +
+				"\x1b[0;4;38;2;255;255;255;48;2;0;0;255mcd\x1b[0;38;2;255;255;255;48;2;0;0;0m  \x1b[0m\n",
+		},
+		"ANSI256NoCursor": {
+			format:  FormatANSI256,
+			options: []RenderOption{RenderCursor("")},
+			want: "\x1b[0;1;38;5;196;48;5;16mab\x1b[0;38;5;231;48;5;16m<&\x1b[0m\n" +
+				"\x1b[0;4;38;5;231;48;5;21mcd\x1b[0;38;5;231;48;5;16m  \x1b[0m\n",
+		},
+		"ANSI256": {
+			format:  FormatANSI256,
+			options: []RenderOption{RenderCursor("|")},
+			want: "\x1b[0;1;38;5;196;48;5;16mab\x1b[0;38;5;231;48;5;16m<&\x1b[0m\n" +
+				"\x1b[0;4;38;5;231;48;5;21mc|\x1b[0;4;7;38;5;231;48;5;21md\x1b[0;38;5;231;48;5;16m  \x1b[0m\n",
+		},
+		"HTML": {
+			format:  FormatHTML,
+			options: []RenderOption{RenderCursor("|")},
+			want: `<table style="border-collapse: collapse; font-family: monospace; white-space: pre; color: #ffffff; background-color: #000000">
+<tr><td><span style="color: #ff0000; background-color: #000000; font-weight: bold">ab</span><span style="color: #ffffff; background-color: #000000">&lt;&amp;</span></td></tr>
+<tr><td><span style="color: #ffffff; background-color: #0000ff; text-decoration: underline">c</span>|<span style="color: #0000ff; background-color: #ffffff; text-decoration: underline">d</span><span style="color: #ffffff; background-color: #000000">  </span></td></tr>
+</table>
+`,
+		},
+	}
+	snap := renderScreen()
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var b strings.Builder
+			if err := Render(&b, snap, tt.format, tt.options...); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.String(); got != tt.want {
+				t.Fatalf("got\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+
+	if got, want := snap.String(), "ab<&\ncd  \n"; got != want {
+		t.Fatalf("String() = %q, want %q", got, want)
+	}
+	if err := Render(&strings.Builder{}, snap, Format(-1)); err == nil {
+		t.Fatal("Render with unknown format returned nil error")
+	}
+}
+
+func TestRGBTo256(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		rgb  int
+		want int
+	}{
+		{0x000000, 16},
+		{0xffffff, 231},
+		{0xff0000, 196},
+		{0x00ff00, 46},
+		{0x0000ff, 21},
+		{0x5f87af, 67},
+		{0x808080, 244},
+		{0x121212, 233},
+	}
+	for _, tt := range tests {
+		if got := rgbTo256(tt.rgb); got != tt.want {
+			t.Errorf("rgbTo256(%#06x) = %d, want %d", tt.rgb, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,502 @@
+package ui
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/neovim/go-client/nvim"
+)
+
+// ScreenCell is a cell of a grid.
+type ScreenCell struct {
+	// Text is the text of the cell. The cell after a double-width character
+	// has the empty text.
+	Text string
+
+	// HLID is the highlight attribute id of the cell. The id 0 is the
+	// default highlight.
+	HLID int
+}
+
+// Grid is a grid of cells. Grid 1 is the global grid. With the
+// ext_multigrid UI option, each window is drawn on its own grid.
+type Grid struct {
+	ID     int
+	Width  int
+	Height int
+
+	// Cells are the rows of the grid.
+	Cells [][]ScreenCell
+}
+
+// Placement is the position of a grid on the screen.
+type Placement struct {
+	Grid int
+	Win  nvim.Window
+
+	// Row and Col are the position of the top left corner of the grid on
+	// the global grid.
+	Row int
+	Col int
+
+	// Float is whether the grid is a floating window. Message is whether
+	// the grid is the message grid. Floats and the message grid are drawn
+	// over the windows in the order of ZIndex.
+	Float   bool
+	Message bool
+	ZIndex  int
+
+	// Hidden is whether the grid is hidden. External is whether the grid is
+	// shown in an external window. Hidden and external grids are not
+	// composited on the screen.
+	Hidden   bool
+	External bool
+}
+
+// Cursor is the position of the cursor.
+type Cursor struct {
+	// Grid is the grid of the cursor.
+	Grid int
+
+	// Row and Col are the position of the cursor on the grid.
+	Row int
+	Col int
+}
+
+// messageZIndex is the z-index of the message grid.
+const messageZIndex = 200
+
+// ScreenOption specifies an option for a Screen.
+type ScreenOption struct {
+	f func(*Screen)
+}
+
+// ScreenFlushFunc specifies a function called with a snapshot of the screen
+// after each flush event. The function is called from the goroutine that
+// handles the events.
+func ScreenFlushFunc(f func(*Snapshot)) ScreenOption {
+	return ScreenOption{func(s *Screen) {
+		s.onFlush = f
+	}}
+}
+
+// Screen is a model of the screen of a linegrid UI. Register the screen as
+// the Handler of the redraw events:
+//
+//	s := ui.NewScreen()
+//	err := ui.Register(v, s)
+//	...
+//	err = v.AttachUI(80, 24, map[string]any{"rgb": true, "ext_linegrid": true})
+//
+// The screen maintains the grids, the highlight attributes, the cursor and
+// the placement of window grids with the ext_multigrid UI option. It is safe
+// to call Screen methods concurrently with the handling of events.
+type Screen struct {
+	onFlush func(*Snapshot)
+
+	mu            sync.Mutex
+	grids         map[int]*Grid
+	placements    map[int]*Placement
+	hlAttrs       map[int]HLAttr
+	ctermAttrs    map[int]HLAttr
+	hlGroups      map[string]int
+	defaultColors DefaultColorsSet
+	cursor        Cursor
+	modeInfo      []ModeInfo
+	mode          string
+	modeIdx       int
+	options       map[string]any
+	title         string
+	flushes       int
+}
+
+// compile time check whether the Screen implements Handler interface.
+var _ Handler = (*Screen)(nil)
+
+// NewScreen returns a new screen.
+func NewScreen(options ...ScreenOption) *Screen {
+	s := &Screen{
+		grids:      make(map[int]*Grid),
+		placements: make(map[int]*Placement),
+		hlAttrs:    make(map[int]HLAttr),
+		ctermAttrs: make(map[int]HLAttr),
+		hlGroups:   make(map[string]int),
+		options:    make(map[string]any),
+		defaultColors: DefaultColorsSet{
+			RGBFg:   -1,
+			RGBBg:   -1,
+			RGBSp:   -1,
+			CtermFg: -1,
+			CtermBg: -1,
+		},
+	}
+	for _, o := range options {
+		o.f(s)
+	}
+	return s
+}
+
+// HandleEvent implements Handler.
+func (s *Screen) HandleEvent(e Event) {
+	s.mu.Lock()
+	s.handle(e)
+	var snap *Snapshot
+	if _, ok := e.(*Flush); ok {
+		s.flushes++
+		if s.onFlush != nil {
+			snap = s.snapshot()
+		}
+	}
+	s.mu.Unlock()
+
+	if snap != nil {
+		s.onFlush(snap)
+	}
+}
+
+// handle applies e to the screen. The caller must hold s.mu.
+func (s *Screen) handle(e Event) {
+	switch e := e.(type) {
+	case *GridResize:
+		s.resizeGrid(e.Grid, e.Width, e.Height)
+	case *GridClear:
+		if g := s.grids[e.Grid]; g != nil {
+			for _, row := range g.Cells {
+				clearCells(row)
+			}
+		}
+	case *GridDestroy:
+		delete(s.grids, e.Grid)
+		delete(s.placements, e.Grid)
+	case *GridCursorGoto:
+		s.cursor = Cursor{Grid: e.Grid, Row: e.Row, Col: e.Col}
+	case *GridLine:
+		s.drawLine(e)
+	case *GridScroll:
+		s.scroll(e)
+	case *HLAttrDefine:
+		s.hlAttrs[e.ID] = e.RGBAttr
+		s.ctermAttrs[e.ID] = e.CtermAttr
+	case *HLGroupSet:
+		s.hlGroups[e.Name] = e.ID
+	case *DefaultColorsSet:
+		s.defaultColors = *e
+	case *ModeInfoSet:
+		s.modeInfo = e.ModeInfo
+	case *ModeChange:
+		s.mode = e.Mode
+		s.modeIdx = e.ModeIdx
+	case *OptionSet:
+		s.options[e.Name] = e.Value
+	case *SetTitle:
+		s.title = e.Title
+	case *WinPos:
+		s.placements[e.Grid] = &Placement{Grid: e.Grid, Win: e.Win, Row: e.StartRow, Col: e.StartCol}
+	case *WinFloatPos:
+		s.placeFloat(e)
+	case *WinExternalPos:
+		s.placements[e.Grid] = &Placement{Grid: e.Grid, Win: e.Win, External: true}
+	case *WinHide:
+		if p := s.placements[e.Grid]; p != nil {
+			p.Hidden = true
+		}
+	case *WinClose:
+		delete(s.placements, e.Grid)
+	case *MsgSetPos:
+		zindex := e.ZIndex
+		if zindex == 0 {
+			// Nvim before 0.10 does not send the z-index.
+			zindex = messageZIndex
+		}
+		s.placements[e.Grid] = &Placement{Grid: e.Grid, Row: e.Row, Message: true, ZIndex: zindex}
+	}
+}
+
+// resizeGrid resizes or creates a grid. The cells inside the new size are
+// kept.
+func (s *Screen) resizeGrid(id, width, height int) {
+	if width < 0 {
+		width = 0
+	}
+	if height < 0 {
+		height = 0
+	}
+
+	g := s.grids[id]
+	if g == nil {
+		g = &Grid{ID: id}
+		s.grids[id] = g
+	}
+	cells := make([][]ScreenCell, height)
+	for i := range cells {
+		cells[i] = make([]ScreenCell, width)
+		clearCells(cells[i])
+		if i < len(g.Cells) {
+			copy(cells[i], g.Cells[i])
+		}
+	}
+	g.Width, g.Height, g.Cells = width, height, cells
+}
+
+func clearCells(row []ScreenCell) {
+	for i := range row {
+		row[i] = ScreenCell{Text: " "}
+	}
+}
+
+// drawLine draws the cells of e. Cells outside the grid are ignored.
+func (s *Screen) drawLine(e *GridLine) {
+	g := s.grids[e.Grid]
+	if g == nil || e.Row < 0 || e.Row >= g.Height {
+		return
+	}
+	row := g.Cells[e.Row]
+	col := e.ColStart
+	for _, c := range e.Cells {
+		for i := 0; i < c.Repeat && col < len(row); i++ {
+			if col >= 0 {
+				row[col] = ScreenCell{Text: c.Text, HLID: c.HLID}
+			}
+			col++
+		}
+	}
+}
+
+// scroll moves the rows of the scroll region of e. The rows scrolled into the
+// region keep their cells until Nvim draws them.
+func (s *Screen) scroll(e *GridScroll) {
+	g := s.grids[e.Grid]
+	if g == nil {
+		return
+	}
+	top, bot := clamp(e.Top, 0, g.Height), clamp(e.Bot, 0, g.Height)
+	left, right := clamp(e.Left, 0, g.Width), clamp(e.Right, 0, g.Width)
+	if top >= bot || left >= right {
+		return
+	}
+
+	if e.Rows > 0 {
+		for i := top; i+e.Rows < bot; i++ {
+			copy(g.Cells[i][left:right], g.Cells[i+e.Rows][left:right])
+		}
+	} else if e.Rows < 0 {
+		for i := bot - 1; i+e.Rows >= top; i-- {
+			copy(g.Cells[i][left:right], g.Cells[i+e.Rows][left:right])
+		}
+	}
+}
+
+func clamp(x, lo, hi int) int {
+	if x < lo {
+		return lo
+	}
+	if x > hi {
+		return hi
+	}
+	return x
+}
+
+// placeFloat places the grid of a floating window relative to its anchor
+// grid.
+func (s *Screen) placeFloat(e *WinFloatPos) {
+	row, col := int(e.AnchorRow), int(e.AnchorCol)
+	if g := s.grids[e.Grid]; g != nil {
+		switch e.Anchor {
+		case "NE":
+			col -= g.Width
+		case "SW":
+			row -= g.Height
+		case "SE":
+			row -= g.Height
+			col -= g.Width
+		}
+	}
+	if e.AnchorGrid != 1 {
+		if p := s.placements[e.AnchorGrid]; p != nil {
+			row += p.Row
+			col += p.Col
+		}
+	}
+	s.placements[e.Grid] = &Placement{
+		Grid:   e.Grid,
+		Win:    e.Win,
+		Row:    row,
+		Col:    col,
+		Float:  true,
+		ZIndex: e.ZIndex,
+	}
+}
+
+// Snapshot returns a copy of the state of the screen.
+func (s *Screen) Snapshot() *Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshot()
+}
+
+// Flushes returns the number of flush events handled by the screen.
+func (s *Screen) Flushes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushes
+}
+
+// snapshot returns a copy of the state of the screen. The caller must hold
+// s.mu.
+func (s *Screen) snapshot() *Snapshot {
+	snap := &Snapshot{
+		Grids:         make(map[int]*Grid, len(s.grids)),
+		Placements:    make(map[int]Placement, len(s.placements)),
+		HLAttrs:       make(map[int]HLAttr, len(s.hlAttrs)),
+		CtermAttrs:    make(map[int]HLAttr, len(s.ctermAttrs)),
+		HLGroups:      make(map[string]int, len(s.hlGroups)),
+		DefaultColors: s.defaultColors,
+		Mode:          s.mode,
+		Options:       make(map[string]any, len(s.options)),
+		Title:         s.title,
+		Cursor:        s.cursor,
+	}
+	if s.modeIdx >= 0 && s.modeIdx < len(s.modeInfo) {
+		mi := s.modeInfo[s.modeIdx]
+		snap.ModeInfo = &mi
+	}
+	for id, g := range s.grids {
+		snap.Grids[id] = g.clone()
+	}
+	for id, p := range s.placements {
+		snap.Placements[id] = *p
+	}
+	for id, a := range s.hlAttrs {
+		snap.HLAttrs[id] = a
+	}
+	for id, a := range s.ctermAttrs {
+		snap.CtermAttrs[id] = a
+	}
+	for name, id := range s.hlGroups {
+		snap.HLGroups[name] = id
+	}
+	for name, v := range s.options {
+		snap.Options[name] = v
+	}
+	snap.compose()
+	return snap
+}
+
+func (g *Grid) clone() *Grid {
+	c := *g
+	c.Cells = make([][]ScreenCell, len(g.Cells))
+	for i, row := range g.Cells {
+		c.Cells[i] = append([]ScreenCell(nil), row...)
+	}
+	return &c
+}
+
+// Snapshot is a copy of the state of a Screen.
+type Snapshot struct {
+	// Width and Height are the size of the global grid.
+	Width  int
+	Height int
+
+	// Cells are the rows of the screen: the global grid with the visible
+	// window grids, the message grid and the floating windows drawn on top.
+	Cells [][]ScreenCell
+
+	// Cursor is the position of the cursor. The Row and Col of the cursor
+	// are relative to the screen when the cursor grid is composited, and
+	// relative to the cursor grid otherwise.
+	Cursor Cursor
+
+	// Grids are the grids by id.
+	Grids map[int]*Grid
+
+	// Placements are the placements of the grids other than the global
+	// grid by grid id.
+	Placements map[int]Placement
+
+	// HLAttrs and CtermAttrs are the RGB and cterm highlight attributes by
+	// id.
+	HLAttrs    map[int]HLAttr
+	CtermAttrs map[int]HLAttr
+
+	// HLGroups are the highlight attribute ids of the builtin highlight
+	// groups.
+	HLGroups map[string]int
+
+	// DefaultColors are the default colors.
+	DefaultColors DefaultColorsSet
+
+	// Mode is the current mode and ModeInfo is the cursor style of the mode,
+	// or nil.
+	Mode     string
+	ModeInfo *ModeInfo
+
+	// Options are the UI options set by option_set events.
+	Options map[string]any
+
+	// Title is the title set by the set_title event.
+	Title string
+
+	// cursorOnScreen is whether the cursor grid is composited.
+	cursorOnScreen bool
+}
+
+// compose draws the grids on the global grid.
+func (snap *Snapshot) compose() {
+	global := snap.Grids[1]
+	if global == nil {
+		snap.Cells = [][]ScreenCell{}
+		return
+	}
+	snap.Width, snap.Height = global.Width, global.Height
+	snap.Cells = global.clone().Cells
+	snap.cursorOnScreen = snap.Cursor.Grid == 1
+
+	// Windows are drawn in grid order, then the message grid and the floats
+	// by z-index.
+	var placements []Placement
+	for _, p := range snap.Placements {
+		if !p.Hidden && !p.External && snap.Grids[p.Grid] != nil {
+			placements = append(placements, p)
+		}
+	}
+	sort.Slice(placements, func(i, j int) bool {
+		pi, pj := placements[i], placements[j]
+		if li, lj := layer(pi), layer(pj); li != lj {
+			return li < lj
+		}
+		if pi.ZIndex != pj.ZIndex {
+			return pi.ZIndex < pj.ZIndex
+		}
+		return pi.Grid < pj.Grid
+	})
+
+	for _, p := range placements {
+		g := snap.Grids[p.Grid]
+		for r := 0; r < g.Height; r++ {
+			sr := p.Row + r
+			if sr < 0 || sr >= snap.Height {
+				continue
+			}
+			for c := 0; c < g.Width; c++ {
+				sc := p.Col + c
+				if sc < 0 || sc >= snap.Width {
+					continue
+				}
+				snap.Cells[sr][sc] = g.Cells[r][c]
+			}
+		}
+		if snap.Cursor.Grid == p.Grid {
+			snap.Cursor.Row += p.Row
+			snap.Cursor.Col += p.Col
+			snap.cursorOnScreen = true
+		}
+	}
+}
+
+// layer returns the compositing layer of p.
+func layer(p Placement) int {
+	if p.Float || p.Message {
+		return 1
+	}
+	return 0
+}
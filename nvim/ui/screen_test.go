@@ -0,0 +1,204 @@
+package ui
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// screenRows returns the text of the rows of snap.
+func screenRows(snap *Snapshot) []string {
+	rows := make([]string, len(snap.Cells))
+	for i, row := range snap.Cells {
+		var b strings.Builder
+		for _, c := range row {
+			b.WriteString(c.Text)
+		}
+		rows[i] = b.String()
+	}
+	return rows
+}
+
+func handleEvents(s *Screen, events ...Event) {
+	for _, e := range events {
+		s.HandleEvent(e)
+	}
+}
+
+func line(grid, row, col int, text string, hlID int) *GridLine {
+	e := &GridLine{Grid: grid, Row: row, ColStart: col}
+	for _, r := range text {
+		e.Cells = append(e.Cells, Cell{Text: string(r), HLID: hlID, Repeat: 1})
+	}
+	return e
+}
+
+func TestScreenGridLine(t *testing.T) {
+	t.Parallel()
+
+	s := NewScreen()
+	handleEvents(s,
+		&GridResize{Grid: 1, Width: 8, Height: 2},
+		&GridLine{Grid: 1, Row: 0, ColStart: 0, Cells: []Cell{
+			{Text: "a", HLID: 1, Repeat: 1},
+			{Text: "-", HLID: 2, Repeat: 3},
+			{Text: "世", HLID: 2, Repeat: 1},
+			{Text: "", HLID: 2, Repeat: 1},
+			{Text: "x", HLID: 0, Repeat: 5},
+		}},
+		&GridCursorGoto{Grid: 1, Row: 1, Col: 2},
+	)
+
+	snap := s.Snapshot()
+	if got, want := screenRows(snap), []string{"a---世xx", "        "}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("rows are %q, want %q", got, want)
+	}
+	var ids []int
+	for _, c := range snap.Cells[0] {
+		ids = append(ids, c.HLID)
+	}
+	if want := []int{1, 2, 2, 2, 2, 2, 0, 0}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("highlight ids are %v, want %v", ids, want)
+	}
+	if want := (Cursor{Grid: 1, Row: 1, Col: 2}); snap.Cursor != want {
+		t.Fatalf("cursor is %+v, want %+v", snap.Cursor, want)
+	}
+
+	// Resizing keeps the cells inside the new size.
+	handleEvents(s, &GridResize{Grid: 1, Width: 3, Height: 3})
+	if got, want := screenRows(s.Snapshot()), []string{"a--", "   ", "   "}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("rows after resize are %q, want %q", got, want)
+	}
+
+	handleEvents(s, &GridClear{Grid: 1})
+	if got, want := screenRows(s.Snapshot()), []string{"   ", "   ", "   "}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("rows after clear are %q, want %q", got, want)
+	}
+}
+
+func TestScreenScroll(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		scroll *GridScroll
+		want   []string
+	}{
+		"Up": {
+			scroll: &GridScroll{Grid: 1, Top: 0, Bot: 4, Left: 0, Right: 3, Rows: 1},
+			want:   []string{"bbb", "ccc", "ddd", "ddd"},
+		},
+		"Down": {
+			scroll: &GridScroll{Grid: 1, Top: 0, Bot: 4, Left: 0, Right: 3, Rows: -2},
+			want:   []string{"aaa", "bbb", "aaa", "bbb"},
+		},
+		"Region": {
+			scroll: &GridScroll{Grid: 1, Top: 1, Bot: 3, Left: 1, Right: 2, Rows: 1},
+			want:   []string{"aaa", "bcb", "ccc", "ddd"},
+		},
+	}
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			s := NewScreen()
+			handleEvents(s,
+				&GridResize{Grid: 1, Width: 3, Height: 4},
+				line(1, 0, 0, "aaa", 0),
+				line(1, 1, 0, "bbb", 0),
+				line(1, 2, 0, "ccc", 0),
+				line(1, 3, 0, "ddd", 0),
+				tt.scroll,
+			)
+			if got := screenRows(s.Snapshot()); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("rows are %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScreenMultigrid(t *testing.T) {
+	t.Parallel()
+
+	s := NewScreen()
+	handleEvents(s,
+		&GridResize{Grid: 1, Width: 8, Height: 5},
+		&GridResize{Grid: 2, Width: 4, Height: 2},
+		line(2, 0, 0, "win2", 0),
+		line(2, 1, 0, "text", 0),
+		&WinPos{Grid: 2, Win: 1000, StartRow: 1, StartCol: 1, Width: 4, Height: 2},
+		&GridResize{Grid: 3, Width: 2, Height: 1},
+		line(3, 0, 0, "FL", 0),
+		&WinFloatPos{Grid: 3, Win: 1001, Anchor: "NE", AnchorGrid: 2, AnchorRow: 1, AnchorCol: 4, ZIndex: 50},
+		&GridResize{Grid: 4, Width: 8, Height: 1},
+		line(4, 0, 0, "message", 0),
+		&MsgSetPos{Grid: 4, Row: 4},
+		&GridResize{Grid: 5, Width: 2, Height: 1},
+		line(5, 0, 0, "HH", 0),
+		&WinPos{Grid: 5, Win: 1002, StartRow: 0, StartCol: 0, Width: 2, Height: 1},
+		&WinHide{Grid: 5},
+		&GridCursorGoto{Grid: 2, Row: 1, Col: 2},
+	)
+
+	snap := s.Snapshot()
+	want := []string{
+		"        ",
+		" win2   ",
+		" teFL   ",
+		"        ",
+		"message ",
+	}
+	if got := screenRows(snap); !reflect.DeepEqual(got, want) {
+		t.Fatalf("rows are %q, want %q", got, want)
+	}
+	if want := (Cursor{Grid: 2, Row: 2, Col: 3}); snap.Cursor != want {
+		t.Fatalf("cursor is %+v, want %+v", snap.Cursor, want)
+	}
+	if p := snap.Placements[3]; !p.Float || p.Row != 2 || p.Col != 3 {
+		t.Fatalf("placement of float is %+v, want float at 2, 3", p)
+	}
+
+	handleEvents(s, &WinClose{Grid: 3}, &GridDestroy{Grid: 3})
+	if got := screenRows(s.Snapshot())[2]; got != " text   " {
+		t.Fatalf("row 2 after closing the float is %q, want %q", got, " text   ")
+	}
+}
+
+func TestScreenFlush(t *testing.T) {
+	t.Parallel()
+
+	var snaps []*Snapshot
+	s := NewScreen(ScreenFlushFunc(func(snap *Snapshot) {
+		snaps = append(snaps, snap)
+	}))
+	handleEvents(s,
+		&DefaultColorsSet{RGBFg: 0xffffff, RGBBg: 0, RGBSp: 0xff0000, CtermFg: 15, CtermBg: 0},
+		&HLAttrDefine{ID: 1, RGBAttr: HLAttr{Foreground: 0x00ff00, Background: -1, Special: -1, Bold: true}},
+		&ModeInfoSet{CursorStyleEnabled: true, ModeInfo: []ModeInfo{{Name: "normal"}, {Name: "insert", CursorShape: "vertical"}}},
+		&ModeChange{Mode: "insert", ModeIdx: 1},
+		&GridResize{Grid: 1, Width: 2, Height: 1},
+		line(1, 0, 0, "ab", 1),
+		&Flush{},
+		line(1, 0, 0, "cd", 0),
+	)
+
+	if len(snaps) != 1 || s.Flushes() != 1 {
+		t.Fatalf("flush func called %d times, Flushes() = %d, want 1", len(snaps), s.Flushes())
+	}
+	snap := snaps[0]
+	if got, want := screenRows(snap), []string{"ab"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("rows of flushed snapshot are %q, want %q", got, want)
+	}
+	if got := snap.HLAttrs[1]; !got.Bold || got.Foreground != 0x00ff00 {
+		t.Fatalf("highlight attribute 1 is %+v", got)
+	}
+	if snap.DefaultColors.RGBFg != 0xffffff {
+		t.Fatalf("default colors are %+v", snap.DefaultColors)
+	}
+	if snap.Mode != "insert" || snap.ModeInfo == nil || snap.ModeInfo.CursorShape != "vertical" {
+		t.Fatalf("mode is %q with info %+v, want insert with vertical cursor", snap.Mode, snap.ModeInfo)
+	}
+	if got, want := screenRows(s.Snapshot()), []string{"cd"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("rows are %q, want %q", got, want)
+	}
+}
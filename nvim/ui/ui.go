@@ -0,0 +1,146 @@
+// Package ui decodes the redraw notifications that Nvim sends to remote UIs
+// into typed events.
+//
+// Register a Handler with an Nvim client and attach the client as a UI with
+// the ext_linegrid option:
+//
+//	err := ui.Register(v, ui.HandlerFunc(func(e ui.Event) {
+//	    switch e := e.(type) {
+//	    case *ui.GridLine:
+//	        // update the grid
+//	    case *ui.Flush:
+//	        // display the grid
+//	    }
+//	}))
+//	...
+//	err = v.AttachUI(80, 24, map[string]any{"rgb": true, "ext_linegrid": true})
+//
+// The events of the linegrid, multigrid, popupmenu, tabline, cmdline and
+// messages UI extensions are decoded. Unknown events and events with
+// arguments of unexpected types are skipped.
+//
+// Screen is a Handler that maintains a model of the screen. Render writes a
+// Snapshot of the screen as plain text, ANSI colored text or HTML.
+//
+//	:help ui
+package ui
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/neovim/go-client/msgpack"
+	"github.com/neovim/go-client/nvim"
+)
+
+// RedrawEvent is the method name of the redraw notification.
+const RedrawEvent = "redraw"
+
+// Handler handles redraw events.
+type Handler interface {
+	// HandleEvent is called with the events of each redraw notification in
+	// order.
+	HandleEvent(e Event)
+}
+
+// HandlerFunc is an adapter to allow the use of ordinary functions as
+// Handlers.
+type HandlerFunc func(e Event)
+
+// HandleEvent calls f(e).
+func (f HandlerFunc) HandleEvent(e Event) {
+	f(e)
+}
+
+// compile time check whether the HandlerFunc implements Handler interface.
+var _ Handler = HandlerFunc(nil)
+
+// Register registers a handler for redraw notifications with v that decodes
+// the notifications and dispatches the events to h. Register replaces
+// handlers previously registered for the redraw method.
+func Register(v *nvim.Nvim, h Handler) error {
+	return v.RegisterHandler(RedrawEvent, func(batches ...Batch) {
+		Dispatch(h, batches...)
+	})
+}
+
+// Dispatch calls h with the events of batches in order.
+func Dispatch(h Handler, batches ...Batch) {
+	for _, b := range batches {
+		for _, e := range b {
+			h.HandleEvent(e)
+		}
+	}
+}
+
+// Batch is the events of an element of the arguments of a redraw
+// notification. An element is an array of the event name and the arguments
+// of one or more events with the name. Decode the arguments of a redraw
+// notification as []Batch.
+type Batch []Event
+
+// UnmarshalMsgPack implements msgpack.Unmarshaler.
+func (b *Batch) UnmarshalMsgPack(dec *msgpack.Decoder) error {
+	*b = nil
+	if dec.Type() != msgpack.ArrayLen {
+		return fmt.Errorf("ui: redraw batch is %v, want array", dec.Type())
+	}
+
+	n := dec.Len()
+	if n == 0 {
+		return nil
+	}
+	if err := dec.Unpack(); err != nil {
+		return err
+	}
+
+	var newEvent func() Event
+	if t := dec.Type(); t == msgpack.String || t == msgpack.Binary {
+		newEvent = eventTypes[dec.String()]
+	} else if err := dec.Skip(); err != nil {
+		return err
+	}
+
+	events := make(Batch, 0, n-1)
+	for i := 1; i < n; i++ {
+		if newEvent == nil {
+			if err := skipValue(dec); err != nil {
+				return err
+			}
+			continue
+		}
+
+		e := newEvent()
+		if reflect.TypeOf(e).Elem().NumField() == 0 {
+			// Events without arguments have an empty array.
+			if err := skipValue(dec); err != nil {
+				return err
+			}
+			events = append(events, e)
+			continue
+		}
+
+		if err := dec.Decode(e); err != nil {
+			var convErr *msgpack.DecodeConvertError
+			if errors.As(err, &convErr) {
+				continue
+			}
+			return err
+		}
+		if gl, ok := e.(*GridLine); ok {
+			gl.fillHLIDs()
+		}
+		events = append(events, e)
+	}
+	*b = events
+	return nil
+}
+
+// skipValue skips the next value in the stream.
+func skipValue(dec *msgpack.Decoder) error {
+	if err := dec.Unpack(); err != nil {
+		return err
+	}
+	return dec.Skip()
+}
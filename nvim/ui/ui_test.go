@@ -0,0 +1,155 @@
+package ui
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/neovim/go-client/msgpack"
+	"github.com/neovim/go-client/nvim"
+)
+
+func decodeBatches(tb testing.TB, args ...any) []Batch {
+	tb.Helper()
+
+	var buf bytes.Buffer
+	if err := msgpack.NewEncoder(&buf).Encode(args); err != nil {
+		tb.Fatal(err)
+	}
+	var batches []Batch
+	if err := msgpack.NewDecoder(&buf).Decode(&batches); err != nil {
+		tb.Fatal(err)
+	}
+	return batches
+}
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		batch []any
+		want  Batch
+	}{
+		"GridLine": {
+			batch: []any{"grid_line",
+				[]any{1, 2, 3, []any{[]any{"a", 5}, []any{" ", 6, 3}, []any{"b"}, []any{"世", 0}, []any{""}}, false},
+				[]any{1, 3, 0, []any{[]any{"c", 7, 2}}, true},
+			},
+			want: Batch{
+				&GridLine{Grid: 1, Row: 2, ColStart: 3, Cells: []Cell{
+					{Text: "a", HLID: 5, Repeat: 1},
+					{Text: " ", HLID: 6, Repeat: 3},
+					{Text: "b", HLID: 6, Repeat: 1},
+					{Text: "世", HLID: 0, Repeat: 1},
+					{Text: "", HLID: 0, Repeat: 1},
+				}},
+				&GridLine{Grid: 1, Row: 3, ColStart: 0, Cells: []Cell{{Text: "c", HLID: 7, Repeat: 2}}, Wrap: true},
+			},
+		},
+		"GridResize": {
+			batch: []any{"grid_resize", []any{1, 80, 24}},
+			want:  Batch{&GridResize{Grid: 1, Width: 80, Height: 24}},
+		},
+		"GridScroll": {
+			batch: []any{"grid_scroll", []any{1, 0, 10, 0, 80, -2, 0}},
+			want:  Batch{&GridScroll{Grid: 1, Top: 0, Bot: 10, Left: 0, Right: 80, Rows: -2}},
+		},
+		"HLAttrDefine": {
+			batch: []any{"hl_attr_define",
+				[]any{3, map[string]any{"foreground": 0xff0000, "bold": true}, map[string]any{"background": 4}, []any{map[string]any{"kind": "ui", "ui_name": "Visual"}}},
+			},
+			want: Batch{&HLAttrDefine{
+				ID:        3,
+				RGBAttr:   HLAttr{Foreground: 0xff0000, Background: -1, Special: -1, Bold: true},
+				CtermAttr: HLAttr{Foreground: -1, Background: 4, Special: -1},
+				Info:      []map[string]any{{"kind": "ui", "ui_name": "Visual"}},
+			}},
+		},
+		"ModeInfoSet": {
+			batch: []any{"mode_info_set", []any{true, []any{map[string]any{"cursor_shape": "block", "name": "normal", "attr_id": 0}}}},
+			want:  Batch{&ModeInfoSet{CursorStyleEnabled: true, ModeInfo: []ModeInfo{{CursorShape: "block", Name: "normal"}}}},
+		},
+		"WinFloatPos": {
+			batch: []any{"win_float_pos", []any{4, nvim.Window(1001), "NW", 1, 2.0, 3.5, true, 50}},
+			want:  Batch{&WinFloatPos{Grid: 4, Win: 1001, Anchor: "NW", AnchorGrid: 1, AnchorRow: 2, AnchorCol: 3.5, MouseEnabled: true, ZIndex: 50}},
+		},
+		"TablineUpdate": {
+			batch: []any{"tabline_update", []any{nvim.Tabpage(1), []any{map[string]any{"tab": nvim.Tabpage(1), "name": "a.go"}}, nvim.Buffer(2), []any{map[string]any{"buffer": nvim.Buffer(2), "name": "a.go"}}}},
+			want:  Batch{&TablineUpdate{Curtab: 1, Tabs: []TablineTab{{Tab: 1, Name: "a.go"}}, Curbuf: 2, Buffers: []TablineBuffer{{Buffer: 2, Name: "a.go"}}}},
+		},
+		"MsgShow": {
+			batch: []any{"msg_show", []any{"echo", []any{[]any{0, "hello", 12}}, false}},
+			want:  Batch{&MsgShow{Kind: "echo", Content: []Chunk{{AttrID: 0, Text: "hello", HLID: 12}}}},
+		},
+		"PopupmenuShow": {
+			batch: []any{"popupmenu_show", []any{[]any{[]any{"word", "v", "", ""}}, -1, 1, 2, 1}},
+			want:  Batch{&PopupmenuShow{Items: []PopupmenuItem{{Word: "word", Kind: "v"}}, Selected: -1, Row: 1, Col: 2, Grid: 1}},
+		},
+		"NoArgs": {
+			batch: []any{"flush", []any{}},
+			want:  Batch{&Flush{}},
+		},
+		"Unknown": {
+			batch: []any{"unknown_event", []any{1, 2}, []any{"x"}},
+			want:  Batch{},
+		},
+		"BadArgs": {
+			batch: []any{"grid_resize", []any{"one", 80, 24}, []any{2, 10, 5}},
+			want:  Batch{&GridResize{Grid: 2, Width: 10, Height: 5}},
+		},
+	}
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			batches := decodeBatches(t, tt.batch)
+			if len(batches) != 1 {
+				t.Fatalf("decoded %d batches, want 1", len(batches))
+			}
+			if got := batches[0]; len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegister(t *testing.T) {
+	t.Parallel()
+
+	v, peer, err := nvim.NewPipe(t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	events := make(chan Event, 10)
+	if err := Register(v, HandlerFunc(func(e Event) { events <- e })); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := peer.Notify(RedrawEvent,
+		[]any{"grid_resize", []any{1, 10, 2}},
+		[]any{"grid_cursor_goto", []any{1, 0, 1}},
+		[]any{"flush", []any{}},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Event{
+		&GridResize{Grid: 1, Width: 10, Height: 2},
+		&GridCursorGoto{Grid: 1, Row: 0, Col: 1},
+		&Flush{},
+	}
+	for _, w := range want {
+		select {
+		case got := <-events:
+			if !reflect.DeepEqual(got, w) {
+				t.Fatalf("got %#v, want %#v", got, w)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout waiting for %s event", w.EventName())
+		}
+	}
+}